@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostACL decides which clients may talk to our listener. It is built once
+// from ListenerConfig when the configuration is read.
+type hostACL struct {
+	allowed []*net.IPNet // client networks allowed to access the listener
+	proxies []*net.IPNet // proxies/load balancers whose X-Forwarded-For we trust
+}
+
+// https://docs.aws.amazon.com/general/latest/gr/aws-ip-ranges.html
+type AWS_IPRanges struct {
+	Prefixes     []AWS_IPPrefix `json:"prefixes"`
+	IPv6Prefixes []AWS_IPPrefix `json:"ipv6_prefixes"`
+}
+type AWS_IPPrefix struct {
+	IPPrefix   string `json:"ip_prefix"`
+	IPv6Prefix string `json:"ipv6_prefix"`
+	Region     string `json:"region"`
+	Service    string `json:"service"`
+}
+
+var listenerACL = &hostACL{}
+
+func buildACL(c ListenerConfig) (*hostACL, error) {
+	acl := &hostACL{}
+	var err error
+	if acl.allowed, err = parseCIDRs(c.AllowedNetworks); err != nil {
+		return nil, fmt.Errorf("AllowedNetworks: %s", err)
+	}
+	if acl.proxies, err = parseCIDRs(c.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("TrustedProxies: %s", err)
+	}
+	if c.AWSIPRangesFile != "" {
+		awsNets, err := loadAWSIPRanges(c.AWSIPRangesFile, c.AWSIPRangesServices, c.AWSIPRangesRegions)
+		if err != nil {
+			return nil, fmt.Errorf("AWSIPRangesFile: %s", err)
+		}
+		acl.allowed = append(acl.allowed, awsNets...)
+	}
+	return acl, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	// Accepts IPv4/IPv6 networks in CIDR notation; plain IPs are treated as /32 resp. /128.
+	var result []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s'", cidr)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func loadAWSIPRanges(filename string, services []string, regions []string) ([]*net.IPNet, error) {
+	// Reads AWS' published ip-ranges.json and returns the prefixes matching services and regions.
+	// SNS has no service of its own in ip-ranges.json; its deliveries originate from AMAZON ranges --
+	// which include EC2, i.e. any AWS customer. Both must be given, so the ACL is not opened up by default.
+	if len(services) == 0 || len(regions) == 0 {
+		return nil, fmt.Errorf("AWSIPRangesServices and AWSIPRangesRegions must be set")
+	}
+	fileContents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var ranges AWS_IPRanges
+	if err := json.Unmarshal(fileContents, &ranges); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %s", filename, err)
+	}
+	var cidrs []string
+	for _, prefix := range append(ranges.Prefixes, ranges.IPv6Prefixes...) {
+		if !contains(services, prefix.Service) {
+			continue
+		}
+		if !contains(regions, prefix.Region) {
+			continue
+		}
+		if prefix.IPPrefix != "" {
+			cidrs = append(cidrs, prefix.IPPrefix)
+		} else {
+			cidrs = append(cidrs, prefix.IPv6Prefix)
+		}
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no prefixes found for services %s in regions %s", services, regions)
+	}
+	return parseCIDRs(cidrs)
+}
+
+func (acl *hostACL) isOpen() bool {
+	return len(acl.allowed) == 0
+}
+
+func (acl *hostACL) clientIP(request *http.Request) net.IP {
+	// Returns the IP of the client. If the connection comes from a trusted proxy,
+	// X-Forwarded-For is walked from right to left, skipping further trusted proxies.
+	remote, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		remote = request.RemoteAddr
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil || !ipInNets(ip, acl.proxies) {
+		return ip
+	}
+	var forwarded []string
+	for _, header := range request.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// garbage in the chain -- don't trust anything left of it
+			return ip
+		}
+		ip = hop
+		if !ipInNets(hop, acl.proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func (acl *hostACL) allows(ip net.IP) bool {
+	if acl.isOpen() {
+		return true
+	}
+	return ip != nil && ipInNets(ip, acl.allowed)
+}
+
+func ipInNets(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
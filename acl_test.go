@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		cidr     string
+		expected string // "" if invalid
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{" 192.168.1.7 ", "192.168.1.7/32"},
+		{"fd00::/8", "fd00::/8"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"::ffff:10.1.2.3", "10.1.2.3/32"},
+		{"10.0.0.0/33", ""},
+		{"10.0.0", ""},
+		{"example.com", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		networks, err := parseCIDRs([]string{test.cidr})
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("parseCIDRs(%q): expected error, got %v", test.cidr, networks)
+			}
+			continue
+		}
+		if err != nil || len(networks) != 1 || networks[0].String() != test.expected {
+			t.Errorf("parseCIDRs(%q) = %v, %v; want %s", test.cidr, networks, err, test.expected)
+		}
+	}
+}
+
+func TestClientIPAndAllows(t *testing.T) {
+	acl, err := buildACL(ListenerConfig{AllowedNetworks: []string{"192.168.0.0/16", "fd00::/8"},
+		TrustedProxies: []string{"10.0.0.0/24", "fd00:1::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		client    string
+		allowed   bool
+	}{
+		{"direct", "192.168.1.1:4711", nil, "192.168.1.1", true},
+		{"direct, not allowed", "172.16.0.1:4711", nil, "172.16.0.1", false},
+		{"direct IPv6", "[fd00::5]:4711", nil, "fd00::5", true},
+		{"spoofed XFF from untrusted client", "172.16.0.1:4711", []string{"192.168.1.1"}, "172.16.0.1", false},
+		{"via proxy", "10.0.0.5:4711", []string{"192.168.1.1"}, "192.168.1.1", true},
+		{"via proxy, not allowed", "10.0.0.5:4711", []string{"172.16.0.1"}, "172.16.0.1", false},
+		{"spoofed XFF via proxy", "10.0.0.5:4711", []string{"192.168.1.1, 172.16.0.1"}, "172.16.0.1", false},
+		{"chained proxies", "10.0.0.5:4711", []string{"192.168.1.1, 10.0.0.7"}, "192.168.1.1", true},
+		{"repeated headers", "10.0.0.5:4711", []string{"172.16.0.1", "192.168.1.1"}, "192.168.1.1", true},
+		{"IPv6 proxy", "[fd00:1::1]:4711", []string{"fd00::5"}, "fd00::5", true},
+		{"malformed XFF", "10.0.0.5:4711", []string{"192.168.1.1, garbage"}, "10.0.0.5", false},
+		{"only proxies", "10.0.0.5:4711", []string{"10.0.0.6"}, "10.0.0.6", false},
+		{"no port", "192.168.1.1", nil, "192.168.1.1", true},
+		{"unparsable remote", "unix-socket", nil, "", false},
+	}
+	for _, test := range tests {
+		request := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		for _, header := range test.forwarded {
+			request.Header.Add("X-Forwarded-For", header)
+		}
+		ip := acl.clientIP(request)
+		if (ip == nil && test.client != "") || (ip != nil && !ip.Equal(net.ParseIP(test.client))) {
+			t.Errorf("%s: clientIP = %v, want %s", test.name, ip, test.client)
+		}
+		if allowed := acl.allows(ip); allowed != test.allowed {
+			t.Errorf("%s: allows(%v) = %t, want %t", test.name, ip, allowed, test.allowed)
+		}
+	}
+
+	if open := (&hostACL{}); !open.allows(nil) {
+		t.Error("ACL without networks must allow everyone")
+	}
+}
+
+func TestLoadAWSIPRanges(t *testing.T) {
+	rangesFile := filepath.Join(t.TempDir(), "ip-ranges.json")
+	ranges := `{"prefixes": [
+		{"ip_prefix": "3.5.140.0/22", "region": "eu-west-1", "service": "AMAZON"},
+		{"ip_prefix": "3.5.144.0/22", "region": "us-east-1", "service": "AMAZON"},
+		{"ip_prefix": "52.94.0.0/22", "region": "eu-west-1", "service": "EC2"}],
+	"ipv6_prefixes": [
+		{"ipv6_prefix": "2a05:d018::/36", "region": "eu-west-1", "service": "AMAZON"}]}`
+	if err := os.WriteFile(rangesFile, []byte(ranges), 0600); err != nil {
+		t.Fatal(err)
+	}
+	networks, err := loadAWSIPRanges(rangesFile, []string{"AMAZON"}, []string{"eu-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 || networks[0].String() != "3.5.140.0/22" || networks[1].String() != "2a05:d018::/36" {
+		t.Errorf("unexpected networks %v", networks)
+	}
+
+	for name, args := range map[string][2][]string{
+		"no services":    {nil, {"eu-west-1"}},
+		"no regions":     {{"AMAZON"}, nil},
+		"no match":       {{"S3"}, {"eu-west-1"}},
+		"unknown region": {{"AMAZON"}, {"eu-central-2"}},
+	} {
+		if _, err := loadAWSIPRanges(rangesFile, args[0], args[1]); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := loadAWSIPRanges(filepath.Join(t.TempDir(), "missing.json"), []string{"AMAZON"}, []string{"eu-west-1"}); err == nil {
+		t.Error("missing file: expected error")
+	}
+	os.WriteFile(rangesFile, []byte("not json"), 0600)
+	if _, err := loadAWSIPRanges(rangesFile, []string{"AMAZON"}, []string{"eu-west-1"}); err == nil {
+		t.Error("invalid file: expected error")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// AAZErrorEvent reports an ASG launch/terminate failure; a failed termination
+// means the instance (and thus its Zabbix host) may still be running.
+type AAZErrorEvent struct {
+	Time                 time.Time `json:"time"`
+	Event                string    `json:"event"`
+	AutoScalingGroupName string    `json:"autoScalingGroupName"`
+	InstanceId           string    `json:"instanceId,omitempty"`
+	StatusMessage        string    `json:"statusMessage,omitempty"`
+	Cause                string    `json:"cause,omitempty"`
+	Source               string    `json:"source"`
+}
+
+func updateGroupStatus(group string, update func(status *AAZGroupStatus)) {
+	updateStatus(func(all *AAZStatus) {
+		if all.AutoScalingGroups == nil {
+			all.AutoScalingGroups = map[string]*AAZGroupStatus{}
+		}
+		status, ok := all.AutoScalingGroups[group]
+		if !ok {
+			status = &AAZGroupStatus{}
+			all.AutoScalingGroups[group] = status
+		}
+		update(status)
+	})
+}
+
+func handleGroupEvent(event aazEvent) {
+	// Records test notifications and surfaces launch/terminate errors of managed ASGs.
+	if !contains(currentConfig().AutoScale.managedGroups(), event.AutoScalingGroupName) {
+		log.Printf("NOTICE: Received '%s' for other ASG '%s' (ignored)", event.Event, event.AutoScalingGroupName)
+		return
+	}
+	countNotification()
+	if event.Event == SNS_EV_Test {
+		log.Printf("NOTICE: Test notification received for ASG '%s' via %s", event.AutoScalingGroupName, event.Via)
+		now := time.Now()
+		updateGroupStatus(event.AutoScalingGroupName, func(status *AAZGroupStatus) {
+			status.LastTestNotification = &now
+		})
+		return
+	}
+	errorEvent := AAZErrorEvent{Time: time.Now(), Event: event.Event, AutoScalingGroupName: event.AutoScalingGroupName,
+		InstanceId: event.InstanceId, StatusMessage: event.StatusMessage, Cause: event.Cause, Source: event.Source}
+	log.Printf("ERROR: ASG '%s' reported %s for instance '%s': %s", event.AutoScalingGroupName, event.Event,
+		event.InstanceId, event.StatusMessage)
+	updateGroupStatus(event.AutoScalingGroupName, func(status *AAZGroupStatus) {
+		if event.Event == SNS_EV_LaunchError {
+			status.LaunchErrors++
+		} else {
+			status.TerminateErrors++
+		}
+		status.LastErrorEvent = &errorEvent
+	})
+	reportErrorEvent(errorEvent, currentConfig().ErrorEvents)
+	notify(aazNotification{Event: NotifyASGError, InstanceId: event.InstanceId, AutoScalingGroupName: event.AutoScalingGroupName,
+		Error: event.StatusMessage, Message: fmt.Sprintf("ASG '%s' reported %s for instance '%s': %s",
+			event.AutoScalingGroupName, event.Event, event.InstanceId, event.StatusMessage)})
+}
+
+func reportErrorEvent(errorEvent AAZErrorEvent, config ErrorEvents) {
+	// Forwards errorEvent to the Zabbix trapper item configured, if any; Webhooks get NotifyASGError.
+	payload, _ := json.Marshal(errorEvent)
+	if config.ZabbixSender != "" {
+		if err := zabbixSend(config.ZabbixSender, config.TrapperHost, config.TrapperKey, string(payload)); err != nil {
+			log.Printf("ERROR: Sending error event to Zabbix trapper failed: %s", err)
+			countError()
+		}
+	}
+}
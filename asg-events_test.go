@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeZabbixSender accepts trapper values like a Zabbix server; values are sent to received.
+func fakeZabbixSender(t *testing.T) (string, chan ZabbixSender_Values) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan ZabbixSender_Values, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			header := make([]byte, len(ZabbixSender_Header)+8)
+			io.ReadFull(conn, header)
+			body := make([]byte, binary.LittleEndian.Uint64(header[len(ZabbixSender_Header):]))
+			io.ReadFull(conn, body)
+			var request ZabbixSender_Request
+			json.Unmarshal(body, &request)
+			for _, values := range request.Data {
+				received <- values
+			}
+			response, _ := json.Marshal(ZabbixSender_Response{Response: "success",
+				Info: "processed: 1; failed: 0; total: 1; seconds spent: 0.000055"})
+			packet := bytes.NewBufferString(ZabbixSender_Header)
+			binary.Write(packet, binary.LittleEndian, uint64(len(response)))
+			packet.Write(response)
+			conn.Write(packet.Bytes())
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestTestNotificationRecordedPerASG(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	postSNS(snsNotification(SNS_EV_Test, "", "web"))
+	postSNS(snsNotification(SNS_EV_Test, "", "other"))
+
+	if status := statusSnapshot().AutoScalingGroups["web"]; status == nil || status.LastTestNotification == nil {
+		t.Errorf("test notification not recorded: %+v", statusSnapshot().AutoScalingGroups)
+	}
+	if _, ok := statusSnapshot().AutoScalingGroups["other"]; ok {
+		t.Error("test notification of unmanaged ASG recorded")
+	}
+	if statusSnapshot().Notifications != 1 || statusSnapshot().Errors != 0 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
+
+func TestErrorEventsReported(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	webhook := make(chan aazNotification, 10)
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification aazNotification
+		json.NewDecoder(r.Body).Decode(&notification)
+		webhook <- notification
+	}))
+	defer webhookServer.Close()
+	sender, trapper := fakeZabbixSender(t)
+	config := currentConfig()
+	config.ErrorEvents = ErrorEvents{ZabbixSender: sender, TrapperHost: "aaz", TrapperKey: "aaz.asg.error"}
+	config.Webhooks = []WebhookConfig{{Name: "asg-errors", URL: webhookServer.URL, Events: []string{NotifyASGError}}}
+	setConfig(config, currentACL())
+
+	message, _ := json.Marshal(SNS_Message{Event: SNS_EV_TerminateError, EC2InstanceId: "i-0aaa", AutoScalingGroupName: "web",
+		StatusMessage: "Instance is protected from termination"})
+	postSNS(snsEnvelope(string(message)))
+	postSNS(snsNotification(SNS_EV_LaunchError, "i-0bbb", "web"))
+
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Error("host of instance failing to terminate deleted")
+	}
+	status := statusSnapshot().AutoScalingGroups["web"]
+	if status == nil || status.TerminateErrors != 1 || status.LaunchErrors != 1 || status.LastErrorEvent.InstanceId != "i-0bbb" {
+		t.Errorf("unexpected ASG status %+v", status)
+	}
+	if notification := <-webhook; notification.InstanceId != "i-0aaa" || notification.Error != "Instance is protected from termination" {
+		t.Errorf("unexpected webhook payload %+v", notification)
+	}
+	if notification := <-webhook; notification.InstanceId != "i-0bbb" {
+		t.Errorf("unexpected webhook payload %+v", notification)
+	}
+	select {
+	case notification := <-webhook:
+		t.Errorf("error event posted twice: %+v", notification)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if values := <-trapper; values.Host != "aaz" || values.Key != "aaz.asg.error" {
+		t.Errorf("unexpected trapper values %+v", values)
+	}
+	if statusSnapshot().Errors != 0 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditEntry records a Zabbix change AAZ made, attempted or would make (dry-run).
+// Entries are appended to AuditConfig.File as JSON lines.
+type auditEntry struct {
+	Time       time.Time    `json:"time"`
+	Action     string       `json:"action"` // DELETE, DISABLE, ENABLE, CREATE, UPDATE or MAINTENANCE
+	InstanceId string       `json:"instanceId,omitempty"`
+	Before     *ZabbixHost  `json:"before,omitempty"` // host as known before the change
+	Trigger    auditTrigger `json:"trigger"`
+	Changes    []string     `json:"changes,omitempty"` // UPDATE only: values set, e.g. "tag aws:az=eu-west-1a"
+	Result     string       `json:"result"`            // Audit* constant
+	Error      string       `json:"error,omitempty"`
+}
+
+// auditTrigger tells what caused a change.
+type auditTrigger struct {
+	Source    string `json:"source"`              // Trigger* constant
+	Event     string `json:"event,omitempty"`     // event received, e.g. SNS_EV_Terminate
+	Via       string `json:"via,omitempty"`       // EventViaSNS, EventViaSQS or EventViaHTTP
+	MessageId string `json:"messageId,omitempty"` // EventBridge event id, SNS MessageId or SQS messageId
+	Client    string `json:"client,omitempty"`    // sender IP; plus client certificate subject, if any; CLI: operator
+	RunId     string `json:"runId,omitempty"`     // sync start time or fingerprint of plan applied
+}
+
+const (
+	TriggerEvent   = "event"   // SNS notification, SQS message or EventBridge event
+	TriggerSync    = "sync"    // reconcile run, see initalizeHosts(); or dry-run sync/plan using the CLI
+	TriggerApply   = "apply"   // saved plan applied using the CLI
+	TriggerRequeue = "requeue" // retry of a failed action, see retryFailedActions()
+	TriggerResume  = "resume"  // action interrupted by last shutdown, see resumePendingActions()
+	TriggerRestore = "restore" // host restored from its snapshot using the CLI, see restoreHost()
+
+	AuditActionCreate = "CREATE" // other actions: ScaleDownAction*, EC2ActionMaintenance
+	AuditActionUpdate = "UPDATE" // host enriched with EC2 metadata, see enrichHosts()
+	AuditActionEnable = "ENABLE" // host disabled by AAZ enabled again, see enableHosts()
+
+	AuditSuccess = "success"
+	AuditFailed  = "failed"
+	AuditVetoed  = "vetoed" // by a pre hook
+	AuditDryRun  = "dry-run"
+
+	DefaultAuditMaxSize    = 10 // MB
+	DefaultAuditMaxBackups = 5
+	DefaultAuditQueryLimit = 100
+	MaxAuditQueryLimit     = 1000
+)
+
+// the audit log file currently written to; see auditRecord()
+var auditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+	path  string
+	size  int64
+}
+
+func eventTrigger(event aazEvent) auditTrigger {
+	return auditTrigger{Source: TriggerEvent, Event: event.Event, Via: event.Via, MessageId: event.MessageId, Client: event.Client}
+}
+
+func auditClient(request *http.Request) string {
+	// Identifies the sender of a request: IP, plus subject of a verified client certificate.
+	client := currentACL().clientIP(request).String()
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		client += " (" + request.TLS.VerifiedChains[0][0].Subject.String() + ")"
+	}
+	return client
+}
+
+func cliTrigger(source string, runId string) auditTrigger {
+	// Trigger of changes made using the CLI, naming the operator as client.
+	trigger := auditTrigger{Source: source, RunId: runId}
+	if current, err := user.Current(); err == nil {
+		trigger.Client = current.Username
+	}
+	return trigger
+}
+
+func auditRecord(entry auditEntry) {
+	// Appends entry to the audit log, if configured; rotates the log when MaxSize is exceeded.
+	config := currentConfig().AuditConfig
+	if config.File == "" {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	line, _ := json.Marshal(entry)
+	line = append(line, '\n')
+
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	if err := auditOpen(config, int64(len(line))); err != nil {
+		log.Printf("ERROR: Cannot write audit log %s: %s", config.File, err)
+		countError()
+		return
+	}
+	n, err := auditLog.file.Write(line)
+	auditLog.size += int64(n)
+	if err != nil {
+		log.Printf("ERROR: Cannot write audit log %s: %s", config.File, err)
+		countError()
+	}
+}
+
+func auditOpen(config AuditConfig, pending int64) error {
+	// Opens (or reopens, if File changed) the audit log; rotates it first if pending bytes would exceed MaxSize.
+	// caller holds auditLog.mutex
+	if auditLog.file != nil && auditLog.path == config.File && auditLog.size+pending <= config.maxSize() {
+		return nil
+	}
+	if auditLog.file != nil {
+		auditLog.file.Close()
+		auditLog.file = nil
+	}
+	if info, err := os.Stat(config.File); err == nil && info.Size() > 0 && info.Size()+pending > config.maxSize() {
+		rotateAuditLog(config)
+	}
+	file, err := os.OpenFile(config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	auditLog.file, auditLog.path, auditLog.size = file, config.File, info.Size()
+	return nil
+}
+
+func rotateAuditLog(config AuditConfig) {
+	// File.N-1 -> File.N, ..., File -> File.1; the oldest backup is removed.
+	backups := config.maxBackups()
+	os.Remove(fmt.Sprintf("%s.%d", config.File, backups))
+	for i := backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", config.File, i), fmt.Sprintf("%s.%d", config.File, i+1))
+	}
+	if backups > 0 {
+		os.Rename(config.File, config.File+".1")
+	} else {
+		os.Remove(config.File)
+	}
+}
+
+func (c AuditConfig) maxSize() int64 {
+	if c.MaxSize <= 0 {
+		return DefaultAuditMaxSize << 20
+	}
+	return int64(c.MaxSize) << 20
+}
+
+func (c AuditConfig) maxBackups() int {
+	if c.MaxBackups <= 0 {
+		return DefaultAuditMaxBackups
+	}
+	return c.MaxBackups
+}
+
+func readAuditLog(config AuditConfig, limit int, match func(auditEntry) bool) ([]auditEntry, error) {
+	// Returns up to limit most recent matching entries, newest first; rotated files are read, too.
+	var entries []auditEntry
+	for i := config.maxBackups(); i >= 0; i-- {
+		path := config.File
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", config.File, i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var entry auditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || !match(entry) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+func auditHandler(w http.ResponseWriter, request *http.Request) {
+	// GET /audit?limit=N&instanceId=i-...&action=DELETE -- recent audit log entries, newest first.
+	if !hostIsAllowed(request) {
+		http.Error(w, "Not authorized", 401)
+		log.Printf("WARNING: Denied audit request (401) from %s", currentACL().clientIP(request))
+		countWarning()
+		return
+	}
+	if !clientCertVerified(request) {
+		http.Error(w, "Client certificate required", 403)
+		log.Printf("WARNING: Denied audit request (403, no client certificate) from %s", currentACL().clientIP(request))
+		countWarning()
+		return
+	}
+	config := currentConfig().AuditConfig
+	if config.File == "" {
+		http.Error(w, "Audit log not enabled (AuditConfig.File)", 404)
+		return
+	}
+	query := request.URL.Query()
+	limit := DefaultAuditQueryLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+		limit = min(parsed, MaxAuditQueryLimit)
+	}
+	instanceId, action := query.Get("instanceId"), query.Get("action")
+	entries, err := readAuditLog(config, limit, func(entry auditEntry) bool {
+		return (instanceId == "" || entry.InstanceId == instanceId) && (action == "" || entry.Action == action)
+	})
+	if err != nil {
+		log.Printf("ERROR: Cannot read audit log %s: %s", config.File, err)
+		countError()
+		http.Error(w, "Cannot read audit log", 500)
+		return
+	}
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func setAudit(t *testing.T, audit AuditConfig) string {
+	if audit.File == "" {
+		audit.File = filepath.Join(t.TempDir(), "audit.log")
+	}
+	config := currentConfig()
+	config.AuditConfig = audit
+	setConfig(config, currentACL())
+	return audit.File
+}
+
+func auditEntries(t *testing.T, match func(auditEntry) bool) []auditEntry {
+	entries, err := readAuditLog(currentConfig().AuditConfig, MaxAuditQueryLimit, match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAuditRecordsActions(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setGroup("web", "i-0bbb")
+	zabbix.addHosts("i-0aaa", "i-0bbb", "i-0ccc")
+	setAudit(t, AuditConfig{})
+	before, _ := zabbix.host("i-0aaa")
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	if err := initalizeHosts(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := auditEntries(t, func(auditEntry) bool { return true })
+	if len(entries) != 2 {
+		t.Fatalf("got %d audit entries, want 2: %+v", len(entries), entries)
+	}
+	sync, event := entries[0], entries[1] // newest first
+	wantTrigger := auditTrigger{Source: TriggerEvent, Event: SNS_EV_Terminate, Via: EventViaSNS, MessageId: "sns-i-0aaa", Client: "192.0.2.1"}
+	if event.InstanceId != "i-0aaa" || event.Action != ScaleDownActionDELETE || event.Result != AuditSuccess || event.Trigger != wantTrigger {
+		t.Errorf("unexpected entry %+v", event)
+	}
+	if event.Before == nil || event.Before.HostId != before.HostId || event.Before.Host != before.Host {
+		t.Errorf("got snapshot %+v, want %+v", event.Before, before)
+	}
+	if sync.InstanceId != "i-0ccc" || sync.Trigger.Source != TriggerSync || sync.Trigger.RunId == "" {
+		t.Errorf("unexpected entry %+v", sync)
+	}
+}
+
+func TestAuditRecordsFailures(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDISABLE)
+	zabbix.addHosts("i-0aaa")
+	zabbix.failHost("i-0aaa")
+	setAudit(t, AuditConfig{})
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	entries := auditEntries(t, func(entry auditEntry) bool { return entry.InstanceId == "i-0aaa" })
+	if len(entries) == 0 {
+		t.Fatal("failure not audited")
+	}
+	if entries[len(entries)-1].Result != AuditFailed || entries[len(entries)-1].Error == "" {
+		t.Errorf("unexpected entry %+v", entries[len(entries)-1])
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	path := setAudit(t, AuditConfig{MaxBackups: 2})
+	for _, instanceId := range []string{"i-0aaa", "i-0bbb", "i-0ccc", "i-0ddd"} {
+		auditRecord(auditEntry{Action: ScaleDownActionDELETE, InstanceId: instanceId, Result: AuditSuccess})
+		auditLog.mutex.Lock()
+		auditLog.file.Close()
+		auditLog.file = nil
+		rotateAuditLog(currentConfig().AuditConfig)
+		auditLog.mutex.Unlock()
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than MaxBackups rotated files kept")
+	}
+	entries := auditEntries(t, func(auditEntry) bool { return true })
+	if len(entries) != 2 || entries[0].InstanceId != "i-0ddd" || entries[1].InstanceId != "i-0ccc" {
+		t.Errorf("got entries %+v, want i-0ddd and i-0ccc", entries)
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	for _, instanceId := range []string{"i-0aaa", "i-0bbb", "i-0aaa", "i-0ccc"} {
+		auditRecord(auditEntry{Action: ScaleDownActionDELETE, InstanceId: instanceId, Result: AuditSuccess})
+	}
+	recorder := httptest.NewRecorder()
+	auditHandler(recorder, httptest.NewRequest("GET", "/audit", nil))
+	if recorder.Code != 404 {
+		t.Errorf("got HTTP %d without AuditConfig.File, want 404", recorder.Code)
+	}
+
+	setAudit(t, AuditConfig{})
+	for _, instanceId := range []string{"i-0aaa", "i-0bbb", "i-0aaa", "i-0ccc"} {
+		auditRecord(auditEntry{Action: ScaleDownActionDELETE, InstanceId: instanceId, Result: AuditSuccess})
+	}
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 4},
+		{"?limit=3", 3},
+		{"?instanceId=i-0aaa", 2},
+		{"?instanceId=i-0aaa&limit=1", 1},
+		{"?action=" + ScaleDownActionDISABLE, 0},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		auditHandler(recorder, httptest.NewRequest("GET", "/audit"+test.query, nil))
+		var entries []auditEntry
+		if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil || recorder.Code != 200 {
+			t.Errorf("%s: got HTTP %d, %s", test.query, recorder.Code, recorder.Body)
+			continue
+		}
+		if len(entries) != test.want {
+			t.Errorf("%s: got %d entries, want %d", test.query, len(entries), test.want)
+		}
+	}
+	recorder = httptest.NewRecorder()
+	auditHandler(recorder, httptest.NewRequest("GET", "/audit?limit=x", nil))
+	if recorder.Code != 400 {
+		t.Errorf("got HTTP %d for invalid limit, want 400", recorder.Code)
+	}
+}
+
+func TestAuditRecordsCLIRuns(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa", "i-0old")
+	autoScaling.setGroup("web", "i-0aaa")
+	configFile := writeConfigFile(t, zabbix, autoScaling, ScaleDownActionDELETE)
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	hcl, _ := os.ReadFile(configFile)
+	hcl = append(hcl, fmt.Sprintf("AuditConfig {\n  File = \"%s\"\n}\n", auditFile)...)
+	if err := os.WriteFile(configFile, hcl, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DryRun = false })
+	operator, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	if code := runCLI([]string{"sync", "-config", configFile, "-dry-run"}); code != ExitChanges {
+		t.Fatalf("sync -dry-run: got exit code %d, want %d", code, ExitChanges)
+	}
+	if code := runCLI([]string{"plan", "-config", configFile, "-out", planFile}); code != ExitChanges {
+		t.Fatalf("plan: got exit code %d, want %d", code, ExitChanges)
+	}
+	entries := auditEntries(t, func(entry auditEntry) bool { return true })
+	if len(entries) != 2 {
+		t.Fatalf("got %d audit entries, want 2: %+v", len(entries), entries)
+	}
+	for _, entry := range entries {
+		if entry.Action != ScaleDownActionDELETE || entry.InstanceId != "i-0old" || entry.Result != AuditDryRun ||
+			entry.Trigger.Source != TriggerSync || entry.Trigger.Client != operator.Username || entry.Before.HostId == "" {
+			t.Errorf("unexpected audit entry %+v", entry)
+		}
+	}
+
+	DryRun = false // as set by sync -dry-run; each CLI run is a process of its own
+	if code := runCLI([]string{"apply", "-config", configFile, planFile}); code != ExitOK {
+		t.Fatalf("apply: got exit code %d, want %d", code, ExitOK)
+	}
+	entries = auditEntries(t, func(entry auditEntry) bool { return entry.Result == AuditSuccess })
+	if len(entries) != 1 || entries[0].Trigger.Source != TriggerApply || entries[0].Trigger.Client != operator.Username {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/smartystreets/go-aws-auth"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type AWS_DescribeAutoScalingGroupsResponse struct {
 	DescribeAutoScalingGroupsResponse AWS_DescribeAutoScalingGroupsResult `json:"DescribeAutoScalingGroupsResponse"`
-	Error                             AWS_API_Error                       `json:"Error"`
 }
 type AWS_DescribeAutoScalingGroupsResult struct {
 	DescribeAutoScalingGroupsResult AWS_AutoScalingGroups `json:"DescribeAutoScalingGroupsResult"`
@@ -20,67 +22,148 @@ type AWS_AutoScalingGroups struct {
 	AutoScalingGroups []AWS_AutoScalingGroup `json:"AutoScalingGroups"`
 }
 type AWS_AutoScalingGroup struct {
-	Instances []AWS_AutoScalingInstance `json:"Instances"`
+	AutoScalingGroupName string                    `json:"AutoScalingGroupName"`
+	Instances            []AWS_AutoScalingInstance `json:"Instances"`
 }
 type AWS_AutoScalingInstance struct {
-	InstanceId     string `json:"InstanceId"`
-	LifecycleState string `json:"LifecycleState"`
+	InstanceId           string `json:"InstanceId"`
+	LifecycleState       string `json:"LifecycleState"`
+	AutoScalingGroupName string `json:"-"` // filled in from AWS_AutoScalingGroup
+}
+type AWS_DescribeAutoScalingInstancesResponse struct {
+	DescribeAutoScalingInstancesResponse AWS_DescribeAutoScalingInstancesResult `json:"DescribeAutoScalingInstancesResponse"`
+}
+type AWS_DescribeAutoScalingInstancesResult struct {
+	DescribeAutoScalingInstancesResult AWS_AutoScalingInstanceDetails `json:"DescribeAutoScalingInstancesResult"`
+}
+type AWS_AutoScalingInstanceDetails struct {
+	AutoScalingInstances []AWS_AutoScalingInstanceDetail `json:"AutoScalingInstances"`
+}
+type AWS_AutoScalingInstanceDetail struct {
+	InstanceId           string `json:"InstanceId"`
+	AutoScalingGroupName string `json:"AutoScalingGroupName"`
+	LifecycleState       string `json:"LifecycleState"`
 }
 type AWS_API_Error struct {
 	Code    string `json:"Code"`
 	Message string `json:"Message"`
 }
 
-func getAutoScalingGroupMembers(asgName string, region string, accessKey string, secretKey string) []string {
+// sanity check failures of getAutoScalingGroupInstances(); acting on such results
+// would remove all hosts from Zabbix
+var (
+	ErrASGMissing = errors.New("API did not return infos for all ASGs; check ASG names?")
+	ErrASGEmpty   = errors.New("API returned 0 ASG instances")
+)
+
+const AWS_ServiceAutoScaling = "autoscaling"
+const AWS_LifecycleInService = "InService"
+
+// AWS error codes worth retrying, in addition to HTTP 5xx
+var AWS_RetryableErrorCodes = []string{"Throttling", "ThrottlingException", "RequestLimitExceeded",
+	"ServiceUnavailable", "InternalFailure", "RequestTimeout"}
+
+var awsHTTPClient = &http.Client{}
+
+func (e AWS_API_Error) Error() string {
+	return fmt.Sprintf("AWS API Error '%s': %s", e.Code, e.Message)
+}
+
+func getAutoScalingGroupInstances(autoScale AutoScale) ([]AWS_AutoScalingInstance, error) {
 	// https://autoscaling.[REGION].amazonaws.com/?Action=DescribeAutoScalingGroups&
 	//        AutoScalingGroupNames.member.1=my-asg&Version=2011-01-01&AUTHPARAMS
-	infoURL := fmt.Sprintf("https://autoscaling.%s.amazonaws.com"+
-		"/?Action=DescribeAutoScalingGroups&Version=2011-01-01&AutoScalingGroupNames.member.1=%s",
-		region, asgName)
-	//infoURL = "http://localhost/~jan/describe-as2.json" -- todo: testcases...?
+	// Returns instances of all ASGs managed. Errors are AWS_API_Error, decodeError,
+	// ErrASGMissing, ErrASGEmpty or network errors.
+	asgNames := autoScale.managedGroups()
+	query := "Action=DescribeAutoScalingGroups"
+	for i, asgName := range asgNames {
+		query += fmt.Sprintf("&AutoScalingGroupNames.member.%d=%s", i+1, url.QueryEscape(asgName))
+	}
 
-	client := new(http.Client)
-	req, err := http.NewRequest("GET", infoURL, nil)
-	req.Header.Add("Accept", "application/json")
-	awsauth.Sign(req, awsauth.Credentials{
-		AccessKeyID:     accessKey,
-		SecretAccessKey: secretKey,
+	var result AWS_DescribeAutoScalingGroupsResponse
+	if err := autoScalingQuery(autoScale, query, &result); err != nil {
+		return nil, err
+	}
+
+	// iterate over instances found in JSON response, return list as result
+	groups := result.DescribeAutoScalingGroupsResponse.DescribeAutoScalingGroupsResult.AutoScalingGroups
+	if len(groups) != len(asgNames) {
+		return nil, ErrASGMissing
+	}
+	var groupMembers = []AWS_AutoScalingInstance{}
+	for _, group := range groups {
+		for _, instance := range group.Instances {
+			instance.AutoScalingGroupName = group.AutoScalingGroupName
+			groupMembers = append(groupMembers, instance)
+		}
+	}
+	if len(groupMembers) == 0 {
+		return nil, ErrASGEmpty
+	}
+	return groupMembers, nil
+}
+
+func describeAutoScalingInstance(autoScale AutoScale, instanceId string) (AWS_AutoScalingInstance, bool, error) {
+	// Returns the ASG membership of an instance; false if it does not belong to any ASG (anymore).
+	query := "Action=DescribeAutoScalingInstances&InstanceIds.member.1=" + url.QueryEscape(instanceId)
+	var result AWS_DescribeAutoScalingInstancesResponse
+	if err := autoScalingQuery(autoScale, query, &result); err != nil {
+		return AWS_AutoScalingInstance{}, false, err
+	}
+	for _, instance := range result.DescribeAutoScalingInstancesResponse.DescribeAutoScalingInstancesResult.AutoScalingInstances {
+		if instance.InstanceId == instanceId {
+			return AWS_AutoScalingInstance{InstanceId: instance.InstanceId, LifecycleState: instance.LifecycleState,
+				AutoScalingGroupName: instance.AutoScalingGroupName}, true, nil
+		}
+	}
+	return AWS_AutoScalingInstance{}, false, nil
+}
+
+func autoScalingQuery(autoScale AutoScale, query string, result interface{}) error {
+	// Calls the AutoScaling Query API with retries and decodes the JSON response into result.
+	infoURL := awsEndpoint(AWS_ServiceAutoScaling, autoScale.Region, autoScale.UseFIPSEndpoint, autoScale.Endpoint) +
+		"/?" + query + "&Version=2011-01-01"
+	action := strings.TrimPrefix(strings.SplitN(query, "&", 2)[0], "Action=")
+	return currentRetryPolicy().do("AWS "+action, func(ctx context.Context) error {
+		return autoScalingRequest(ctx, infoURL, autoScale, result)
 	})
+}
 
-	resp, err := client.Do(req)
+func autoScalingRequest(ctx context.Context, infoURL string, autoScale AutoScale, result interface{}) error {
+	// Single signed AutoScaling API call; throttling and 5xx errors are retryable.
+	req, err := http.NewRequestWithContext(ctx, "GET", infoURL, nil)
 	if err != nil {
-		log.Fatalf("FATAL: Cannot GET ASG members: %s", err)
+		return fmt.Errorf("Invalid AutoScaling endpoint: %s", err)
 	}
-	defer resp.Body.Close()
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	req.Header.Add("Accept", "application/json")
+	signRequestV4(req, nil, autoScale.credentials(), autoScale.Region, AWS_ServiceAutoScaling, time.Now())
 
+	resp, err := awsHTTPClient.Do(req)
 	if err != nil {
-		log.Fatalf("FATAL: Cannot read ASG members: %s", err)
+		return err
 	}
-	//body := string(bodyBytes)
-	//log.Print(body)  <-- todo: add -debug flag?
-
-	var result AWS_DescribeAutoScalingGroupsResponse
-	err = json.Unmarshal(bodyBytes, &result)
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("ERROR: Decoding JSON failed: %s", err)
+		return err
 	}
 
-	if result.Error.Code != "" {
-		// MUST "panic" here, as all hosts would be removed from Zabbix as result!
-		log.Fatalf("FATAL: AWS API Error '%s': %s", result.Error.Code, result.Error.Message)
+	// AWS returns error details in the body, also with HTTP 4xx/5xx
+	var apiError struct {
+		Error AWS_API_Error `json:"Error"`
 	}
-
-	// iterate over instances found in JSON response, return list as result
-	if len(result.DescribeAutoScalingGroupsResponse.DescribeAutoScalingGroupsResult.AutoScalingGroups) == 0 {
-		log.Fatal("FATAL: Sanity check halt -- API did not return ASG infos; check ASG name?")
+	json.Unmarshal(bodyBytes, &apiError)
+	if apiError.Error.Code != "" {
+		if contains(AWS_RetryableErrorCodes, apiError.Error.Code) || resp.StatusCode >= 500 {
+			return retryable(apiError.Error)
+		}
+		return apiError.Error
 	}
-	var groupMembers = []string{}
-	for _, instance := range result.DescribeAutoScalingGroupsResponse.DescribeAutoScalingGroupsResult.AutoScalingGroups[0].Instances {
-		groupMembers = append(groupMembers, instance.InstanceId)
+	if err := httpStatusError(resp); err != nil {
+		return err
 	}
-	if len(groupMembers) == 0 {
-		log.Fatal("FATAL: Sanity check halt -- API returned 0 ASG instances!")
+	if err := json.Unmarshal(bodyBytes, result); err != nil {
+		return decodeError{"AWS AutoScaling", err}
 	}
-	return groupMembers
+	return nil
 }
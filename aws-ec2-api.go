@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The EC2 Query API answers in XML only, unlike the AutoScaling one.
+// https://docs.aws.amazon.com/AWSEC2/latest/APIReference/API_DescribeInstances.html
+type AWS_DescribeInstancesResponse struct {
+	Reservations []AWS_EC2Reservation `xml:"reservationSet>item"`
+	NextToken    string               `xml:"nextToken"`
+}
+type AWS_EC2Reservation struct {
+	Instances []AWS_EC2Instance `xml:"instancesSet>item"`
+}
+type AWS_EC2Instance struct {
+	InstanceId       string       `xml:"instanceId"`
+	ImageId          string       `xml:"imageId"`
+	InstanceType     string       `xml:"instanceType"`
+	AvailabilityZone string       `xml:"placement>availabilityZone"`
+	PrivateIpAddress string       `xml:"privateIpAddress"`
+	Tags             []AWS_EC2Tag `xml:"tagSet>item"`
+}
+type AWS_EC2Tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+type AWS_EC2ErrorResponse struct {
+	Errors []AWS_API_Error `xml:"Errors>Error"`
+}
+
+const (
+	AWS_ServiceEC2 = "ec2"
+
+	DefaultEC2DescribeBatchSize = 100 // instance ids per DescribeInstances call
+)
+
+func describeEC2Instances(autoScale AutoScale, instanceIds []string) (map[string]AWS_EC2Instance, error) {
+	// https://ec2.[REGION].amazonaws.com/?Action=DescribeInstances&Filter.1.Name=instance-id&
+	//        Filter.1.Value.1=i-...&Version=2016-11-15&AUTHPARAMS
+	// Returns instances by InstanceId; unknown (e.g. long gone) instances are missing, not an error.
+	instances := map[string]AWS_EC2Instance{}
+	for start := 0; start < len(instanceIds); start += DefaultEC2DescribeBatchSize {
+		query := "Action=DescribeInstances&Filter.1.Name=instance-id"
+		for i, instanceId := range instanceIds[start:min(start+DefaultEC2DescribeBatchSize, len(instanceIds))] {
+			query += fmt.Sprintf("&Filter.1.Value.%d=%s", i+1, url.QueryEscape(instanceId))
+		}
+		nextToken := ""
+		for {
+			pageQuery := query
+			if nextToken != "" {
+				pageQuery += "&NextToken=" + url.QueryEscape(nextToken)
+			}
+			var result AWS_DescribeInstancesResponse
+			if err := ec2Query(autoScale, pageQuery, &result); err != nil {
+				return nil, err
+			}
+			for _, reservation := range result.Reservations {
+				for _, instance := range reservation.Instances {
+					instances[instance.InstanceId] = instance
+				}
+			}
+			if nextToken = result.NextToken; nextToken == "" {
+				break
+			}
+		}
+	}
+	return instances, nil
+}
+
+func ec2Query(autoScale AutoScale, query string, result interface{}) error {
+	// Calls the EC2 Query API with retries and decodes the XML response into result.
+	infoURL := awsEndpoint(AWS_ServiceEC2, autoScale.Region, autoScale.UseFIPSEndpoint, autoScale.EC2Endpoint) +
+		"/?" + query + "&Version=2016-11-15"
+	action := strings.TrimPrefix(strings.SplitN(query, "&", 2)[0], "Action=")
+	return currentRetryPolicy().do("AWS "+action, func(ctx context.Context) error {
+		return ec2Request(ctx, infoURL, autoScale, result)
+	})
+}
+
+func ec2Request(ctx context.Context, infoURL string, autoScale AutoScale, result interface{}) error {
+	// Single signed EC2 API call; throttling and 5xx errors are retryable.
+	req, err := http.NewRequestWithContext(ctx, "GET", infoURL, nil)
+	if err != nil {
+		return fmt.Errorf("Invalid EC2 endpoint: %s", err)
+	}
+	signRequestV4(req, nil, autoScale.credentials(), autoScale.Region, AWS_ServiceEC2, time.Now())
+
+	resp, err := awsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var apiError AWS_EC2ErrorResponse
+	xml.Unmarshal(bodyBytes, &apiError)
+	if len(apiError.Errors) > 0 {
+		if contains(AWS_RetryableErrorCodes, apiError.Errors[0].Code) || resp.StatusCode >= 500 {
+			return retryable(apiError.Errors[0])
+		}
+		return apiError.Errors[0]
+	}
+	if err := httpStatusError(resp); err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(bodyBytes, result); err != nil {
+		return decodeError{"AWS EC2", err}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// awsPartition maps regions to their DNS suffix, see
+// https://docs.aws.amazon.com/general/latest/gr/rande.html
+type awsPartition struct {
+	name         string
+	regionPrefix string
+	dnsSuffix    string
+}
+
+// checked in order; the first matching prefix wins, "aws" matches all other regions
+var awsPartitions = []awsPartition{
+	{"aws-cn", "cn-", "amazonaws.com.cn"},
+	{"aws-us-gov", "us-gov-", "amazonaws.com"},
+	{"aws-iso-b", "us-isob-", "sc2s.sgov.gov"},
+	{"aws-iso", "us-iso-", "c2s.ic.gov"},
+	{"aws", "", "amazonaws.com"},
+}
+
+func awsPartitionForRegion(region string) awsPartition {
+	for _, partition := range awsPartitions {
+		if strings.HasPrefix(region, partition.regionPrefix) {
+			return partition
+		}
+	}
+	return awsPartitions[len(awsPartitions)-1]
+}
+
+func awsEndpoint(service string, region string, useFIPS bool, override string) string {
+	// Returns base URL of service in region. An explicit override (VPC endpoint,
+	// local fake, ...) is returned as is, without trailing slash.
+	if override != "" {
+		return strings.TrimRight(override, "/")
+	}
+	if useFIPS {
+		service = service + "-fips"
+	}
+	return fmt.Sprintf("https://%s.%s.%s", service, region, awsPartitionForRegion(region).dnsSuffix)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestAWSEndpoint(t *testing.T) {
+	tests := []struct {
+		region   string
+		fips     bool
+		override string
+		expected string
+	}{
+		{"eu-west-1", false, "", "https://autoscaling.eu-west-1.amazonaws.com"},
+		{"us-east-1", true, "", "https://autoscaling-fips.us-east-1.amazonaws.com"},
+		{"cn-north-1", false, "", "https://autoscaling.cn-north-1.amazonaws.com.cn"},
+		{"us-gov-west-1", false, "", "https://autoscaling.us-gov-west-1.amazonaws.com"},
+		{"us-iso-east-1", false, "", "https://autoscaling.us-iso-east-1.c2s.ic.gov"},
+		{"us-isob-east-1", false, "", "https://autoscaling.us-isob-east-1.sc2s.sgov.gov"},
+		{"eu-west-1", true, "http://localhost:4566/", "http://localhost:4566"},
+	}
+	for _, test := range tests {
+		if got := awsEndpoint(AWS_ServiceAutoScaling, test.region, test.fips, test.override); got != test.expected {
+			t.Errorf("awsEndpoint(%s, fips=%t, %q) = %s, want %s", test.region, test.fips, test.override, got, test.expected)
+		}
+	}
+}
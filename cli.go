@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// command is an aaz subcommand; run returns the process exit code.
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+// Exit codes of aaz subcommands
+const (
+	ExitOK      = 0 // success; for plan: no changes
+	ExitError   = 1 // runtime errors occurred (Zabbix/AWS/listener unreachable, ...)
+	ExitUsage   = 2 // invalid command line or configuration
+	ExitChanges = 3 // plan: Zabbix changes pending
+	ExitStale   = 4 // apply: ASG or Zabbix changed since plan was made
+)
+
+const DefaultConfigFile = "/etc/aws-autoscale-zabbix.hcl"
+const DefaultListenerURL = "http://localhost:8080"
+
+var commands = []command{
+	{"serve", "initial sync, then listen for SNS notifications (default)", cmdServe},
+	{"sync", "one-shot reconcile of ASG members and Zabbix hosts", cmdSync},
+	{"plan", "print actions a sync would take", cmdPlan},
+	{"apply", "execute a plan saved by 'plan -out'", cmdApply},
+	{"validate-config", "check configuration file", cmdValidateConfig},
+	{"restore", "recreate a deleted Zabbix host from its snapshot", cmdRestore},
+	{"status", "query /status of a running AAZ instance", cmdStatus},
+	{"simulate-event", "post a synthetic SNS notification to a running AAZ instance", cmdSimulateEvent},
+	{"version", "print AAZ version", cmdVersion},
+}
+
+func runCLI(args []string) int {
+	// Dispatches to subcommand args[0]. Without subcommand (or legacy flags only), serve.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return cmdLegacy(args)
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", args[0])
+	usage()
+	return ExitUsage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for command flags.\n", os.Args[0])
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+func parseFlags(flags *flag.FlagSet, args []string) bool {
+	// Parses args; false if flags are invalid or help was requested.
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", flags.Args())
+		return false
+	}
+	return true
+}
+
+func cliLoadConfig() bool {
+	// Loads and activates ConfigFile; false if invalid.
+	config, acl, err := loadConfig(ConfigFile)
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			log.Printf("ERROR: %s", line)
+		}
+		return false
+	}
+	setConfig(config, acl)
+	return true
+}
+
+func cmdLegacy(args []string) int {
+	// Pre-subcommand command line: aaz [-config file] [-dry-run] [-skip-listener] [-version]
+	flags := newFlagSet("aaz")
+	flags.StringVar(&ConfigFile, "config", DefaultConfigFile, "AAZ configuration file")
+	versionQuery := flags.Bool("version", false, "get aws-autoscale-zabbix version")
+	skipListener := flags.Bool("skip-listener", false, "one-shot -- do not listen for SNS notifications")
+	flags.BoolVar(&DryRun, "dry-run", false, "don't kiss, just talk -- only tell what would be changed")
+	flags.Usage = func() {
+		usage()
+		fmt.Fprint(os.Stderr, "\nLegacy flags (same as 'serve'):\n")
+		flags.PrintDefaults()
+	}
+	if !parseFlags(flags, args) {
+		return ExitUsage
+	}
+	if *versionQuery {
+		return cmdVersion(nil)
+	}
+	if !cliLoadConfig() {
+		return ExitUsage
+	}
+	return runServe(*skipListener)
+}
+
+func cmdServe(args []string) int {
+	flags := newFlagSet("serve")
+	flags.StringVar(&ConfigFile, "config", DefaultConfigFile, "AAZ configuration file")
+	flags.BoolVar(&DryRun, "dry-run", false, "don't kiss, just talk -- only tell what would be changed")
+	if !parseFlags(flags, args) || !cliLoadConfig() {
+		return ExitUsage
+	}
+	return runServe(false)
+}
+
+func cmdSync(args []string) int {
+	flags := newFlagSet("sync")
+	flags.StringVar(&ConfigFile, "config", DefaultConfigFile, "AAZ configuration file")
+	flags.BoolVar(&DryRun, "dry-run", false, "only print plan of what would be changed")
+	planFile := flags.String("out", "", "dry-run: save plan as JSON to this file, for 'apply'")
+	planFormat := flags.String("format", PlanFormatTable, "dry-run: print plan as table or json")
+	if !parseFlags(flags, args) || !cliLoadConfig() {
+		return ExitUsage
+	}
+	return runSync(*planFile, *planFormat)
+}
+
+func cmdPlan(args []string) int {
+	// Exit codes: ExitOK if Zabbix is in sync, ExitChanges if a sync would change hosts.
+	flags := newFlagSet("plan")
+	flags.StringVar(&ConfigFile, "config", DefaultConfigFile, "AAZ configuration file")
+	planFile := flags.String("out", "", "save plan as JSON to this file, for 'apply'")
+	planFormat := flags.String("format", PlanFormatTable, "print plan as table or json")
+	if !parseFlags(flags, args) || !cliLoadConfig() {
+		return ExitUsage
+	}
+	if !currentConfig().hasAWSKey() {
+		log.Print("ERROR: Cannot plan as AutoScale group has no IAM user/key defined")
+		return ExitUsage
+	}
+	defer zabbixLogout()
+	if refreshZabbixInventory() != nil {
+		return ExitError
+	}
+	plan, err := currentSyncPlan()
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return ExitError
+	}
+	auditSyncPlan(plan, cliTrigger(TriggerSync, plan.Created.Format(time.RFC3339Nano)))
+	return outputPlan(plan, *planFile, *planFormat)
+}
+
+func outputPlan(plan syncPlan, planFile string, planFormat string) int {
+	// Prints plan and optionally saves it; exit code as for cmdPlan.
+	if err := writePlan(os.Stdout, plan, planFormat); err != nil {
+		log.Printf("ERROR: %s", err)
+		return ExitUsage
+	}
+	if planFile != "" {
+		if err := savePlan(planFile, plan); err != nil {
+			log.Printf("ERROR: Cannot save plan: %s", err)
+			return ExitError
+		}
+		log.Printf("Plan saved to %s", planFile)
+	}
+	if plan.changes() > 0 {
+		return ExitChanges
+	}
+	return ExitOK
+}
+
+func cmdApply(args []string) int {
+	// Applies a saved plan exactly -- or refuses (ExitStale), if the plan
+	// computed now differs from the saved one.
+	flags := newFlagSet("apply")
+	flags.StringVar(&ConfigFile, "config", DefaultConfigFile, "AAZ configuration file")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: apply [flags] <planfile>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return ExitUsage
+	}
+	if !cliLoadConfig() {
+		return ExitUsage
+	}
+	savedPlan, err := loadPlan(flags.Arg(0))
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return ExitUsage
+	}
+	defer zabbixLogout()
+	if refreshZabbixInventory() != nil {
+		return ExitError
+	}
+	plan, err := currentSyncPlan()
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return ExitError
+	}
+	if plan.Fingerprint != savedPlan.Fingerprint {
+		log.Printf("ERROR: Refusing to apply plan created %s -- ASG or Zabbix changed since:", savedPlan.Created)
+		for _, diff := range planDiff(savedPlan, plan) {
+			log.Printf("  %s", diff)
+		}
+		return ExitStale
+	}
+	log.Printf("Applying plan created %s: %d host(s) to change", savedPlan.Created, savedPlan.changes())
+	changed, failed := applySyncPlan(savedPlan, cliTrigger(TriggerApply, savedPlan.Fingerprint))
+	notifySyncSummary(savedPlan, changed, failed)
+	if !waitForWebhooks(DefaultShutdownTimeout * time.Second) {
+		log.Print("WARNING: Webhook deliveries did not complete")
+	}
+	return exitCodeFromStatus()
+}
+
+func cmdRestore(args []string) int {
+	flags := newFlagSet("restore")
+	flags.StringVar(&ConfigFile, "config", DefaultConfigFile, "AAZ configuration file")
+	flags.BoolVar(&DryRun, "dry-run", false, "only print the host that would be created")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: restore [flags] <instanceId>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return ExitUsage
+	}
+	if !cliLoadConfig() {
+		return ExitUsage
+	}
+	defer zabbixLogout()
+	if err := restoreHost(flags.Arg(0)); err != nil {
+		log.Printf("ERROR: %s", err)
+		return ExitError
+	}
+	return ExitOK
+}
+
+func cmdValidateConfig(args []string) int {
+	// Reports all problems found in the configuration file; exit code ExitUsage if invalid,
+	// ExitError if -check-connectivity is given and Zabbix or AWS cannot be reached.
+	flags := newFlagSet("validate-config")
+	flags.StringVar(&ConfigFile, "config", DefaultConfigFile, "AAZ configuration file")
+	connectivity := flags.Bool("check-connectivity", false, "also test connectivity to Zabbix and AWS")
+	if !parseFlags(flags, args) || !cliLoadConfig() {
+		return ExitUsage
+	}
+	fmt.Printf("Configuration %s is valid\n", ConfigFile)
+	if *connectivity {
+		problems := checkConnectivity(currentConfig())
+		for _, problem := range problems {
+			log.Printf("ERROR: %s", problem)
+		}
+		if len(problems) > 0 {
+			return ExitError
+		}
+		fmt.Println("Connectivity to Zabbix and AWS OK")
+	}
+	return ExitOK
+}
+
+func cmdVersion(args []string) int {
+	fmt.Println(aazVersion)
+	return ExitOK
+}
+
+// listenerClientFlags are shared by subcommands talking to a running AAZ instance.
+type listenerClientFlags struct {
+	url      *string
+	caCert   *string
+	cert     *string
+	key      *string
+	insecure *bool
+	timeout  *time.Duration
+}
+
+func addListenerClientFlags(flags *flag.FlagSet) listenerClientFlags {
+	return listenerClientFlags{
+		url:      flags.String("url", DefaultListenerURL, "base URL of AAZ listener"),
+		caCert:   flags.String("cacert", "", "CA bundle to verify listener certificate"),
+		cert:     flags.String("cert", "", "client certificate (if listener requires TLS_ClientCA)"),
+		key:      flags.String("key", "", "client certificate key"),
+		insecure: flags.Bool("insecure", false, "do not verify listener certificate"),
+		timeout:  flags.Duration("timeout", 10*time.Second, "request timeout"),
+	}
+}
+
+func (f listenerClientFlags) client() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: *f.insecure}
+	if *f.caCert != "" {
+		caBundle, err := ioutil.ReadFile(*f.caCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in %s", *f.caCert)
+		}
+	}
+	if *f.cert != "" {
+		cert, err := tls.LoadX509KeyPair(*f.cert, *f.key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   *f.timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+func cmdStatus(args []string) int {
+	// Prints /status of a running instance. Exit code ExitError if unreachable,
+	// or if -fail-on-errors is given and the instance reports errors.
+	flags := newFlagSet("status")
+	clientFlags := addListenerClientFlags(flags)
+	failOnErrors := flags.Bool("fail-on-errors", false, "exit with error if instance reports errors")
+	if !parseFlags(flags, args) {
+		return ExitUsage
+	}
+	client, err := clientFlags.client()
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return ExitUsage
+	}
+	resp, err := client.Get(strings.TrimRight(*clientFlags.url, "/") + "/status")
+	if err != nil {
+		log.Printf("ERROR: Cannot query status: %s", err)
+		return ExitError
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("ERROR: Cannot query status: %s %s", resp.Status, strings.TrimSpace(string(body)))
+		return ExitError
+	}
+	var status AAZStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		log.Printf("ERROR: Decoding status failed: %s", err)
+		return ExitError
+	}
+	var pretty bytes.Buffer
+	json.Indent(&pretty, body, "", "  ")
+	fmt.Println(pretty.String())
+	if *failOnErrors && (status.Errors > 0 || (status.LastSync != nil && status.LastSync.Failed)) {
+		return ExitError
+	}
+	return ExitOK
+}
+
+func cmdSimulateEvent(args []string) int {
+	// Posts a synthetic SNS notification, e.g. to verify AllowedNetworks/ASG settings or to unmonitor a host manually.
+	flags := newFlagSet("simulate-event")
+	clientFlags := addListenerClientFlags(flags)
+	instanceId := flags.String("instance-id", "", "EC2 InstanceId (required)")
+	groupName := flags.String("group", "", "AutoScaling group name (required)")
+	event := flags.String("event", SNS_EV_Terminate, "AutoScaling event")
+	if !parseFlags(flags, args) {
+		return ExitUsage
+	}
+	if *instanceId == "" || *groupName == "" {
+		log.Print("ERROR: -instance-id and -group are required")
+		return ExitUsage
+	}
+	client, err := clientFlags.client()
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return ExitUsage
+	}
+	message, _ := json.Marshal(SNS_Message{Event: *event, EC2InstanceId: *instanceId, AutoScalingGroupName: *groupName})
+	notification, _ := json.Marshal(SNS_Notification{Type: SNS_Type_Notification, Message: string(message)})
+	resp, err := client.Post(strings.TrimRight(*clientFlags.url, "/")+"/", "text/plain; charset=UTF-8", bytes.NewReader(notification))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = errors.New(resp.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: Posting event failed: %s", err)
+		return ExitError
+	}
+	fmt.Printf("Posted %s event for %s (ASG %s)\n", *event, *instanceId, *groupName)
+	return ExitOK
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCLIUsageErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.hcl")
+	tests := []struct {
+		args     []string
+		expected int
+	}{
+		{[]string{"version"}, ExitOK},
+		{[]string{"-version"}, ExitOK},
+		{[]string{"no-such-command"}, ExitUsage},
+		{[]string{"plan", "-no-such-flag"}, ExitUsage},
+		{[]string{"plan", "-config", missing}, ExitUsage},
+		{[]string{"sync", "-config", missing}, ExitUsage},
+		{[]string{"sync", "unexpected-argument"}, ExitUsage},
+		{[]string{"apply"}, ExitUsage},
+		{[]string{"restore"}, ExitUsage},
+		{[]string{"validate-config", "-config", "testdata/config/valid.hcl"}, ExitOK},
+		{[]string{"validate-config", "-config", "testdata/config/invalid-values.hcl"}, ExitUsage},
+		{[]string{"simulate-event", "-group", "web"}, ExitUsage},
+		{[]string{"status", "-url", "http://127.0.0.1:1", "-timeout", "1s"}, ExitError},
+	}
+	for _, test := range tests {
+		if code := runCLI(test.args); code != test.expected {
+			t.Errorf("%s: got exit code %d, want %d", strings.Join(test.args, " "), code, test.expected)
+		}
+	}
+}
+
+func TestCLIPlanAndSync(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa", "i-0old")
+	autoScaling.setGroup("web", "i-0aaa")
+	configFile := writeConfigFile(t, zabbix, autoScaling, ScaleDownActionDELETE)
+	t.Cleanup(func() { DryRun = false })
+
+	if code := runCLI([]string{"plan", "-config", configFile, "-format", "yaml"}); code != ExitUsage {
+		t.Errorf("plan -format yaml: got exit code %d, want %d", code, ExitUsage)
+	}
+	if code := runCLI([]string{"sync", "-config", configFile, "-dry-run"}); code != ExitChanges {
+		t.Errorf("sync -dry-run: got exit code %d, want %d", code, ExitChanges)
+	}
+	if _, ok := zabbix.host("i-0old"); !ok {
+		t.Fatal("host deleted by dry-run")
+	}
+	if code := runCLI([]string{"sync", "-config", configFile}); code != ExitOK {
+		t.Errorf("sync: got exit code %d, want %d", code, ExitOK)
+	}
+	if _, ok := zabbix.host("i-0old"); ok {
+		t.Error("host not deleted by sync")
+	}
+	if code := runCLI([]string{"plan", "-config", configFile}); code != ExitOK {
+		t.Errorf("plan after sync: got exit code %d, want %d", code, ExitOK)
+	}
+
+	zabbix.failHTTP(JSONRPC_Method_GetHost, 2) // as many as MaxAttempts
+	if code := runCLI([]string{"plan", "-config", configFile}); code != ExitError {
+		t.Errorf("plan with Zabbix down: got exit code %d, want %d", code, ExitError)
+	}
+}
+
+func TestCLISyncChecksPreconditionsFirst(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	configFile := writeConfigFile(t, zabbix, autoScaling, ScaleDownActionDELETE)
+	configHCL, _ := os.ReadFile(configFile)
+	withoutKey := strings.Replace(string(configHCL), `AccessKey = "AKIDEXAMPLE"`, "", 1)
+	os.WriteFile(configFile, []byte(withoutKey), 0600)
+
+	for _, args := range [][]string{{"sync"}, {"sync", "-dry-run"}, {"plan"}} {
+		if code := runCLI(append(args, "-config", configFile)); code != ExitUsage {
+			t.Errorf("%s without AWS key: got exit code %d, want %d", strings.Join(args, " "), code, ExitUsage)
+		}
+	}
+	DryRun = false
+	if calls := zabbix.countCalls(JSONRPC_Method_UserLogin); calls != 0 {
+		t.Errorf("logged in to Zabbix %d times despite missing AWS key", calls)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/token"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// configValidator collects all problems found in a configuration file,
+// so they can be reported at once, with positions in the file.
+type configValidator struct {
+	filename  string
+	positions map[string]token.Pos // setting ("Block.Setting") or block name -> position
+	errors    []configError
+}
+
+type configError struct {
+	pos     token.Pos
+	message string // including position
+}
+
+// configErrors is returned by loadConfig; one error per line.
+type configErrors []configError
+
+var awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]?)?-[a-z]+-[0-9]+$`)
+var zabbixMacroPattern = regexp.MustCompile(`^\{\$[A-Z0-9_.]+\}$`)
+
+func newConfigValidator(filename string) *configValidator {
+	return &configValidator{filename: filename, positions: map[string]token.Pos{}}
+}
+
+func (v *configValidator) add(setting string, format string, args ...interface{}) {
+	// Records a problem with setting; its position is looked up (falling back to its block).
+	pos, ok := v.positions[setting]
+	if !ok {
+		pos = v.positions[strings.SplitN(setting, ".", 2)[0]]
+	}
+	v.errors = append(v.errors, configError{pos: pos,
+		message: fmt.Sprintf("%s: %s: %s", v.where(pos), setting, fmt.Sprintf(format, args...))})
+}
+
+func (v *configValidator) addError(err error) {
+	// Records a problem not related to a single setting (or with position info of its own).
+	v.errors = append(v.errors, configError{message: fmt.Sprintf("%s: %s", v.filename, err)})
+}
+
+func (v *configValidator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		if v.errors[i].pos.Line != v.errors[j].pos.Line {
+			return v.errors[i].pos.Line < v.errors[j].pos.Line
+		}
+		return v.errors[i].message < v.errors[j].message
+	})
+	return configErrors(v.errors)
+}
+
+func (v *configValidator) where(pos token.Pos) string {
+	if !pos.IsValid() {
+		return v.filename
+	}
+	return fmt.Sprintf("%s:%d:%d", v.filename, pos.Line, pos.Column)
+}
+
+func (errs configErrors) Error() string {
+	var lines []string
+	for _, e := range errs {
+		lines = append(lines, e.message)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (v *configValidator) checkKeys(root *ast.File) {
+	// Records positions of all blocks/settings and rejects keys not known to AAZConfig.
+	rootList, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return
+	}
+	v.checkObjectKeys(rootList, reflect.TypeOf(AAZConfig{}), "")
+}
+
+func (v *configValidator) checkObjectKeys(list *ast.ObjectList, structType reflect.Type, prefix string) {
+	for _, item := range list.Items {
+		path := prefix
+		fieldType := structType
+		for _, key := range item.Keys {
+			name, _ := key.Token.Value().(string)
+			if isBlockList(fieldType) {
+				// label of a repeated block, e.g. Webhook "name" { ... }
+				path = path + "." + name
+				if _, seen := v.positions[path]; !seen {
+					v.positions[path] = key.Token.Pos
+				}
+				fieldType = fieldType.Elem()
+				continue
+			}
+			field, ok := lookupConfigField(fieldType, name)
+			if !ok {
+				pos := key.Token.Pos
+				v.errors = append(v.errors, configError{pos: pos, message: fmt.Sprintf("%s: unknown setting '%s'%s",
+					v.where(pos), strings.TrimPrefix(path+"."+name, "."), suggestConfigField(fieldType, name))})
+				fieldType = nil
+				break
+			}
+			path = strings.TrimPrefix(path+"."+field.Name, ".")
+			if _, seen := v.positions[path]; !seen {
+				v.positions[path] = key.Token.Pos
+			}
+			fieldType = field.Type
+		}
+		if fieldType == nil {
+			continue
+		}
+		if isBlockList(fieldType) {
+			fieldType = fieldType.Elem()
+		}
+		if object, ok := item.Val.(*ast.ObjectType); ok && fieldType.Kind() == reflect.Struct {
+			v.checkObjectKeys(object.List, fieldType, path)
+		}
+	}
+}
+
+func isBlockList(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct
+}
+
+func lookupConfigField(structType reflect.Type, name string) (reflect.StructField, bool) {
+	// Finds field by hcl tag or field name, case-insensitive like hcl.DecodeObject.
+	if structType.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if strings.EqualFold(configFieldName(field), name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func configFieldName(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("hcl"), ",")[0]; tag != "" {
+		return tag
+	}
+	return field.Name
+}
+
+func suggestConfigField(structType reflect.Type, name string) string {
+	// Returns " (did you mean 'X'?)" for misspelled settings.
+	if structType.Kind() != reflect.Struct {
+		return ""
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		candidate := configFieldName(structType.Field(i))
+		if editDistance(strings.ToLower(candidate), strings.ToLower(name)) <= 2 {
+			return fmt.Sprintf(" (did you mean '%s'?)", candidate)
+		}
+	}
+	return ""
+}
+
+func editDistance(a string, b string) int {
+	// Levenshtein distance
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func (v *configValidator) checkFormats(c AAZConfig) {
+	// Checks value formats that verifyConfig does not care about.
+	if c.ZabbixConfig.URL != "" {
+		zabbixURL, err := url.Parse(c.ZabbixConfig.URL)
+		if err != nil || (zabbixURL.Scheme != "http" && zabbixURL.Scheme != "https") || zabbixURL.Host == "" {
+			v.add("ZabbixConfig.URL", "invalid URL '%s' (expected http(s)://host/path)", c.ZabbixConfig.URL)
+		}
+	}
+	for setting, endpoint := range map[string]string{
+		"AutoScale.Endpoint":    c.AutoScale.Endpoint,
+		"AutoScale.EC2Endpoint": c.AutoScale.EC2Endpoint,
+	} {
+		if endpoint == "" {
+			continue
+		}
+		endpointURL, err := url.Parse(endpoint)
+		if err != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") || endpointURL.Host == "" {
+			v.add(setting, "invalid URL '%s' (expected http(s)://host[:port])", endpoint)
+		}
+	}
+	if c.ErrorEvents.ZabbixSender != "" {
+		if _, _, err := net.SplitHostPort(c.ErrorEvents.ZabbixSender); err != nil {
+			v.add("ErrorEvents.ZabbixSender", "%s (expected host:port, e.g. zabbix:10051)", err)
+		}
+		if c.ErrorEvents.TrapperHost == "" || c.ErrorEvents.TrapperKey == "" {
+			v.add("ErrorEvents.ZabbixSender", "requires TrapperHost and TrapperKey")
+		}
+	}
+	for setting, commands := range map[string][]string{
+		"Hooks.PreAction":  c.Hooks.PreAction,
+		"Hooks.PostAction": c.Hooks.PostAction,
+	} {
+		for _, command := range commands {
+			info, err := os.Stat(command)
+			if err != nil {
+				v.add(setting, "%s", err)
+			} else if !filepath.IsAbs(command) || info.IsDir() || info.Mode()&0111 == 0 {
+				v.add(setting, "'%s' is not an executable (absolute path expected)", command)
+			}
+		}
+	}
+	webhookNames := map[string]bool{}
+	for _, webhook := range c.Webhooks {
+		setting := "Webhooks." + webhook.Name
+		if webhook.Name == "" || webhookNames[webhook.Name] {
+			v.add("Webhooks", "each Webhook needs a unique name, e.g. Webhook \"ops\" { ... }")
+		}
+		webhookNames[webhook.Name] = true
+		webhookURL, err := url.Parse(webhook.URL)
+		if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+			v.add(setting+".URL", "invalid URL (expected http(s)://host/path)") // not printed, it may be a secret
+		}
+		if webhook.Format != "" && !contains(WebhookFormats, webhook.Format) {
+			v.add(setting+".Format", "invalid format '%s' (expected one of %s)", webhook.Format, strings.Join(WebhookFormats, ", "))
+		}
+		if webhook.Template != "" {
+			if webhook.Format != "" && webhook.Format != WebhookFormatJSON {
+				v.add(setting+".Template", "only supported with format %s", WebhookFormatJSON)
+			}
+			if _, err := parseWebhookTemplate(webhook.Template); err != nil {
+				v.add(setting+".Template", "%s", err)
+			}
+		}
+		for _, event := range webhook.Events {
+			if !contains(NotifyEvents, event) {
+				v.add(setting+".Events", "unknown event '%s' (expected one of %s)", event, strings.Join(NotifyEvents, ", "))
+			}
+		}
+	}
+	if c.AutoScale.Region != "" && !awsRegionPattern.MatchString(c.AutoScale.Region) {
+		v.add("AutoScale.Region", "'%s' does not look like an AWS region (e.g. eu-west-1)", c.AutoScale.Region)
+	}
+	if strings.Contains(c.ListenerConfig.Address, ":") {
+		if _, err := net.ResolveTCPAddr("tcp", c.ListenerConfig.Address); err != nil {
+			v.add("ListenerConfig.Address", "%s", err)
+		}
+	}
+	for setting, cidrs := range map[string][]string{
+		"ListenerConfig.AllowedNetworks": c.ListenerConfig.AllowedNetworks,
+		"ListenerConfig.TrustedProxies":  c.ListenerConfig.TrustedProxies,
+	} {
+		if _, err := parseCIDRs(cidrs); err != nil {
+			v.add(setting, "%s", err)
+		}
+	}
+	if c.ListenerConfig.AWSIPRangesFile != "" {
+		if _, err := loadAWSIPRanges(c.ListenerConfig.AWSIPRangesFile, c.ListenerConfig.AWSIPRangesServices,
+			c.ListenerConfig.AWSIPRangesRegions); err != nil {
+			v.add("ListenerConfig.AWSIPRangesFile", "%s", err)
+		}
+	}
+	tlsFilesReadable := true
+	for setting, filename := range map[string]string{
+		"ListenerConfig.TLS_CertPath": c.ListenerConfig.TLS_CertPath,
+		"ListenerConfig.TLS_CertKey":  c.ListenerConfig.TLS_CertKey,
+		"ListenerConfig.TLS_ClientCA": c.ListenerConfig.TLS_ClientCA,
+	} {
+		if filename == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(filename); err != nil {
+			v.add(setting, "%s", err)
+			tlsFilesReadable = false
+		}
+	}
+	if c.useTLS() && tlsFilesReadable {
+		if _, err := buildTLSConfig(c.ListenerConfig); err != nil {
+			v.add("ListenerConfig", "%s", err)
+		}
+	}
+	if c.DaemonConfig.ShutdownTimeout < 0 {
+		v.add("DaemonConfig.ShutdownTimeout", "must not be negative")
+	}
+	for setting, value := range map[string]int{
+		"ZabbixConfig.BatchSize":        c.ZabbixConfig.BatchSize,
+		"DaemonConfig.QueueSize":        c.DaemonConfig.QueueSize,
+		"DaemonConfig.QueueWorkers":     c.DaemonConfig.QueueWorkers,
+		"RetryConfig.MaxAttempts":       c.RetryConfig.MaxAttempts,
+		"RetryConfig.InitialBackoff":    c.RetryConfig.InitialBackoff,
+		"RetryConfig.MaxBackoff":        c.RetryConfig.MaxBackoff,
+		"RetryConfig.CallTimeout":       c.RetryConfig.CallTimeout,
+		"RetryConfig.RequeueInterval":   c.RetryConfig.RequeueInterval,
+		"Hooks.Timeout":                 c.Hooks.Timeout,
+		"AuditConfig.MaxSize":           c.AuditConfig.MaxSize,
+		"AuditConfig.MaxBackups":        c.AuditConfig.MaxBackups,
+		"EC2Events.MaintenanceDuration": c.EC2Events.MaintenanceDuration,
+	} {
+		if value < 0 {
+			v.add(setting, "must not be negative")
+		}
+	}
+	if c.RetryConfig.MaxBackoff > 0 && c.RetryConfig.InitialBackoff > c.RetryConfig.MaxBackoff {
+		v.add("RetryConfig.InitialBackoff", "must not exceed MaxBackoff")
+	}
+	for state, action := range c.EC2Events.StateActions {
+		if !contains(EC2States, state) {
+			v.add("EC2Events.StateActions", "unknown EC2 instance state '%s' (expected one of %s)", state, strings.Join(EC2States, ", "))
+		}
+		if !contains(EC2Actions, action) {
+			v.add("EC2Events.StateActions", "invalid action '%s' for state '%s' (expected one of %s)", action, state, strings.Join(EC2Actions, ", "))
+		}
+	}
+	if action := c.EC2Events.InterruptionWarningAction; action != "" && !contains(EC2Actions, action) {
+		v.add("EC2Events.InterruptionWarningAction", "invalid action '%s' (expected one of %s)", action, strings.Join(EC2Actions, ", "))
+	}
+	for setting, values := range map[string]map[string]string{
+		"Enrichment.HostTags":  c.Enrichment.HostTags,
+		"Enrichment.Macros":    c.Enrichment.Macros,
+		"Enrichment.Inventory": c.Enrichment.Inventory,
+	} {
+		for name, source := range values {
+			if !validEnrichSource(source) {
+				v.add(setting, "invalid value '%s' for '%s' (expected one of %s, or %s<EC2 tag>)", source, name,
+					strings.Join(EnrichSources, ", "), EnrichTagPrefix)
+			}
+		}
+	}
+	for macro := range c.Enrichment.Macros {
+		if !zabbixMacroPattern.MatchString(macro) {
+			v.add("Enrichment.Macros", "invalid user macro '%s' (expected {$NAME}, NAME in A-Z, 0-9, _ and .)", macro)
+		}
+	}
+	if c.Enrichment.enabled() && !c.hasAWSKey() {
+		v.add("Enrichment", "requires AutoScale AccessKey/SecretKey (for ec2:DescribeInstances)")
+	}
+	if c.ZabbixConfig.SnapshotDir != "" {
+		if info, err := os.Stat(c.ZabbixConfig.SnapshotDir); err != nil || !info.IsDir() {
+			v.add("ZabbixConfig.SnapshotDir", "directory %s does not exist", c.ZabbixConfig.SnapshotDir)
+		}
+	}
+	if c.AuditConfig.File != "" {
+		if info, err := os.Stat(filepath.Dir(c.AuditConfig.File)); err != nil || !info.IsDir() {
+			v.add("AuditConfig.File", "directory %s does not exist", filepath.Dir(c.AuditConfig.File))
+		}
+	}
+	if c.DaemonConfig.StateFile != "" {
+		if info, err := os.Stat(filepath.Dir(c.DaemonConfig.StateFile)); err != nil || !info.IsDir() {
+			v.add("DaemonConfig.StateFile", "directory %s does not exist", filepath.Dir(c.DaemonConfig.StateFile))
+		}
+	}
+}
+
+func checkConnectivity(c AAZConfig) []error {
+	// Tries to log in to Zabbix and to describe the ASGs; returns problems found.
+	var problems []error
+	if _, err := zabbixGetSession(); err != nil {
+		problems = append(problems, fmt.Errorf("Zabbix login at %s failed: %s", c.ZabbixConfig.URL, err))
+	} else {
+		zabbixLogout()
+	}
+	if c.ZabbixConfig.ReEnableHosts || len(c.Enrichment.HostTags) > 0 {
+		if version, err := zabbixAPIVersion(); err != nil {
+			problems = append(problems, fmt.Errorf("Zabbix API version query at %s failed: %s", c.ZabbixConfig.URL, err))
+		} else if !zabbixSupportsHostTags(version) {
+			problems = append(problems, fmt.Errorf("Zabbix %s does not support host tags, "+
+				"required by ZabbixConfig.ReEnableHosts and Enrichment.HostTags (4.2 or later)", version))
+		}
+	}
+	if c.hasAWSKey() {
+		if _, err := getAutoScalingGroupInstances(c.AutoScale); err != nil {
+			problems = append(problems, fmt.Errorf("Describing ASGs %s failed: %s", c.AutoScale.managedGroups(), err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidationReportsAllErrors(t *testing.T) {
+	tests := []struct {
+		file     string
+		expected []string
+	}{
+		{"testdata/config/valid.hcl", nil},
+		{"testdata/config/unknown-keys.hcl", []string{
+			"testdata/config/unknown-keys.hcl:3:3: unknown setting 'ListenerConfig.AllowedNetwork' (did you mean 'AllowedNetworks'?)",
+			"testdata/config/unknown-keys.hcl:15:3: unknown setting 'ZabbixConfig.Colour'",
+			"testdata/config/unknown-keys.hcl:19:3: unknown setting 'Webhooks.ops.Event' (did you mean 'Events'?)",
+			"testdata/config/unknown-keys.hcl:21:1: unknown setting 'DeamonConfig' (did you mean 'DaemonConfig'?)",
+		}},
+		{"testdata/config/invalid-values.hcl", []string{
+			"testdata/config/invalid-values.hcl:2:3: ListenerConfig.Address: must be of format [IP]:Port",
+			"testdata/config/invalid-values.hcl:3:3: ListenerConfig.AllowedNetworks: invalid CIDR '192.168.0.0/33'",
+			"testdata/config/invalid-values.hcl:7:3: AutoScale.Region: 'Frankfurt' does not look like an AWS region (e.g. eu-west-1)",
+			"testdata/config/invalid-values.hcl:9:1: ZabbixConfig.Password: missing",
+			"testdata/config/invalid-values.hcl:10:3: ZabbixConfig.URL: invalid URL 'zabbix.example.com' (expected http(s)://host/path)",
+			"testdata/config/invalid-values.hcl:12:3: ZabbixConfig.ScaleDownAction: must be DELETE or DISABLE",
+			"testdata/config/invalid-values.hcl:14:3: ZabbixConfig.BatchSize: must not be negative",
+			"testdata/config/invalid-values.hcl:17:3: RetryConfig.InitialBackoff: must not exceed MaxBackoff",
+			"testdata/config/invalid-values.hcl:22:3: Webhooks.ops.Events: unknown event 'everything' (expected one of " +
+				strings.Join(NotifyEvents, ", ") + ")",
+		}},
+	}
+	for _, test := range tests {
+		_, _, err := loadConfig(test.file)
+		var lines []string
+		if err != nil {
+			lines = strings.Split(err.Error(), "\n")
+		}
+		if !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%s: got errors\n%s\nwant\n%s", test.file, strings.Join(lines, "\n"), strings.Join(test.expected, "\n"))
+		}
+	}
+}
+
+func TestConfigValidationParseErrors(t *testing.T) {
+	_, _, err := loadConfig("testdata/config/syntax-error.hcl")
+	if err == nil || !strings.HasPrefix(err.Error(), "testdata/config/syntax-error.hcl: Config parser error: At ") ||
+		!strings.Contains(err.Error(), "expected closing RBRACE") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, _, err := loadConfig("testdata/config/missing.hcl"); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestSuggestConfigField(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"scaledownaktion", " (did you mean 'ScaleDownAction'?)"},
+		{"URI", " (did you mean 'URL'?)"},
+		{"Colour", ""},
+	}
+	for _, test := range tests {
+		if got := suggestConfigField(reflect.TypeOf(ZabbixConfig{}), test.name); got != test.expected {
+			t.Errorf("suggestConfigField(%s) = %q, want %q", test.name, got, test.expected)
+		}
+	}
+}
@@ -1,30 +1,54 @@
 package main
 
 import (
+	"fmt"
 	"github.com/hashicorp/hcl"
 	"io/ioutil"
 	"log"
+	"reflect"
 	"strings"
+	"sync"
 )
 
 type AAZConfig struct {
 	ListenerConfig ListenerConfig
 	AutoScale      AutoScale
 	ZabbixConfig   ZabbixConfig
+	DaemonConfig   DaemonConfig
+	RetryConfig    RetryConfig
+	EC2Events      EC2Events
+	ErrorEvents    ErrorEvents
+	Webhooks       []WebhookConfig `hcl:"Webhook"`
+	Hooks          Hooks
+	AuditConfig    AuditConfig
+	Enrichment     Enrichment
 }
 
 type ListenerConfig struct {
-	Address      string `hcl:"Address"`
-	TLS_CertPath string `hcl:"TLS_CertPath"`
-	TLS_CertKey  string `hcl:"TLS_CertKey"`
-	HostsAllow   string `hcl:"HostsAllow"`
+	Address             string   `hcl:"Address"`
+	TLS_CertPath        string   `hcl:"TLS_CertPath"`
+	TLS_CertKey         string   `hcl:"TLS_CertKey"`
+	TLS_MinVersion      string   `hcl:"TLS_MinVersion"`
+	TLS_CipherSuites    []string `hcl:"TLS_CipherSuites"`
+	TLS_ClientCA        string   `hcl:"TLS_ClientCA"`
+	HostsAllow          string   `hcl:"HostsAllow"` // obsolete regexp; replaced by AllowedNetworks
+	AllowedNetworks     []string `hcl:"AllowedNetworks"`
+	AWSIPRangesFile     string   `hcl:"AWSIPRangesFile"`
+	AWSIPRangesServices []string `hcl:"AWSIPRangesServices"`
+	AWSIPRangesRegions  []string `hcl:"AWSIPRangesRegions"`
+	TrustedProxies      []string `hcl:"TrustedProxies"`
 }
 
 type AutoScale struct {
-	GroupName string `hcl:"GroupName"`
-	Region    string `hcl:"Region"`
-	AccessKey string `hcl:"AccessKey"`
-	SecretKey string `hcl:"SecretKey"`
+	GroupName  string   `hcl:"GroupName"`
+	GroupNames []string `hcl:"GroupNames"` // further ASGs to manage, in addition to GroupName
+	Region     string   `hcl:"Region"`
+	AccessKey  string   `hcl:"AccessKey"`
+	SecretKey  string   `hcl:"SecretKey"`
+	// AWS API endpoint is derived from Region, unless overridden by Endpoint (e.g. VPC endpoint)
+	Endpoint        string `hcl:"Endpoint"`
+	EC2Endpoint     string `hcl:"EC2Endpoint"` // same for the EC2 API, see Enrichment
+	UseFIPSEndpoint bool   `hcl:"UseFIPSEndpoint"`
 }
 
 type ZabbixConfig struct {
@@ -35,6 +59,72 @@ type ZabbixConfig struct {
 	ScaleDownAction      string `hcl:"ScaleDownAction"`
 	RestrictToGroupId    int    `hcl:"RestrictToGroupId"`
 	RestrictToTemplateId int    `hcl:"RestrictToTemplateId"`
+	BatchSize            int    `hcl:"BatchSize"`     // hosts per delete/disable API call
+	SnapshotDir          string `hcl:"SnapshotDir"`   // where to save hosts before DELETING them, see restoreHost()
+	ReEnableHosts        bool   `hcl:"ReEnableHosts"` // tag hosts on DISABLE and enable them again, see enableHosts(); Zabbix >= 4.2
+}
+
+type DaemonConfig struct {
+	ShutdownTimeout int    `hcl:"ShutdownTimeout"` // seconds to wait for in-flight work on shutdown
+	StateFile       string `hcl:"StateFile"`       // where to persist unfinished actions on shutdown
+	QueueSize       int    `hcl:"QueueSize"`       // events received but not handled yet; more are refused (503)
+	QueueWorkers    int    `hcl:"QueueWorkers"`    // events handled concurrently
+}
+
+// retry policy for AWS and Zabbix API calls; all durations in seconds, 0 selects the default
+type RetryConfig struct {
+	MaxAttempts     int `hcl:"MaxAttempts"`
+	InitialBackoff  int `hcl:"InitialBackoff"`
+	MaxBackoff      int `hcl:"MaxBackoff"`
+	CallTimeout     int `hcl:"CallTimeout"`     // deadline per single API call
+	RequeueInterval int `hcl:"RequeueInterval"` // how often failed actions are retried
+}
+
+// actions on EC2 state-change and spot interruption events of ASG instances (via EventBridge);
+// unset settings select the defaults, see defaultEC2StateActions
+type EC2Events struct {
+	StateActions              map[string]string `hcl:"StateActions"`              // EC2 state -> MAINTENANCE, UNMONITOR or NONE
+	InterruptionWarningAction string            `hcl:"InterruptionWarningAction"` // spot interruption warning
+	MaintenanceDuration       int               `hcl:"MaintenanceDuration"`       // seconds
+}
+
+// where ASG launch/terminate error events are reported, in addition to log and /status
+type ErrorEvents struct {
+	ZabbixSender string `hcl:"ZabbixSender"` // Zabbix server/proxy host:port receiving trapper values
+	TrapperHost  string `hcl:"TrapperHost"`  // Zabbix host holding the trapper item
+	TrapperKey   string `hcl:"TrapperKey"`   // key of the trapper item (type text)
+}
+
+// executables run for each host removed from monitoring, see runPreHooks() and runPostHooks()
+type Hooks struct {
+	PreAction  []string `hcl:"PreAction"`  // run before; any failing vetoes the action
+	PostAction []string `hcl:"PostAction"` // run after, whatever the outcome
+	Timeout    int      `hcl:"Timeout"`    // seconds per hook
+}
+
+// EC2 metadata copied into Zabbix hosts, see enrichHosts(); disabled unless any is set.
+// Values are Enrich* sources, e.g. "instance-type" or "tag:team".
+type Enrichment struct {
+	HostTags  map[string]string `hcl:"HostTags"`  // Zabbix host tag -> source
+	Macros    map[string]string `hcl:"Macros"`    // user macro, e.g. {$AWS.AMI} -> source
+	Inventory map[string]string `hcl:"Inventory"` // inventory field, e.g. "type" -> source
+}
+
+// append-only log of Zabbix changes, see auditRecord(); disabled unless File is set
+type AuditConfig struct {
+	File       string `hcl:"File"`
+	MaxSize    int    `hcl:"MaxSize"`    // MB; the file is rotated when exceeding it
+	MaxBackups int    `hcl:"MaxBackups"` // rotated files kept (File.1, File.2, ...)
+}
+
+// outgoing notification, see notify(); one Webhook "name" { ... } block per receiver
+type WebhookConfig struct {
+	Name     string   `hcl:",key"`
+	URL      string   `hcl:"URL"`
+	Format   string   `hcl:"Format"`   // json (default), slack or teams
+	Template string   `hcl:"Template"` // json format only: body template; default is the notification as JSON
+	Events   []string `hcl:"Events"`   // notifications to send, see NotifyEvents; default: all
+	Secret   string   `hcl:"Secret"`   // signs body using HMAC-SHA256, see WebhookSignatureHeader
 }
 
 const (
@@ -42,52 +132,164 @@ const (
 	ScaleDownActionDISABLE = "DISABLE"
 )
 
-func readConfig(filename string) AAZConfig {
+// the active configuration and listener ACL; swapped as a whole on SIGHUP
+var activeConfig AAZConfig
+var configMutex sync.RWMutex
+
+func currentConfig() AAZConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return activeConfig
+}
+
+func currentACL() *hostACL {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return listenerACL
+}
+
+func setConfig(c AAZConfig, acl *hostACL) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	activeConfig = c
+	listenerACL = acl
+}
+
+func (c AAZConfig) hasAWSKey() bool {
+	return c.AutoScale.AccessKey != "" && c.AutoScale.SecretKey != ""
+}
+
+func (c AAZConfig) useTLS() bool {
+	return c.ListenerConfig.TLS_CertKey != "" && c.ListenerConfig.TLS_CertPath != ""
+}
+
+func (a AutoScale) credentials() awsCredentials {
+	return awsCredentials{AccessKeyID: a.AccessKey, SecretAccessKey: a.SecretKey}
+}
+
+func (a AutoScale) managedGroups() []string {
+	// All ASG names managed by AAZ: GroupName plus GroupNames.
+	groups := []string{}
+	for _, name := range append([]string{a.GroupName}, a.GroupNames...) {
+		if name != "" && !contains(groups, name) {
+			groups = append(groups, name)
+		}
+	}
+	return groups
+}
+
+func loadConfig(filename string) (AAZConfig, *hostACL, error) {
+	// Reads, decodes and verifies configuration, but does not activate it.
+	// All problems found are returned at once as configErrors.
 	var result AAZConfig
 	fileContents, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatal("FATAL: Cannot read config file ", filename)
+		return result, nil, fmt.Errorf("Cannot read config file %s", filename)
 	}
 	hclParseTree, err := hcl.ParseBytes(fileContents)
 	if err != nil {
-		log.Fatal("FATAL: Config parser error: ", err)
+		return result, nil, fmt.Errorf("%s: Config parser error: %s", filename, err)
 	}
+	validator := newConfigValidator(filename)
+	validator.checkKeys(hclParseTree)
 	if err := hcl.DecodeObject(&result, hclParseTree); err != nil {
-		log.Fatal("FATAL: Error decoding config: ", err)
+		validator.addError(fmt.Errorf("Error decoding config: %s", err))
+		return result, nil, validator.err()
 	}
-	if result.AutoScale.AccessKey != "" && result.AutoScale.SecretKey != "" {
-		ConfigHasAWSKey = true
+	if err := resolveSecrets(&result); err != nil {
+		validator.addError(err)
 	}
-	if result.ListenerConfig.TLS_CertKey != "" && result.ListenerConfig.TLS_CertPath != "" {
-		useTLS = true
+	verifyConfig(result, validator)
+	validator.checkFormats(result)
+	if err := validator.err(); err != nil {
+		return result, nil, err
 	}
-	verifyConfig(result)
-	return result
+	acl, err := buildACL(result.ListenerConfig)
+	if err != nil {
+		return result, nil, fmt.Errorf("Invalid listener access configuration: %s", err)
+	}
+	return result, acl, nil
 }
 
-func verifyConfig(c AAZConfig) {
-	if c.AutoScale.GroupName == "" {
-		log.Fatal("Missing AutoScale.GroupName in configuration file")
+func verifyConfig(c AAZConfig, v *configValidator) {
+	// Checks for missing or contradicting settings.
+	if len(c.AutoScale.managedGroups()) == 0 {
+		v.add("AutoScale.GroupName", "missing")
 	}
 	if c.AutoScale.Region == "" {
-		log.Fatal("Missing AutoScale.Region in configuration file")
+		v.add("AutoScale.Region", "missing")
 	}
-	for _, v := range []string{c.ZabbixConfig.URL, c.ZabbixConfig.User, c.ZabbixConfig.Password} {
-		if v == "" {
-			log.Fatal("Missing Zabbix URL, User or Password in configuration file")
+	for setting, value := range map[string]string{
+		"ZabbixConfig.URL":      c.ZabbixConfig.URL,
+		"ZabbixConfig.User":     c.ZabbixConfig.User,
+		"ZabbixConfig.Password": c.ZabbixConfig.Password,
+	} {
+		if value == "" {
+			v.add(setting, "missing")
 		}
 	}
 	if c.ZabbixConfig.RestrictToGroupId == 0 && c.ZabbixConfig.RestrictToTemplateId == 0 {
-		log.Fatal("FATAL: You must restrict Zabbix hosts to Groups or Templates")
+		v.add("ZabbixConfig", "You must restrict Zabbix hosts to Groups or Templates (RestrictToGroupId/RestrictToTemplateId)")
+	}
+	if c.ListenerConfig.HostsAllow != "" {
+		v.add("ListenerConfig.HostsAllow", "regexp is no longer supported; use AllowedNetworks CIDR list instead")
 	}
-	if c.ListenerConfig.HostsAllow == "" {
-		log.Print("NOTICE: Access to our service is not restricted (no HostsAllow defined)")
+	if len(c.ListenerConfig.AllowedNetworks) == 0 && c.ListenerConfig.AWSIPRangesFile == "" {
+		log.Print("NOTICE: Access to our service is not restricted (no AllowedNetworks defined)")
 	}
 	if c.ZabbixConfig.ScaleDownAction != ScaleDownActionDELETE &&
 		c.ZabbixConfig.ScaleDownAction != ScaleDownActionDISABLE {
-		log.Fatal("ScaleDownAction must be DELETE or DISABLE")
+		v.add("ZabbixConfig.ScaleDownAction", "must be DELETE or DISABLE")
+	}
+	if c.ListenerConfig.TLS_ClientCA != "" && !c.useTLS() {
+		v.add("ListenerConfig.TLS_ClientCA", "requires TLS_CertPath and TLS_CertKey to be set")
 	}
 	if !strings.Contains(c.ListenerConfig.Address, ":") {
-		log.Fatal("Listener address must be of format [IP]:Port")
+		v.add("ListenerConfig.Address", "must be of format [IP]:Port")
+	}
+}
+
+func configDiff(oldConfig AAZConfig, newConfig AAZConfig) []string {
+	// Lists changed settings as "Block.Setting: old -> new". Credentials and secrets are not printed.
+	var changes []string
+	oldValue := reflect.ValueOf(oldConfig)
+	newValue := reflect.ValueOf(newConfig)
+	for i := 0; i < oldValue.NumField(); i++ {
+		blockName := oldValue.Type().Field(i).Name
+		oldBlock, newBlock := oldValue.Field(i), newValue.Field(i)
+		if oldBlock.Kind() == reflect.Slice {
+			// repeated blocks may hold secrets; only their names are printed
+			if !reflect.DeepEqual(oldBlock.Interface(), newBlock.Interface()) {
+				changes = append(changes, fmt.Sprintf("%s: %v -> %v (changed)", blockName, blockNames(oldBlock), blockNames(newBlock)))
+			}
+			continue
+		}
+		for j := 0; j < oldBlock.NumField(); j++ {
+			name := blockName + "." + oldBlock.Type().Field(j).Name
+			before, after := oldBlock.Field(j).Interface(), newBlock.Field(j).Interface()
+			if reflect.DeepEqual(before, after) {
+				continue
+			}
+			if isSecretSetting(name) {
+				changes = append(changes, name+": (changed)")
+			} else {
+				changes = append(changes, redactSecrets(fmt.Sprintf("%s: %v -> %v", name, before, after)))
+			}
+		}
 	}
+	return changes
+}
+
+func blockNames(blocks reflect.Value) []string {
+	// Returns the labels (Name fields) of repeated blocks.
+	names := []string{}
+	for i := 0; i < blocks.Len(); i++ {
+		names = append(names, blocks.Index(i).FieldByName("Name").String())
+	}
+	return names
+}
+
+func isSecretSetting(name string) bool {
+	return name == "ZabbixConfig.Password" || name == "AutoScale.SecretKey" || name == "AutoScale.AccessKey" ||
+		strings.HasPrefix(name, "Webhooks.") && strings.HasSuffix(name, ".Secret")
 }
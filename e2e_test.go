@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// End-to-end tests: SNS notifications and syncs against fake Zabbix and AutoScaling APIs.
+
+func TestSNSTerminateDeletesHost(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa", "i-0bbb")
+	if err := refreshZabbixInventory(); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web")); resp.Code != http.StatusOK {
+		t.Fatalf("snsHandler: %d %s", resp.Code, resp.Body)
+	}
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Error("host i-0aaa not deleted in Zabbix")
+	}
+	if _, ok := zabbix.host("i-0bbb"); !ok {
+		t.Error("host i-0bbb deleted, too")
+	}
+	if _, ok := zabbixInventory.byInstance("i-0aaa"); ok {
+		t.Error("host i-0aaa still in inventory")
+	}
+	if statusSnapshot().Notifications != 1 || statusSnapshot().Errors != 0 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
+
+func TestSNSTerminateDisablesHost(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDISABLE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	if host, _ := zabbix.host("i-0aaa"); host.Status != strconv.Itoa(JSONRPC_StatusDisableHost) {
+		t.Errorf("host not disabled in Zabbix: %+v", host)
+	}
+	if host, _ := zabbixInventory.byInstance("i-0aaa"); !zabbixHostDisabled(host) {
+		t.Errorf("host not disabled in inventory: %+v", host)
+	}
+}
+
+func TestSNSIgnoresOtherEventsAndGroups(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+
+	postSNS(snsNotification("autoscaling:EC2_INSTANCE_LAUNCH", "i-0aaa", "web"))
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "other-asg"))
+	postSNS(`{"Type":"Notification","Message":"not json"}`)
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Error("host deleted")
+	}
+	if zabbix.countCalls(JSONRPC_Method_DeleteHost) != 0 {
+		t.Error("unexpected host.delete call")
+	}
+	if statusSnapshot().Errors != 1 {
+		t.Errorf("expected 1 error for undecodable message, got %+v", statusSnapshot())
+	}
+}
+
+func TestSNSTerminateOfNewHostRefreshesInventory(t *testing.T) {
+	// Host added to Zabbix after inventory was read, e.g. by auto-registration.
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	refreshZabbixInventory()
+	zabbix.addHosts("i-0new")
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0new", "web"))
+	if _, ok := zabbix.host("i-0new"); ok {
+		t.Error("new host not deleted")
+	}
+	if zabbix.countCalls(JSONRPC_Method_GetHost) != 2 {
+		t.Errorf("expected inventory refresh, got %d host.get calls", zabbix.countCalls(JSONRPC_Method_GetHost))
+	}
+}
+
+func TestSNSTerminateOfUnknownHost(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	refreshZabbixInventory()
+
+	unMonitorInstance("i-0unknown", auditTrigger{Source: TriggerEvent})
+	if statusSnapshot().Warnings != 1 || len(failedActions.instanceIds()) != 0 {
+		t.Errorf("unexpected status %+v, failed actions %v", statusSnapshot(), failedActions.instanceIds())
+	}
+}
+
+func TestZabbixSessionExpiryLogsInAgain(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+	zabbix.expireSessions()
+
+	unMonitorInstance("i-0aaa", auditTrigger{Source: TriggerEvent})
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Error("host not deleted after re-login")
+	}
+	if logins := zabbix.countCalls(JSONRPC_Method_UserLogin); logins != 2 {
+		t.Errorf("expected 2 logins, got %d", logins)
+	}
+}
+
+func TestZabbixOutageRequeuesAction(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+	zabbix.failHTTP(JSONRPC_Method_DeleteHost, 2) // as many as MaxAttempts
+
+	unMonitorInstance("i-0aaa", auditTrigger{Source: TriggerEvent})
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Fatal("host deleted despite outage")
+	}
+	if failed := failedActions.instanceIds(); len(failed) != 1 || failed[0] != "i-0aaa" {
+		t.Fatalf("action not re-queued: %v", failed)
+	}
+
+	// what retryFailedActions() does once Zabbix is back
+	failedActions.done("i-0aaa")
+	unMonitorInstance("i-0aaa", auditTrigger{Source: TriggerEvent})
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Error("host not deleted on retry")
+	}
+}
+
+func TestZabbixDeleteAppliedDespiteTimeout(t *testing.T) {
+	// host.delete is applied, but its answer lost; the retry finds the host gone.
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+	zabbix.loseAnswers(JSONRPC_Method_DeleteHost, 1)
+
+	unMonitorInstance("i-0aaa", auditTrigger{Source: TriggerEvent})
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Error("host not deleted")
+	}
+	if _, ok := zabbixInventory.byInstance("i-0aaa"); ok {
+		t.Error("host still in inventory")
+	}
+	if failed := failedActions.instanceIds(); len(failed) != 0 || statusSnapshot().Errors != 0 {
+		t.Errorf("delete reported as failed: %v, %+v", failed, statusSnapshot())
+	}
+}
+
+func TestInitialSyncRemovesStaleHosts(t *testing.T) {
+	// Zabbix knows three hosts, the ASG only one of them: the other two must be deleted.
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa", "i-0bbb", "i-0ccc")
+	autoScaling.setGroup("web", "i-0bbb", "i-0ddd")
+	if err := refreshZabbixInventory(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initalizeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{"i-0aaa": false, "i-0bbb": true, "i-0ccc": false} {
+		if _, ok := zabbix.host(name); ok != exists {
+			t.Errorf("host %s: exists %v, want %v", name, ok, exists)
+		}
+	}
+	if hosts := zabbixInventory.all(); len(hosts) != 1 || hosts[0].InstanceId != "i-0bbb" {
+		t.Errorf("inventory after sync: %+v", hosts)
+	}
+	if calls := zabbix.countCalls(JSONRPC_Method_DeleteHost); calls != 1 {
+		t.Errorf("expected a single batched host.delete, got %d", calls)
+	}
+	if statusSnapshot().LastSync == nil || statusSnapshot().LastSync.Failed {
+		t.Errorf("unexpected sync status %+v", statusSnapshot().LastSync)
+	}
+}
+
+func TestInitialSyncPartialFailure(t *testing.T) {
+	// One host failing must not keep the others from being removed.
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDISABLE)
+	zabbix.addHosts("i-0aaa", "i-0bbb", "i-0ccc")
+	zabbix.failHost("i-0bbb")
+	autoScaling.setGroup("web", "i-0ddd")
+	refreshZabbixInventory()
+
+	initalizeHosts()
+	for name, disabled := range map[string]bool{"i-0aaa": true, "i-0bbb": false, "i-0ccc": true} {
+		if host, _ := zabbix.host(name); zabbixHostDisabled(host) != disabled {
+			t.Errorf("host %s: disabled %v, want %v", name, !disabled, disabled)
+		}
+	}
+	if statusSnapshot().Errors != 1 {
+		t.Errorf("expected 1 error, got %+v", statusSnapshot())
+	}
+	// a permanent error -- not worth retrying
+	if len(failedActions.instanceIds()) != 0 {
+		t.Errorf("unexpected failed actions: %v", failedActions.instanceIds())
+	}
+}
+
+func TestInitialSyncAWSErrors(t *testing.T) {
+	// AWS errors and suspicious results must fail the sync without touching Zabbix.
+	for name, setup := range map[string]func(*fakeAutoScaling){
+		"api error":     func(fake *fakeAutoScaling) { fake.errorCode = "ValidationError" },
+		"empty group":   func(fake *fakeAutoScaling) { fake.setGroup("web") },
+		"missing group": func(fake *fakeAutoScaling) {},
+	} {
+		zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+		zabbix.addHosts("i-0aaa")
+		setup(autoScaling)
+		refreshZabbixInventory()
+
+		if err := initalizeHosts(); err == nil {
+			t.Errorf("%s: sync did not fail", name)
+		}
+		if _, ok := zabbix.host("i-0aaa"); !ok {
+			t.Errorf("%s: host deleted", name)
+		}
+		if statusSnapshot().LastSync == nil || !statusSnapshot().LastSync.Failed {
+			t.Errorf("%s: failed sync not reported: %+v", name, statusSnapshot().LastSync)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/monitoring-instance-state-changes.html
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/spot-instance-termination-notices.html
+type EventBridge_EC2Detail struct {
+	InstanceId     string `json:"instance-id"`
+	State          string `json:"state"`           // State-change Notification
+	InstanceAction string `json:"instance-action"` // Spot Instance Interruption Warning: terminate, stop or hibernate
+}
+
+const (
+	EventBridge_SourceEC2         = "aws.ec2"
+	EventBridge_EC2StateChange    = "EC2 Instance State-change Notification"
+	EventBridge_SpotInterruption  = "EC2 Spot Instance Interruption Warning"
+	EC2ActionMaintenance          = "MAINTENANCE" // put host into a Zabbix maintenance period
+	EC2ActionUnmonitor            = "UNMONITOR"   // apply ScaleDownAction, as for ASG terminations
+	EC2ActionNone                 = "NONE"
+	DefaultEC2MaintenanceDuration = 3600 // seconds
+)
+
+var EC2States = []string{"pending", "running", "stopping", "stopped", "shutting-down", "terminated"}
+var EC2Actions = []string{EC2ActionMaintenance, EC2ActionUnmonitor, EC2ActionNone}
+
+// used for EC2Events.StateActions/InterruptionWarningAction not configured
+var defaultEC2StateActions = map[string]string{"stopping": EC2ActionMaintenance, "terminated": EC2ActionUnmonitor}
+
+const defaultEC2InterruptionWarningAction = EC2ActionMaintenance
+
+// ASG membership of instances seen by syncs or looked up; EC2 events do not name the ASG,
+// and terminated instances are no longer listed by AWS when the event arrives
+var asgMembers = struct {
+	sync.Mutex
+	groups map[string]string // InstanceId -> ASG name
+}{groups: map[string]string{}}
+
+func decodeEC2Event(event EventBridge_Event, result aazEvent) (aazEvent, error) {
+	var detail EventBridge_EC2Detail
+	if err := json.Unmarshal(event.Detail, &detail); err != nil {
+		return aazEvent{}, fmt.Errorf("Decoding EventBridge EC2 event detail failed: %s", err)
+	}
+	result.InstanceId = detail.InstanceId
+	result.State = detail.State
+	if event.DetailType == EventBridge_SpotInterruption {
+		result.State = detail.InstanceAction
+	}
+	return result, nil
+}
+
+func rememberASGMembers(instances []AWS_AutoScalingInstance) {
+	// Adds instances to asgMembers; entries are dropped once instances are terminated.
+	asgMembers.Lock()
+	defer asgMembers.Unlock()
+	for _, instance := range instances {
+		asgMembers.groups[instance.InstanceId] = instance.AutoScalingGroupName
+	}
+}
+
+func autoScalingGroupOf(instanceId string) (string, error) {
+	// Returns the ASG an instance belongs to, or "" if none; asks AWS for instances not seen by last sync.
+	asgMembers.Lock()
+	group, ok := asgMembers.groups[instanceId]
+	asgMembers.Unlock()
+	if ok {
+		return group, nil
+	}
+	config := currentConfig()
+	if !config.hasAWSKey() {
+		return "", fmt.Errorf("cannot look up ASG of instance '%s' without AutoScale AccessKey/SecretKey", instanceId)
+	}
+	instance, found, err := describeAutoScalingInstance(config.AutoScale, instanceId)
+	if err != nil || !found {
+		return "", err
+	}
+	asgMembers.Lock()
+	asgMembers.groups[instanceId] = instance.AutoScalingGroupName
+	asgMembers.Unlock()
+	return instance.AutoScalingGroupName, nil
+}
+
+func ec2EventAction(event aazEvent, config EC2Events) string {
+	// Returns configured action for an EC2 state change or spot interruption warning.
+	if event.Event == EventBridge_SpotInterruption {
+		if config.InterruptionWarningAction != "" {
+			return config.InterruptionWarningAction
+		}
+		return defaultEC2InterruptionWarningAction
+	}
+	stateActions := config.StateActions
+	if stateActions == nil {
+		stateActions = defaultEC2StateActions
+	}
+	if action, ok := stateActions[event.State]; ok {
+		return action
+	}
+	return EC2ActionNone
+}
+
+func handleEC2Event(event aazEvent) {
+	// Maps EC2 state changes and spot interruption warnings of ASG instances to actions.
+	config := currentConfig()
+	action := ec2EventAction(event, config.EC2Events)
+	if action == EC2ActionNone {
+		log.Printf("NOTICE: No action configured for '%s' (%s) of instance '%s' (ignored)", event.Event, event.State, event.InstanceId)
+		return
+	}
+	group, err := autoScalingGroupOf(event.InstanceId)
+	if err != nil {
+		log.Printf("ERROR: Cannot handle '%s' of instance '%s': %s", event.Event, event.InstanceId, err)
+		countError()
+		return
+	}
+	if !contains(config.AutoScale.managedGroups(), group) {
+		log.Printf("NOTICE: Received '%s' for instance '%s' not in managed ASGs (ignored)", event.Event, event.InstanceId)
+		return
+	}
+	log.Printf("Received '%s' (%s) for instance '%s' of ASG '%s' -- %s", event.Event, event.State, event.InstanceId, group, action)
+	switch action {
+	case EC2ActionUnmonitor:
+		unMonitorInstance(event.InstanceId, eventTrigger(event))
+	case EC2ActionMaintenance:
+		maintainInstance(event.InstanceId, fmt.Sprintf("%s: %s", event.Event, event.State), config.EC2Events.maintenanceDuration(), eventTrigger(event))
+	}
+	if event.State == "terminated" {
+		asgMembers.Lock()
+		delete(asgMembers.groups, event.InstanceId)
+		asgMembers.Unlock()
+	}
+	countNotification()
+}
+
+func maintainInstance(instanceId string, reason string, duration time.Duration, trigger auditTrigger) {
+	// Puts the Zabbix host of an instance into maintenance (with data collection) for duration.
+	host, ok := zabbixInventory.byInstance(instanceId)
+	if !ok {
+		if refreshZabbixInventory() == nil {
+			host, ok = zabbixInventory.byInstance(instanceId)
+		}
+	}
+	if !ok {
+		log.Printf("WARNING: Attempt to put instance '%s' not found in Zabbix into maintenance", instanceId)
+		countWarning()
+		return
+	}
+	audit := auditEntry{Action: EC2ActionMaintenance, InstanceId: instanceId, Before: &host, Trigger: trigger, Result: AuditSuccess}
+	if DryRun {
+		log.Printf("DRY-RUN: Would now put Zabbix host '%s' into maintenance for %s", host.Host, duration)
+		audit.Result = AuditDryRun
+		auditRecord(audit)
+		return
+	}
+	name := fmt.Sprintf("AAZ %s %s (%s)", host.Host, time.Now().UTC().Format(time.RFC3339), reason)
+	if err := zabbixCreateMaintenance(name, []string{host.HostId}, duration); err != nil {
+		log.Printf("ERROR: Failed to put host '%s' into maintenance: %s", host.Host, err)
+		countError()
+		notify(aazNotification{Event: NotifyFailure, Action: EC2ActionMaintenance, Host: host.Host, HostId: host.HostId,
+			InstanceId: instanceId, Error: err.Error(),
+			Message: fmt.Sprintf("AAZ failed to put Zabbix host '%s' into maintenance: %s", host.Host, err)})
+		audit.Result, audit.Error = AuditFailed, err.Error()
+		auditRecord(audit)
+		return
+	}
+	log.Printf("SUCCESS: Host '%s' in maintenance for %s", host.Host, duration)
+	auditRecord(audit)
+	notify(aazNotification{Event: NotifyAction, Action: EC2ActionMaintenance, Host: host.Host, HostId: host.HostId,
+		InstanceId: instanceId, Message: fmt.Sprintf("AAZ put Zabbix host '%s' into maintenance for %s (%s)", host.Host, duration, reason)})
+}
+
+func (c EC2Events) maintenanceDuration() time.Duration {
+	if c.MaintenanceDuration <= 0 {
+		return DefaultEC2MaintenanceDuration * time.Second
+	}
+	return time.Duration(c.MaintenanceDuration) * time.Second
+}
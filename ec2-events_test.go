@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func ec2StateChange(instanceId string, state string) string {
+	return fmt.Sprintf(`{"version":"0","id":"7bf73129-1428-4cd3-a780-95db273d1602","detail-type":"%s",`+
+		`"source":"aws.ec2","account":"123456789012","time":"2026-10-19T10:00:00Z","region":"eu-west-1",`+
+		`"resources":["arn:aws:ec2:eu-west-1:123456789012:instance/%s"],"detail":{"instance-id":"%s","state":"%s"}}`,
+		EventBridge_EC2StateChange, instanceId, instanceId, state)
+}
+
+func spotInterruption(instanceId string) string {
+	return fmt.Sprintf(`{"version":"0","id":"1e5527d7-bb36-4607-3370-4164db56a40e","detail-type":"%s",`+
+		`"source":"aws.ec2","account":"123456789012","time":"2026-10-19T10:00:00Z","region":"eu-west-1",`+
+		`"resources":[],"detail":{"instance-id":"%s","instance-action":"terminate"}}`,
+		EventBridge_SpotInterruption, instanceId)
+}
+
+func TestDecodeEC2Events(t *testing.T) {
+	for body, want := range map[string]aazEvent{
+		ec2StateChange("i-0aaa", "stopping"): {Event: EventBridge_EC2StateChange, InstanceId: "i-0aaa", State: "stopping",
+			MessageId: "7bf73129-1428-4cd3-a780-95db273d1602"},
+		spotInterruption("i-0bbb"): {Event: EventBridge_SpotInterruption, InstanceId: "i-0bbb", State: "terminate",
+			MessageId: "1e5527d7-bb36-4607-3370-4164db56a40e"},
+	} {
+		events, err := decodeEvents([]byte(snsEnvelope(body)))
+		want.Source, want.Via = EventSourceEventBridge, EventViaSNS
+		if err != nil || len(events) != 1 || events[0] != want {
+			t.Errorf("got %+v, %v; want %+v", events, err, want)
+		}
+	}
+}
+
+func TestEC2EventAction(t *testing.T) {
+	configured := EC2Events{StateActions: map[string]string{"stopped": EC2ActionUnmonitor}, InterruptionWarningAction: EC2ActionNone}
+	tests := []struct {
+		event  aazEvent
+		config EC2Events
+		want   string
+	}{
+		{aazEvent{Event: EventBridge_EC2StateChange, State: "stopping"}, EC2Events{}, EC2ActionMaintenance},
+		{aazEvent{Event: EventBridge_EC2StateChange, State: "terminated"}, EC2Events{}, EC2ActionUnmonitor},
+		{aazEvent{Event: EventBridge_EC2StateChange, State: "running"}, EC2Events{}, EC2ActionNone},
+		{aazEvent{Event: EventBridge_SpotInterruption, State: "terminate"}, EC2Events{}, EC2ActionMaintenance},
+		{aazEvent{Event: EventBridge_EC2StateChange, State: "stopping"}, configured, EC2ActionNone},
+		{aazEvent{Event: EventBridge_EC2StateChange, State: "stopped"}, configured, EC2ActionUnmonitor},
+		{aazEvent{Event: EventBridge_SpotInterruption, State: "terminate"}, configured, EC2ActionNone},
+	}
+	for _, test := range tests {
+		if got := ec2EventAction(test.event, test.config); got != test.want {
+			t.Errorf("%s (%s) with %+v: got %s, want %s", test.event.Event, test.event.State, test.config, got, test.want)
+		}
+	}
+}
+
+func TestEC2StoppingStartsMaintenance(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setGroup("web", "i-0aaa")
+	zabbix.addHosts("i-0aaa")
+
+	postSNS(ec2StateChange("i-0aaa", "stopping"))
+	host, _ := zabbix.host("i-0aaa")
+	maintenance := zabbix.maintenanceOf(host.HostId)
+	if len(maintenance) != 1 {
+		t.Fatalf("got %d maintenance periods, want 1", len(maintenance))
+	}
+	if period := maintenance[0].TimePeriods[0].Period; period != int64(DefaultEC2MaintenanceDuration) {
+		t.Errorf("got maintenance period %d, want %d", period, DefaultEC2MaintenanceDuration)
+	}
+	if statusSnapshot().Notifications != 1 || statusSnapshot().Errors != 0 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
+
+func TestEC2TerminatedUnmonitorsKnownMember(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setGroup("web", "i-0aaa", "i-0bbb")
+	zabbix.addHosts("i-0aaa", "i-0bbb")
+	refreshZabbixInventory()
+	if _, err := currentSyncPlan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// AWS no longer lists terminated instances; membership is known from the sync
+	autoScaling.setGroup("web", "i-0bbb")
+	postSNS(ec2StateChange("i-0aaa", "terminated"))
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Error("host not deleted")
+	}
+	if _, ok := zabbix.host("i-0bbb"); !ok {
+		t.Error("other host deleted")
+	}
+}
+
+func TestEC2TerminatedUnmonitorsLaunchedMember(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setGroup("web", "i-0aaa")
+	zabbix.addHosts("i-0aaa", "i-0bbb")
+	refreshZabbixInventory()
+	if _, err := currentSyncPlan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// launched after the last sync, and gone from AWS once terminated
+	postSNS(snsNotification(SNS_EV_Launch, "i-0bbb", "web"))
+	postSNS(ec2StateChange("i-0bbb", "terminated"))
+	if _, ok := zabbix.host("i-0bbb"); ok {
+		t.Error("host of launched instance not deleted")
+	}
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Error("other host deleted")
+	}
+}
+
+func TestEC2TerminatedUnmonitorsOnce(t *testing.T) {
+	// the ASG notifies the termination, too -- in either order
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setGroup("web", "i-0aaa", "i-0bbb")
+	zabbix.addHosts("i-0aaa", "i-0bbb")
+	refreshZabbixInventory()
+	if _, err := currentSyncPlan(); err != nil {
+		t.Fatal(err)
+	}
+	autoScaling.setGroup("web")
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	postSNS(ec2StateChange("i-0aaa", "terminated"))
+	postSNS(ec2StateChange("i-0bbb", "terminated"))
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0bbb", "web"))
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Error("host not deleted")
+	}
+	if _, ok := zabbix.host("i-0bbb"); ok {
+		t.Error("host not deleted")
+	}
+	if calls := zabbix.countCalls(JSONRPC_Method_GetHost); calls != 1 {
+		t.Errorf("got %d host.get calls, want 1 (no inventory refresh)", calls)
+	}
+	if statusSnapshot().Warnings != 0 || statusSnapshot().Errors != 0 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
+
+func TestEC2EventsOfOtherInstancesIgnored(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setGroup("web", "i-0aaa")
+	autoScaling.setGroup("batch", "i-0bbb")
+	zabbix.addHosts("i-0aaa", "i-0bbb", "i-0ccc")
+
+	postSNS(spotInterruption("i-0bbb"))
+	postSNS(ec2StateChange("i-0ccc", "terminated"))
+	for _, name := range []string{"i-0bbb", "i-0ccc"} {
+		host, ok := zabbix.host(name)
+		if !ok || len(zabbix.maintenanceOf(host.HostId)) != 0 {
+			t.Errorf("host %s acted upon", name)
+		}
+	}
+	if statusSnapshot().Notifications != 0 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
+
+func TestEC2MaintenanceDuration(t *testing.T) {
+	if got := (EC2Events{MaintenanceDuration: 600}).maintenanceDuration(); got != 10*time.Minute {
+		t.Errorf("got %s", got)
+	}
+	if got := (EC2Events{}).maintenanceDuration(); got != time.Hour {
+		t.Errorf("got %s for default", got)
+	}
+}
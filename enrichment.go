@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Values copied by Enrichment; EnrichTagPrefix + key selects the value of an EC2 tag.
+const (
+	EnrichInstanceType = "instance-type"
+	EnrichAZ           = "availability-zone"
+	EnrichPrivateIP    = "private-ip"
+	EnrichAMI          = "ami"
+	EnrichASG          = "asg"
+	EnrichTagPrefix    = "tag:"
+
+	JSONRPC_Method_CreateMacro = "usermacro.create"
+	JSONRPC_Method_UpdateMacro = "usermacro.update"
+	JSONRPC_InventoryDisabled  = "-1"
+	JSONRPC_InventoryManual    = 0
+)
+
+var EnrichSources = []string{EnrichInstanceType, EnrichAZ, EnrichPrivateIP, EnrichAMI, EnrichASG}
+
+// https://www.zabbix.com/documentation/3.2/manual/api/reference/host/get
+type JSONRPC_GetHostEnrichParams struct {
+	Output          []string `json:"output"`
+	HostIds         []string `json:"hostids"`
+	SelectTags      string   `json:"selectTags"`
+	SelectMacros    string   `json:"selectMacros"`
+	SelectInventory string   `json:"selectInventory"`
+}
+type JSONRPC_EnrichHost struct {
+	HostId        string              `json:"hostid"`
+	Host          string              `json:"host"`
+	InventoryMode string              `json:"inventory_mode"`
+	Tags          []JSONRPC_HostTag   `json:"tags"`
+	Macros        []JSONRPC_HostMacro `json:"macros"`
+	Inventory     json.RawMessage     `json:"inventory"` // object; an empty array if inventory is disabled
+}
+
+// https://www.zabbix.com/documentation/3.2/manual/api/reference/usermacro/object
+type JSONRPC_HostMacro struct {
+	HostMacroId string `json:"hostmacroid,omitempty"`
+	HostId      string `json:"hostid,omitempty"`
+	Macro       string `json:"macro"`
+	Value       string `json:"value"`
+}
+
+// enrichTarget is a Zabbix host of an ASG instance.
+type enrichTarget struct {
+	HostId               string
+	InstanceId           string
+	AutoScalingGroupName string
+}
+
+func (c Enrichment) enabled() bool {
+	return len(c.HostTags) > 0 || len(c.Macros) > 0 || len(c.Inventory) > 0
+}
+
+func validEnrichSource(source string) bool {
+	return contains(EnrichSources, source) || (strings.HasPrefix(source, EnrichTagPrefix) && len(source) > len(EnrichTagPrefix))
+}
+
+func (i AWS_EC2Instance) enrichValue(source string, group string) (string, bool) {
+	// Value of source for instance; false for EC2 tags not set on instance.
+	switch source {
+	case EnrichInstanceType:
+		return i.InstanceType, true
+	case EnrichAZ:
+		return i.AvailabilityZone, true
+	case EnrichPrivateIP:
+		return i.PrivateIpAddress, true
+	case EnrichAMI:
+		return i.ImageId, true
+	case EnrichASG:
+		return group, true
+	}
+	for _, tag := range i.Tags {
+		if EnrichTagPrefix+tag.Key == source {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
+
+func enrichPlannedHosts(plan syncPlan, trigger auditTrigger) {
+	// Enriches the hosts a sync keeps, i.e. those of instances in managed ASGs.
+	var targets []enrichTarget
+	for _, step := range plan.Steps {
+		if step.Action == PlanActionKeep {
+			targets = append(targets, enrichTarget{HostId: step.HostId, InstanceId: step.InstanceId, AutoScalingGroupName: step.AutoScalingGroup})
+		}
+	}
+	enrichHosts(targets, trigger)
+}
+
+func enrichInstance(instanceId string, group string, trigger auditTrigger) {
+	// Enriches the host of a launched instance -- if Zabbix knows it already; otherwise the next sync does.
+	if !currentConfig().Enrichment.enabled() {
+		return
+	}
+	host, ok := zabbixInventory.byInstance(instanceId)
+	if !ok && refreshZabbixInventory() == nil {
+		host, ok = zabbixInventory.byInstance(instanceId)
+	}
+	if !ok {
+		log.Printf("NOTICE: Instance '%s' not in Zabbix (yet), not enriching its host", instanceId)
+		return
+	}
+	enrichHosts([]enrichTarget{{HostId: host.HostId, InstanceId: instanceId, AutoScalingGroupName: group}}, trigger)
+}
+
+func enrichHosts(targets []enrichTarget, trigger auditTrigger) {
+	// Writes EC2 metadata into Zabbix host tags, macros and inventory as per Enrichment;
+	// hosts are only updated if values differ.
+	config := currentConfig()
+	if !config.Enrichment.enabled() || len(targets) == 0 {
+		return
+	}
+	var instanceIds, hostIds []string
+	for _, target := range targets {
+		instanceIds = append(instanceIds, target.InstanceId)
+		hostIds = append(hostIds, target.HostId)
+	}
+	instances, err := describeEC2Instances(config.AutoScale, instanceIds)
+	if err != nil {
+		log.Printf("ERROR: Cannot enrich Zabbix hosts, DescribeInstances failed: %s", err)
+		countError()
+		return
+	}
+	params := JSONRPC_GetHostEnrichParams{Output: []string{"hostid", "host", "inventory_mode"}, HostIds: hostIds,
+		SelectTags: "extend", SelectMacros: "extend", SelectInventory: "extend"}
+	var hosts []JSONRPC_EnrichHost
+	if err := zabbixAPI(JSONRPC_Method_GetHost, params, &hosts); err != nil {
+		log.Printf("ERROR: Cannot enrich Zabbix hosts: %s", err)
+		countError()
+		return
+	}
+	byHostId := map[string]JSONRPC_EnrichHost{}
+	for _, host := range hosts {
+		byHostId[host.HostId] = host
+	}
+	for _, target := range targets {
+		instance, ok := instances[target.InstanceId]
+		host, found := byHostId[target.HostId]
+		if !ok || !found {
+			log.Printf("NOTICE: Instance '%s' (hostid %s) not found in EC2 or Zabbix, not enriched", target.InstanceId, target.HostId)
+			continue
+		}
+		enrichHost(host, config.Enrichment.desired(instance, target.AutoScalingGroupName), target.InstanceId, trigger)
+	}
+}
+
+// enrichment lists the values a host should have.
+type enrichment struct {
+	tags, macros, inventory map[string]string
+}
+
+func (c Enrichment) desired(instance AWS_EC2Instance, group string) enrichment {
+	resolve := func(sources map[string]string) map[string]string {
+		values := map[string]string{}
+		for name, source := range sources {
+			if value, ok := instance.enrichValue(source, group); ok {
+				values[name] = value
+			}
+		}
+		return values
+	}
+	return enrichment{tags: resolve(c.HostTags), macros: resolve(c.Macros), inventory: resolve(c.Inventory)}
+}
+
+func enrichHost(host JSONRPC_EnrichHost, want enrichment, instanceId string, trigger auditTrigger) {
+	// Updates host where it differs from want: tags and inventory using host.update, macros one by one.
+	var changes []string
+	update := map[string]interface{}{"hostid": host.HostId}
+
+	// host.update replaces all tags; those not managed are kept as they are
+	tagsDiffer := false
+	tags := []JSONRPC_HostTag{}
+	for _, tag := range host.Tags {
+		if _, managed := want.tags[tag.Tag]; !managed {
+			tags = append(tags, tag)
+		}
+	}
+	for _, name := range sortedKeys(want.tags) {
+		tags = append(tags, JSONRPC_HostTag{Tag: name, Value: want.tags[name]})
+		if !hasTag(host.Tags, name, want.tags[name]) {
+			tagsDiffer = true
+			changes = append(changes, fmt.Sprintf("tag %s=%s", name, want.tags[name]))
+		}
+	}
+	if tagsDiffer {
+		update["tags"] = tags
+	}
+
+	inventory := map[string]string{}
+	json.Unmarshal(host.Inventory, &inventory) // stays empty if inventory is disabled
+	inventoryUpdate := map[string]string{}
+	for _, field := range sortedKeys(want.inventory) {
+		if inventory[field] != want.inventory[field] {
+			inventoryUpdate[field] = want.inventory[field]
+			changes = append(changes, fmt.Sprintf("inventory %s=%s", field, want.inventory[field]))
+		}
+	}
+	if len(inventoryUpdate) > 0 {
+		update["inventory"] = inventoryUpdate
+		if host.InventoryMode == JSONRPC_InventoryDisabled {
+			update["inventory_mode"] = JSONRPC_InventoryManual
+		}
+	}
+
+	// macros are created or updated one by one, leaving other macros (and secret values) alone
+	var macros []JSONRPC_HostMacro
+	for _, name := range sortedKeys(want.macros) {
+		macro := JSONRPC_HostMacro{Macro: name, Value: want.macros[name]}
+		current, exists := "", false
+		for _, existing := range host.Macros {
+			if existing.Macro == name {
+				macro.HostMacroId, current, exists = existing.HostMacroId, existing.Value, true
+			}
+		}
+		if exists && current == macro.Value {
+			continue
+		}
+		macros = append(macros, macro)
+		changes = append(changes, fmt.Sprintf("macro %s=%s", name, macro.Value))
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+	audit := auditEntry{Action: AuditActionUpdate, InstanceId: instanceId, Before: &ZabbixHost{HostId: host.HostId, Host: host.Host},
+		Trigger: trigger, Changes: changes, Result: AuditSuccess}
+	if DryRun {
+		log.Printf("DRY-RUN: Would now update Zabbix host '%s': %s", host.Host, strings.Join(changes, ", "))
+		audit.Result = AuditDryRun
+		auditRecord(audit)
+		return
+	}
+	var err error
+	if len(update) > 1 {
+		err = zabbixAPI(JSONRPC_Method_UpdateHost, update, nil)
+	}
+	for _, macro := range macros {
+		if err != nil {
+			break
+		}
+		if macro.HostMacroId == "" {
+			macro.HostId = host.HostId
+			err = zabbixAPI(JSONRPC_Method_CreateMacro, macro, nil)
+		} else {
+			err = zabbixAPI(JSONRPC_Method_UpdateMacro, map[string]string{"hostmacroid": macro.HostMacroId, "value": macro.Value}, nil)
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to enrich Zabbix host '%s': %s", host.Host, err)
+		countError()
+		audit.Result, audit.Error = AuditFailed, err.Error()
+		auditRecord(audit)
+		return
+	}
+	log.Printf("SUCCESS: Enriched Zabbix host '%s': %s", host.Host, strings.Join(changes, ", "))
+	auditRecord(audit)
+	if tagsDiffer {
+		if known, ok := zabbixInventory.byHostId(host.HostId); ok {
+			known.Tags = tags
+			zabbixInventory.set(known)
+		}
+	}
+}
+
+func hasTag(tags []JSONRPC_HostTag, name string, value string) bool {
+	// true if name is set to value only (Zabbix allows a tag name more than once)
+	found := false
+	for _, tag := range tags {
+		if tag.Tag == name {
+			if tag.Value != value {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+)
+
+func setEnrichment(enrichment Enrichment) {
+	config := currentConfig()
+	config.Enrichment = enrichment
+	setConfig(config, currentACL())
+}
+
+func tagValue(tags []JSONRPC_HostTag, name string) string {
+	for _, tag := range tags {
+		if tag.Tag == name {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+func macroValue(macros []JSONRPC_HostMacro, name string) string {
+	for _, macro := range macros {
+		if macro.Macro == name {
+			return macro.Value
+		}
+	}
+	return ""
+}
+
+func TestEnrichmentOnSync(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setGroup("web", "i-0aaa")
+	autoScaling.setEC2Instance(AWS_EC2Instance{InstanceId: "i-0aaa", ImageId: "ami-0123", InstanceType: "t3.small",
+		AvailabilityZone: "eu-west-1a", PrivateIpAddress: "10.0.0.5", Tags: []AWS_EC2Tag{{Key: "team", Value: "ops"}}})
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+	setAudit(t, AuditConfig{})
+	setEnrichment(Enrichment{
+		HostTags:  map[string]string{"aws:az": EnrichAZ, "team": "tag:team", "owner": "tag:owner"},
+		Macros:    map[string]string{"{$AWS.ASG}": EnrichASG, "{$ROLE}": "tag:team"},
+		Inventory: map[string]string{"type": EnrichInstanceType, "host_networks": EnrichPrivateIP, "os_short": EnrichAMI},
+	})
+
+	if err := initalizeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	details := zabbix.detailsOf("i-0aaa")
+	for name, want := range map[string]string{"env": "prod", "aws:az": "eu-west-1a", "team": "ops", "owner": ""} {
+		if got := tagValue(details.tags, name); got != want {
+			t.Errorf("got tag %s='%s', want '%s'", name, got, want)
+		}
+	}
+	if host, _ := zabbixInventory.byInstance("i-0aaa"); tagValue(host.Tags, "aws:az") != "eu-west-1a" {
+		t.Errorf("inventory not updated, tags %+v", host.Tags)
+	}
+	if len(details.macros) != 2 || macroValue(details.macros, "{$ROLE}") != "ops" || macroValue(details.macros, "{$AWS.ASG}") != "web" {
+		t.Errorf("unexpected macros %+v", details.macros)
+	}
+	for field, want := range map[string]string{"os": "Linux", "type": "t3.small", "host_networks": "10.0.0.5", "os_short": "ami-0123"} {
+		if got := details.inventory[field]; got != want {
+			t.Errorf("got inventory %s='%s', want '%s'", field, got, want)
+		}
+	}
+	entries := auditEntries(t, func(entry auditEntry) bool { return entry.Action == AuditActionUpdate })
+	if len(entries) != 1 || len(entries[0].Changes) != 7 || entries[0].Trigger.Source != TriggerSync {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+
+	// nothing differs anymore
+	updates := zabbix.countCalls(JSONRPC_Method_UpdateHost) + zabbix.countCalls(JSONRPC_Method_CreateMacro) +
+		zabbix.countCalls(JSONRPC_Method_UpdateMacro)
+	if err := initalizeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	if zabbix.countCalls(JSONRPC_Method_UpdateHost)+zabbix.countCalls(JSONRPC_Method_CreateMacro)+
+		zabbix.countCalls(JSONRPC_Method_UpdateMacro) != updates {
+		t.Error("host updated although values did not change")
+	}
+}
+
+func TestEnrichmentOnLaunch(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setEC2Instance(AWS_EC2Instance{InstanceId: "i-0aaa", InstanceType: "c5.large"})
+	zabbix.addHosts("i-0aaa")
+	zabbix.mutex.Lock()
+	for _, details := range zabbix.details {
+		details.inventoryMode = JSONRPC_InventoryDisabled
+	}
+	zabbix.mutex.Unlock()
+	setEnrichment(Enrichment{Inventory: map[string]string{"type": EnrichInstanceType}})
+
+	postSNS(snsNotification(SNS_EV_Launch, "i-0aaa", "web"))
+	details := zabbix.detailsOf("i-0aaa")
+	if details.inventoryMode != "0" || details.inventory["type"] != "c5.large" {
+		t.Errorf("unexpected inventory %v (mode %s)", details.inventory, details.inventoryMode)
+	}
+	postSNS(snsNotification(SNS_EV_Launch, "i-0bbb", "web")) // not in Zabbix yet
+	if statusSnapshot().Errors != 0 || statusSnapshot().Notifications != 2 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
+
+func TestEnrichmentDescribeInstancesFails(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	setEnrichment(Enrichment{HostTags: map[string]string{"type": EnrichInstanceType}})
+	autoScaling.errorCode = "UnauthorizedOperation"
+
+	postSNS(snsNotification(SNS_EV_Launch, "i-0aaa", "web"))
+	if statusSnapshot().Errors != 1 || zabbix.countCalls(JSONRPC_Method_UpdateHost) != 0 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
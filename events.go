@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// aazEvent is the normalized form of all events AAZ handles: classic ASG
+// notifications and EventBridge events, delivered via SNS, SQS or HTTP.
+type aazEvent struct {
+	Event                string // ASG notification event, e.g. SNS_EV_Terminate; EventBridge detail-types are mapped to these
+	InstanceId           string
+	AutoScalingGroupName string
+	Source               string // EventSourceASG or EventSourceEventBridge
+	Via                  string // EventViaSNS, EventViaSQS or EventViaHTTP
+	SubscribeURL         string // set for SNS subscription confirmations only
+	State                string // EC2 events only: new instance state, or instance-action of a spot interruption warning
+	StatusMessage        string // ASG error events only: reason of failure
+	Cause                string
+	MessageId            string // EventBridge event id, SNS MessageId or SQS messageId -- the innermost one
+	Client               string // set by snsHandler, see auditTrigger
+}
+
+// https://docs.aws.amazon.com/eventbridge/latest/userguide/eb-events-structure.html
+type EventBridge_Event struct {
+	Version    string          `json:"version"`
+	Id         string          `json:"id"`
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Account    string          `json:"account"`
+	Time       string          `json:"time"`
+	Region     string          `json:"region"`
+	Detail     json.RawMessage `json:"detail"` // depends on Source
+}
+
+// https://docs.aws.amazon.com/autoscaling/ec2/userguide/automating-ec2-auto-scaling-with-eventbridge.html
+type EventBridge_ASGDetail struct {
+	EC2InstanceId        string `json:"EC2InstanceId"`
+	AutoScalingGroupName string `json:"AutoScalingGroupName"`
+	StatusMessage        string `json:"StatusMessage"`
+	Cause                string `json:"Cause"`
+}
+
+// SQS messages, as delivered in batches by Lambda/EventBridge Pipes
+type SQS_Records struct {
+	Records []SQS_Message `json:"Records"`
+}
+type SQS_Message struct {
+	MessageId   string `json:"messageId"`
+	Body        string `json:"body"`
+	EventSource string `json:"eventSource"`
+}
+
+const (
+	EventSourceASG         = "asg-notification"
+	EventSourceEventBridge = "eventbridge"
+	EventViaSNS            = "sns"
+	EventViaSQS            = "sqs"
+	EventViaHTTP           = "http"
+
+	EventBridge_SourceAutoScaling = "aws.autoscaling"
+	SQS_EventSource               = "aws:sqs"
+)
+
+// EventBridge detail-types of aws.autoscaling mapped to classic ASG notification events
+var eventBridgeASGEvents = map[string]string{
+	"EC2 Instance Launch Successful":      SNS_EV_Launch,
+	"EC2 Instance Launch Unsuccessful":    SNS_EV_LaunchError,
+	"EC2 Instance Terminate Successful":   SNS_EV_Terminate,
+	"EC2 Instance Terminate Unsuccessful": SNS_EV_TerminateError,
+}
+
+// envelope is used to recognise the format of a request body or message
+type envelope struct {
+	Type       string            `json:"Type"` // SNS
+	Message    string            `json:"Message"`
+	MessageId  string            `json:"MessageId"`
+	Records    []json.RawMessage `json:"Records"`     // SQS
+	DetailType string            `json:"detail-type"` // EventBridge
+	Event      string            `json:"Event"`       // ASG notification
+}
+
+func decodeEvents(body []byte) ([]aazEvent, error) {
+	// Decodes a request body received by the listener: an SNS notification, a batch of
+	// SQS messages or an EventBridge event posted by an API destination.
+	return decodeEnvelope(body, EventViaHTTP)
+}
+
+func decodeEnvelope(body []byte, via string) ([]aazEvent, error) {
+	var probe envelope
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, fmt.Errorf("Decoding JSON failed: %s", err)
+	}
+	switch {
+	case probe.Type == SNS_Type_Subscription:
+		var notification SNS_Notification
+		json.Unmarshal(body, &notification)
+		return []aazEvent{{Event: SNS_Type_Subscription, SubscribeURL: notification.SubscribeURL, Via: EventViaSNS}}, nil
+	case probe.Type == SNS_Type_Notification:
+		event, err := decodeMessage([]byte(probe.Message), EventViaSNS)
+		if err != nil {
+			return nil, err
+		}
+		if event.MessageId == "" {
+			event.MessageId = probe.MessageId
+		}
+		return []aazEvent{event}, nil
+	case probe.Type != "":
+		return nil, fmt.Errorf("Invalid notification type received: '%s'", probe.Type)
+	case probe.Records != nil:
+		return decodeSQSRecords(body)
+	}
+	event, err := decodeMessage(body, via)
+	if err != nil {
+		return nil, err
+	}
+	return []aazEvent{event}, nil
+}
+
+func decodeSQSRecords(body []byte) ([]aazEvent, error) {
+	// SQS message bodies may hold SNS notifications (SNS subscription without raw delivery)
+	// or the event itself; undecodable messages are skipped, but reported.
+	var batch SQS_Records
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, fmt.Errorf("Decoding SQS messages failed: %s", err)
+	}
+	var events []aazEvent
+	var errs []error
+	for _, message := range batch.Records {
+		if message.EventSource != SQS_EventSource {
+			errs = append(errs, fmt.Errorf("SQS message %s: unexpected eventSource '%s'", message.MessageId, message.EventSource))
+			continue
+		}
+		messageEvents, err := decodeEnvelope([]byte(message.Body), EventViaSQS)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SQS message %s: %s", message.MessageId, err))
+			continue
+		}
+		for _, event := range messageEvents {
+			if event.Via == EventViaHTTP {
+				event.Via = EventViaSQS
+			}
+			if event.MessageId == "" {
+				event.MessageId = message.MessageId
+			}
+			events = append(events, event)
+		}
+	}
+	return events, errors.Join(errs...)
+}
+
+func decodeMessage(message []byte, via string) (aazEvent, error) {
+	// Decodes a single ASG notification or EventBridge event.
+	var probe envelope
+	if err := json.Unmarshal(message, &probe); err != nil {
+		return aazEvent{}, fmt.Errorf("Decoding JSON message failed: %s", err)
+	}
+	if probe.DetailType != "" {
+		return decodeEventBridge(message, via)
+	}
+	var asgMessage SNS_Message
+	json.Unmarshal(message, &asgMessage)
+	if asgMessage.Event == "" {
+		return aazEvent{}, errors.New("Unrecognized message format (neither ASG notification nor EventBridge event)")
+	}
+	return aazEvent{Event: asgMessage.Event, InstanceId: asgMessage.EC2InstanceId,
+		AutoScalingGroupName: asgMessage.AutoScalingGroupName, StatusMessage: asgMessage.StatusMessage,
+		Cause: asgMessage.Cause, Source: EventSourceASG, Via: via}, nil
+}
+
+func decodeEventBridge(message []byte, via string) (aazEvent, error) {
+	var event EventBridge_Event
+	if err := json.Unmarshal(message, &event); err != nil {
+		return aazEvent{}, fmt.Errorf("Decoding EventBridge event failed: %s", err)
+	}
+	result := aazEvent{Event: event.DetailType, Source: EventSourceEventBridge, Via: via, MessageId: event.Id}
+	if event.Source == EventBridge_SourceEC2 {
+		return decodeEC2Event(event, result)
+	}
+	if event.Source != EventBridge_SourceAutoScaling {
+		// not handled (yet); passed on with detail-type as event, to be ignored
+		return result, nil
+	}
+	var detail EventBridge_ASGDetail
+	if err := json.Unmarshal(event.Detail, &detail); err != nil {
+		return aazEvent{}, fmt.Errorf("Decoding EventBridge event detail failed: %s", err)
+	}
+	if mapped, ok := eventBridgeASGEvents[event.DetailType]; ok {
+		result.Event = mapped
+	}
+	result.InstanceId = detail.EC2InstanceId
+	result.AutoScalingGroupName = detail.AutoScalingGroupName
+	result.StatusMessage = detail.StatusMessage
+	result.Cause = detail.Cause
+	return result, nil
+}
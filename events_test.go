@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+const eventBridgeTerminate = `{"version":"0","id":"12345678-1234-1234-1234-123456789012",` +
+	`"detail-type":"EC2 Instance Terminate Successful","source":"aws.autoscaling","account":"123456789012",` +
+	`"time":"2026-10-19T10:00:00Z","region":"eu-west-1","resources":[],` +
+	`"detail":{"StatusCode":"InProgress","AutoScalingGroupName":"web","EC2InstanceId":"i-0aaa"}}`
+
+func snsEnvelope(message string) string {
+	notification, _ := json.Marshal(SNS_Notification{Type: SNS_Type_Notification, Message: message})
+	return string(notification)
+}
+
+func sqsBatch(bodies ...string) string {
+	var batch SQS_Records
+	for i, body := range bodies {
+		batch.Records = append(batch.Records, SQS_Message{MessageId: fmt.Sprint(i), Body: body, EventSource: SQS_EventSource})
+	}
+	batchJSON, _ := json.Marshal(batch)
+	return string(batchJSON)
+}
+
+func TestDecodeEvents(t *testing.T) {
+	terminate := aazEvent{Event: SNS_EV_Terminate, InstanceId: "i-0aaa", AutoScalingGroupName: "web"}
+	classic := snsNotification(SNS_EV_Terminate, "i-0aaa", "web")
+	var classicMessage SNS_Notification
+	json.Unmarshal([]byte(classic), &classicMessage)
+
+	eventBridgeId := "12345678-1234-1234-1234-123456789012"
+
+	tests := []struct {
+		name       string
+		body       string
+		source     string
+		via        []string
+		messageIds []string // innermost id wins
+	}{
+		{"ASG notification via SNS", classic, EventSourceASG, []string{EventViaSNS}, []string{"sns-i-0aaa"}},
+		{"EventBridge via SNS", snsEnvelope(eventBridgeTerminate), EventSourceEventBridge, []string{EventViaSNS}, []string{eventBridgeId}},
+		{"EventBridge via API destination", eventBridgeTerminate, EventSourceEventBridge, []string{EventViaHTTP}, []string{eventBridgeId}},
+		{"EventBridge via SQS", sqsBatch(eventBridgeTerminate), EventSourceEventBridge, []string{EventViaSQS}, []string{eventBridgeId}},
+		{"ASG notification via SNS and SQS", sqsBatch(classic, classicMessage.Message), EventSourceASG,
+			[]string{EventViaSNS, EventViaSQS}, []string{"sns-i-0aaa", "1"}},
+	}
+	for _, test := range tests {
+		events, err := decodeEvents([]byte(test.body))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(events) != len(test.via) {
+			t.Errorf("%s: got %d events, want %d", test.name, len(events), len(test.via))
+			continue
+		}
+		for i, event := range events {
+			want := terminate
+			want.Source, want.Via, want.MessageId = test.source, test.via[i], test.messageIds[i]
+			if event != want {
+				t.Errorf("%s:\n got %+v\nwant %+v", test.name, event, want)
+			}
+		}
+	}
+}
+
+func TestDecodeEventsErrors(t *testing.T) {
+	for name, body := range map[string]string{
+		"no json":          `<xml/>`,
+		"unknown format":   `{"foo":"bar"}`,
+		"unknown SNS type": `{"Type":"UnsubscribeConfirmation"}`,
+		"SNS message":      snsEnvelope("not json"),
+	} {
+		if events, err := decodeEvents([]byte(body)); err == nil || events != nil {
+			t.Errorf("%s: expected error and no events, got %+v, %v", name, events, err)
+		}
+	}
+
+	// a broken message does not hide the others of an SQS batch
+	events, err := decodeEvents([]byte(sqsBatch("not json", eventBridgeTerminate)))
+	if err == nil || len(events) != 1 || events[0].InstanceId != "i-0aaa" {
+		t.Errorf("SQS batch: got %+v, %v", events, err)
+	}
+}
+
+func TestUndecodableMessageRejected(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+
+	// SNS retries deliveries not answered with 2xx
+	for _, body := range []string{snsEnvelope("not json"), snsEnvelope(`{"foo":"bar"}`)} {
+		if recorder := postSNS(body); recorder.Code != 400 {
+			t.Errorf("got status %d, want 400", recorder.Code)
+		}
+	}
+	if status := statusSnapshot(); status.Notifications != 0 || status.Errors != 2 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Error("host deleted")
+	}
+}
+
+func TestEventBridgeTerminateDeletesHost(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+
+	postSNS(eventBridgeTerminate)
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Error("host not deleted")
+	}
+	if statusSnapshot().Notifications != 1 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test doubles for end-to-end tests: an in-memory Zabbix JSON-RPC API, an
+// AutoScaling DescribeAutoScalingGroups/DescribeAutoScalingInstances endpoint
+// and SNS notification helpers.
+
+const (
+	fakeZabbixUser     = "Admin"
+	fakeZabbixPassword = "zabbix"
+)
+
+// fakeZabbix implements apiinfo.version, user.login/logout, host.get/create/update/massupdate/delete,
+// usermacro.create/update and maintenance.create.
+type fakeZabbix struct {
+	*httptest.Server
+	mutex       sync.Mutex
+	hosts       map[string]ZabbixHost // hostid -> host
+	nextHostId  int
+	sessions    map[string]bool
+	calls       []string       // methods called, in order
+	httpErrors  map[string]int // method -> number of HTTP 502 answers still to give
+	lostAnswers map[string]int // method -> number of calls to apply, but answer with HTTP 504
+	failHostIds map[string]bool
+	maintenance map[string]JSONRPC_MaintenanceParams // maintenanceid -> params
+	created     []map[string]interface{}             // host.create params, in order
+	details     map[string]*fakeHostDetails          // hostid -> tags, macros and inventory
+	version     string                               // returned by apiinfo.version
+}
+
+// fakeHostDetails are returned by host.get if selected; new hosts get the same defaults.
+type fakeHostDetails struct {
+	tags          []JSONRPC_HostTag
+	macros        []JSONRPC_HostMacro
+	inventory     map[string]string
+	inventoryMode string
+}
+
+// fakeAutoScaling answers DescribeAutoScalingGroups and DescribeAutoScalingInstances from groups,
+// and EC2 DescribeInstances from instances.
+type fakeAutoScaling struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	groups    map[string][]AWS_AutoScalingInstance // ASG name -> instances
+	instances map[string]AWS_EC2Instance           // InstanceId -> EC2 metadata
+	errorCode string                               // if set, answer with this AWS error
+}
+
+func newFakeZabbix(t *testing.T) *fakeZabbix {
+	fake := &fakeZabbix{hosts: map[string]ZabbixHost{}, nextHostId: 10001, sessions: map[string]bool{},
+		httpErrors: map[string]int{}, lostAnswers: map[string]int{}, failHostIds: map[string]bool{},
+		maintenance: map[string]JSONRPC_MaintenanceParams{}, details: map[string]*fakeHostDetails{},
+		version: "4.2.0"}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (fake *fakeZabbix) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+		Auth   string          `json:"auth"`
+		Id     int64           `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.calls = append(fake.calls, request.Method)
+	if fake.httpErrors[request.Method] > 0 {
+		fake.httpErrors[request.Method]--
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	result, zabbixError := fake.call(request.Method, request.Params, request.Auth)
+	if fake.lostAnswers[request.Method] > 0 {
+		fake.lostAnswers[request.Method]--
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	response := map[string]interface{}{"jsonrpc": JSONRPC_DefaultVersion, "id": request.Id}
+	if zabbixError != nil {
+		response["error"] = zabbixError
+	} else {
+		response["result"] = result
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (fake *fakeZabbix) call(method string, params json.RawMessage, auth string) (interface{}, *JSONRPC_Error) {
+	// caller holds mutex
+	if method == JSONRPC_Method_APIVersion {
+		if auth != "" {
+			return nil, &JSONRPC_Error{Code: -32602, Message: "Invalid params.", Data: "The \"apiinfo.version\" method must be called without the \"auth\" parameter."}
+		}
+		return fake.version, nil
+	}
+	if method == JSONRPC_Method_UserLogin {
+		var login JSONRPC_Auth
+		json.Unmarshal(params, &login)
+		if login.User != fakeZabbixUser || login.Password != fakeZabbixPassword {
+			return nil, &JSONRPC_Error{Code: -32602, Message: "Invalid params.", Data: "Login name or password is incorrect."}
+		}
+		session := fmt.Sprintf("session-%d", len(fake.calls))
+		fake.sessions[session] = true
+		return session, nil
+	}
+	if !fake.sessions[auth] {
+		return nil, &JSONRPC_Error{Code: -32602, Message: "Invalid params.", Data: "Session terminated, re-login, please."}
+	}
+	switch method {
+	case JSONRPC_Method_UserLogout:
+		delete(fake.sessions, auth)
+		return true, nil
+	case JSONRPC_Method_GetHost:
+		var filter struct {
+			HostIds          []string `json:"hostids"`
+			SelectInterfaces string   `json:"selectInterfaces"`
+			SelectTags       string   `json:"selectTags"`
+		}
+		json.Unmarshal(params, &filter)
+		hosts := []map[string]interface{}{}
+		for _, host := range fake.hosts {
+			if len(filter.HostIds) > 0 && !contains(filter.HostIds, host.HostId) {
+				continue
+			}
+			definition := map[string]interface{}{"hostid": host.HostId, "host": host.Host, "status": host.Status}
+			if filter.SelectInterfaces != "" {
+				// the same for all hosts
+				definition["interfaces"] = []interface{}{map[string]interface{}{"interfaceid": "1", "hostid": host.HostId,
+					"type": "1", "main": "1", "useip": "1", "ip": "10.0.0.1", "dns": "", "port": "10050", "available": "1"}}
+				definition["groups"] = []interface{}{map[string]interface{}{"groupid": "2", "name": "Linux servers"}}
+				definition["parentTemplates"] = []interface{}{map[string]interface{}{"templateid": "10001", "host": "Template OS Linux"}}
+			}
+			if details := fake.details[host.HostId]; filter.SelectTags != "" && details != nil {
+				definition["tags"] = details.tags
+				definition["macros"] = details.macros
+				definition["inventory_mode"] = details.inventoryMode
+				if details.inventoryMode == JSONRPC_InventoryDisabled {
+					definition["inventory"] = []interface{}{}
+				} else {
+					inventory := map[string]string{"hostid": host.HostId}
+					for field, value := range details.inventory {
+						inventory[field] = value
+					}
+					definition["inventory"] = inventory
+				}
+			}
+			hosts = append(hosts, definition)
+		}
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i]["hostid"].(string) < hosts[j]["hostid"].(string) })
+		return hosts, nil
+	case JSONRPC_Method_CreateHost:
+		var host map[string]interface{}
+		json.Unmarshal(params, &host)
+		name, _ := host["host"].(string)
+		for _, existing := range fake.hosts {
+			if existing.Host == name {
+				return nil, &JSONRPC_Error{Code: -32602, Message: "Invalid params.", Data: "Host with the same name \"" + name + "\" already exists."}
+			}
+		}
+		fake.created = append(fake.created, host)
+		return JSONRPC_HostIdsResult{HostIds: []string{fake.createHost(name)}}, nil
+	case JSONRPC_Method_UpdateHost:
+		var update struct {
+			HostId        string            `json:"hostid"`
+			Status        *int              `json:"status"`
+			Tags          []JSONRPC_HostTag `json:"tags"`
+			Inventory     map[string]string `json:"inventory"`
+			InventoryMode *int              `json:"inventory_mode"`
+		}
+		json.Unmarshal(params, &update)
+		if err := fake.checkHostIds([]string{update.HostId}); err != nil {
+			return nil, err
+		}
+		if update.Status != nil {
+			fake.setStatus([]string{update.HostId}, *update.Status)
+		}
+		details := fake.details[update.HostId]
+		if update.InventoryMode != nil {
+			details.inventoryMode = strconv.Itoa(*update.InventoryMode)
+		}
+		if update.Inventory != nil && details.inventoryMode == JSONRPC_InventoryDisabled {
+			return nil, &JSONRPC_Error{Code: -32602, Message: "Invalid params.", Data: "Cannot set inventory fields for disabled inventory."}
+		}
+		if update.Tags != nil {
+			details.tags = update.Tags
+		}
+		for field, value := range update.Inventory {
+			details.inventory[field] = value
+		}
+		return JSONRPC_HostIdsResult{HostIds: []string{update.HostId}}, nil
+	case JSONRPC_Method_CreateMacro:
+		var macro JSONRPC_HostMacro
+		json.Unmarshal(params, &macro)
+		if err := fake.checkHostIds([]string{macro.HostId}); err != nil {
+			return nil, err
+		}
+		macro.HostMacroId = strconv.Itoa(len(fake.calls))
+		fake.details[macro.HostId].macros = append(fake.details[macro.HostId].macros, macro)
+		return map[string][]string{"hostmacroids": {macro.HostMacroId}}, nil
+	case JSONRPC_Method_UpdateMacro:
+		var macro JSONRPC_HostMacro
+		json.Unmarshal(params, &macro)
+		for _, details := range fake.details {
+			for i := range details.macros {
+				if details.macros[i].HostMacroId == macro.HostMacroId {
+					details.macros[i].Value = macro.Value
+					return map[string][]string{"hostmacroids": {macro.HostMacroId}}, nil
+				}
+			}
+		}
+		return nil, &JSONRPC_Error{Code: -32500, Message: "Application error.",
+			Data: "No permissions to referred object or it does not exist!"}
+	case JSONRPC_Method_MassUpdateHost:
+		var update JSONRPC_MassUpdateParams
+		json.Unmarshal(params, &update)
+		var hostIds []string
+		for _, host := range update.Hosts {
+			hostIds = append(hostIds, host.HostId)
+		}
+		return fake.setStatus(hostIds, update.Status)
+	case JSONRPC_Method_DeleteHost:
+		var hostIds []string
+		json.Unmarshal(params, &hostIds)
+		if err := fake.checkHostIds(hostIds); err != nil {
+			return nil, err
+		}
+		for _, hostId := range hostIds {
+			delete(fake.hosts, hostId)
+		}
+		return JSONRPC_HostIdsResult{HostIds: hostIds}, nil
+	case JSONRPC_Method_CreateMaint:
+		var maintenance JSONRPC_MaintenanceParams
+		json.Unmarshal(params, &maintenance)
+		if err := fake.checkHostIds(maintenance.HostIds); err != nil {
+			return nil, err
+		}
+		maintenanceId := strconv.Itoa(len(fake.maintenance) + 1)
+		fake.maintenance[maintenanceId] = maintenance
+		return JSONRPC_MaintenanceIdsResult{MaintenanceIds: []string{maintenanceId}}, nil
+	}
+	return nil, &JSONRPC_Error{Code: -32601, Message: "Method not found.", Data: "Incorrect method \"" + method + "\"."}
+}
+
+func (fake *fakeZabbix) checkHostIds(hostIds []string) *JSONRPC_Error {
+	// Like Zabbix, a request fails as a whole if any host is missing (or set up to fail).
+	for _, hostId := range hostIds {
+		if _, ok := fake.hosts[hostId]; !ok || fake.failHostIds[hostId] {
+			return &JSONRPC_Error{Code: -32500, Message: "Application error.",
+				Data: "No permissions to referred object or it does not exist!"}
+		}
+	}
+	return nil
+}
+
+func (fake *fakeZabbix) setStatus(hostIds []string, status int) (interface{}, *JSONRPC_Error) {
+	if err := fake.checkHostIds(hostIds); err != nil {
+		return nil, err
+	}
+	for _, hostId := range hostIds {
+		host := fake.hosts[hostId]
+		host.Status = strconv.Itoa(status)
+		fake.hosts[hostId] = host
+	}
+	return JSONRPC_HostIdsResult{HostIds: hostIds}, nil
+}
+
+func (fake *fakeZabbix) createHost(name string) string {
+	// caller holds mutex
+	hostId := strconv.Itoa(fake.nextHostId)
+	fake.nextHostId++
+	fake.hosts[hostId] = ZabbixHost{HostId: hostId, Host: name, Status: strconv.Itoa(JSONRPC_StatusEnableHost)}
+	fake.details[hostId] = &fakeHostDetails{tags: []JSONRPC_HostTag{{Tag: "env", Value: "prod"}},
+		macros:    []JSONRPC_HostMacro{{HostMacroId: "7" + hostId, HostId: hostId, Macro: "{$ROLE}", Value: "web"}},
+		inventory: map[string]string{"os": "Linux", "serialno_a": ""}, inventoryMode: "0"}
+	return hostId
+}
+
+func (fake *fakeZabbix) addHosts(names ...string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for _, name := range names {
+		fake.createHost(name)
+	}
+}
+
+func (fake *fakeZabbix) host(name string) (ZabbixHost, bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for _, host := range fake.hosts {
+		if host.Host == name {
+			return host, true
+		}
+	}
+	return ZabbixHost{}, false
+}
+
+func (fake *fakeZabbix) detailsOf(name string) fakeHostDetails {
+	// a copy, safe to inspect while the fake serves requests
+	host, _ := fake.host(name)
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	details := *fake.details[host.HostId]
+	details.tags = append([]JSONRPC_HostTag{}, details.tags...)
+	details.macros = append([]JSONRPC_HostMacro{}, details.macros...)
+	details.inventory = map[string]string{}
+	for field, value := range fake.details[host.HostId].inventory {
+		details.inventory[field] = value
+	}
+	return details
+}
+
+func (fake *fakeZabbix) failHost(name string) {
+	host, _ := fake.host(name)
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.failHostIds[host.HostId] = true
+}
+
+func (fake *fakeZabbix) failHTTP(method string, times int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.httpErrors[method] = times
+}
+
+func (fake *fakeZabbix) loseAnswers(method string, times int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.lostAnswers[method] = times
+}
+
+func (fake *fakeZabbix) expireSessions() {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.sessions = map[string]bool{}
+}
+
+func (fake *fakeZabbix) maintenanceOf(hostId string) []JSONRPC_MaintenanceParams {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	var result []JSONRPC_MaintenanceParams
+	for _, maintenance := range fake.maintenance {
+		if contains(maintenance.HostIds, hostId) {
+			result = append(result, maintenance)
+		}
+	}
+	return result
+}
+
+func (fake *fakeZabbix) countCalls(method string) int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	count := 0
+	for _, call := range fake.calls {
+		if call == method {
+			count++
+		}
+	}
+	return count
+}
+
+func newFakeAutoScaling(t *testing.T) *fakeAutoScaling {
+	fake := &fakeAutoScaling{groups: map[string][]AWS_AutoScalingInstance{}, instances: map[string]AWS_EC2Instance{}}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (fake *fakeAutoScaling) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	action := r.URL.Query().Get("Action")
+	if action == "DescribeInstances" && strings.HasPrefix(r.Header.Get("Authorization"), SigV4_Algorithm) {
+		fake.describeEC2Instances(w, r)
+		return
+	}
+	if (action != "DescribeAutoScalingGroups" && action != "DescribeAutoScalingInstances") || !strings.HasPrefix(r.Header.Get("Authorization"), SigV4_Algorithm) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"Error":{"Code":"InvalidAction","Message":"unsigned or unknown request"}}`)
+		return
+	}
+	if fake.errorCode != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"Error":{"Code":"%s","Message":"fake error"}}`, fake.errorCode)
+		return
+	}
+	if action == "DescribeAutoScalingInstances" {
+		fake.describeInstances(w, r)
+		return
+	}
+	var result AWS_DescribeAutoScalingGroupsResponse
+	groups := &result.DescribeAutoScalingGroupsResponse.DescribeAutoScalingGroupsResult.AutoScalingGroups
+	*groups = []AWS_AutoScalingGroup{}
+	for i := 1; r.URL.Query().Get(fmt.Sprintf("AutoScalingGroupNames.member.%d", i)) != ""; i++ {
+		name := r.URL.Query().Get(fmt.Sprintf("AutoScalingGroupNames.member.%d", i))
+		if instances, ok := fake.groups[name]; ok {
+			*groups = append(*groups, AWS_AutoScalingGroup{AutoScalingGroupName: name, Instances: instances})
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (fake *fakeAutoScaling) describeInstances(w http.ResponseWriter, r *http.Request) {
+	// caller holds mutex
+	var result AWS_DescribeAutoScalingInstancesResponse
+	instances := &result.DescribeAutoScalingInstancesResponse.DescribeAutoScalingInstancesResult.AutoScalingInstances
+	*instances = []AWS_AutoScalingInstanceDetail{}
+	for i := 1; r.URL.Query().Get(fmt.Sprintf("InstanceIds.member.%d", i)) != ""; i++ {
+		instanceId := r.URL.Query().Get(fmt.Sprintf("InstanceIds.member.%d", i))
+		for name, members := range fake.groups {
+			for _, instance := range members {
+				if instance.InstanceId == instanceId {
+					*instances = append(*instances, AWS_AutoScalingInstanceDetail{InstanceId: instanceId,
+						AutoScalingGroupName: name, LifecycleState: instance.LifecycleState})
+				}
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (fake *fakeAutoScaling) describeEC2Instances(w http.ResponseWriter, r *http.Request) {
+	// caller holds mutex; answers in XML, like EC2 does
+	if fake.errorCode != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<Response><Errors><Error><Code>%s</Code><Message>fake error</Message></Error></Errors></Response>`, fake.errorCode)
+		return
+	}
+	var reservation AWS_EC2Reservation
+	for i := 1; r.URL.Query().Get(fmt.Sprintf("Filter.1.Value.%d", i)) != ""; i++ {
+		if instance, ok := fake.instances[r.URL.Query().Get(fmt.Sprintf("Filter.1.Value.%d", i))]; ok {
+			reservation.Instances = append(reservation.Instances, instance)
+		}
+	}
+	response := struct {
+		XMLName      xml.Name             `xml:"DescribeInstancesResponse"`
+		Reservations []AWS_EC2Reservation `xml:"reservationSet>item"`
+	}{Reservations: []AWS_EC2Reservation{reservation}}
+	xml.NewEncoder(w).Encode(response)
+}
+
+func (fake *fakeAutoScaling) setEC2Instance(instance AWS_EC2Instance) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.instances[instance.InstanceId] = instance
+}
+
+func (fake *fakeAutoScaling) setGroup(name string, instanceIds ...string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.groups[name] = []AWS_AutoScalingInstance{}
+	for _, instanceId := range instanceIds {
+		fake.groups[name] = append(fake.groups[name], AWS_AutoScalingInstance{InstanceId: instanceId, LifecycleState: "InService"})
+	}
+}
+
+func (fake *fakeAutoScaling) setLifecycleState(instanceId string, state string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for name, instances := range fake.groups {
+		for i := range instances {
+			if instances[i].InstanceId == instanceId {
+				fake.groups[name][i].LifecycleState = state
+			}
+		}
+	}
+}
+
+func setupFakes(t *testing.T, scaleDownAction string) (*fakeZabbix, *fakeAutoScaling) {
+	// Starts fakes and activates a configuration using them; resets global state.
+	zabbix := newFakeZabbix(t)
+	autoScaling := newFakeAutoScaling(t)
+	config := AAZConfig{
+		AutoScale: AutoScale{GroupName: "web", Region: "eu-west-1", AccessKey: "AKIDEXAMPLE", SecretKey: "secret",
+			Endpoint: autoScaling.URL, EC2Endpoint: autoScaling.URL},
+		ZabbixConfig: ZabbixConfig{URL: zabbix.URL, User: fakeZabbixUser, Password: fakeZabbixPassword,
+			ScaleDownAction: scaleDownAction, RestrictToGroupId: 2},
+		RetryConfig: RetryConfig{MaxAttempts: 2},
+	}
+	acl, _ := buildACL(config.ListenerConfig)
+	setConfig(config, acl)
+	zabbixSession = ""
+	zabbixInventory = newHostInventory()
+	updateStatus(func(status *AAZStatus) { *status = AAZStatus{} })
+	failedActions = pendingActionSet{actions: map[string]time.Time{}}
+	unmonitoredInstances = pendingActionSet{actions: map[string]time.Time{}}
+	asgMembers.groups = map[string]string{}
+	queue := startEventQueue(config.DaemonConfig)
+	t.Cleanup(func() { queue.drain(time.Second) })
+	t.Cleanup(zabbixLogout)
+	return zabbix, autoScaling
+}
+
+func writeConfigFile(t *testing.T, zabbix *fakeZabbix, autoScaling *fakeAutoScaling, scaleDownAction string) string {
+	// Writes the configuration setupFakes() activates as HCL file, for subcommands' -config.
+	configFile := filepath.Join(t.TempDir(), "aaz.hcl")
+	hcl := fmt.Sprintf(`ListenerConfig {
+  Address = ":0"
+}
+AutoScale {
+  GroupName = "web"
+  Region = "eu-west-1"
+  AccessKey = "AKIDEXAMPLE"
+  SecretKey = "secret"
+  Endpoint = "%s"
+  EC2Endpoint = "%s"
+}
+ZabbixConfig {
+  URL = "%s"
+  User = "%s"
+  Password = "%s"
+  ScaleDownAction = "%s"
+  RestrictToGroupId = 2
+}
+RetryConfig {
+  MaxAttempts = 2
+}
+`, autoScaling.URL, autoScaling.URL, zabbix.URL, fakeZabbixUser, fakeZabbixPassword, scaleDownAction)
+	if err := os.WriteFile(configFile, []byte(hcl), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ConfigFile = DefaultConfigFile })
+	return configFile
+}
+
+func snsNotification(event string, instanceId string, group string) string {
+	message, _ := json.Marshal(SNS_Message{Event: event, EC2InstanceId: instanceId, AutoScalingGroupName: group})
+	notification, _ := json.Marshal(SNS_Notification{Type: SNS_Type_Notification, MessageId: "sns-" + instanceId, Message: string(message)})
+	return string(notification)
+}
+
+func postSNS(body string) *httptest.ResponseRecorder {
+	// Delivers body like deliverSNS, then waits for the queued events to be handled.
+	recorder := deliverSNS(body)
+	workQueue.wait()
+	return recorder
+}
+
+func deliverSNS(body string) *httptest.ResponseRecorder {
+	// Delivers body to snsHandler like SNS would.
+	request := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	request.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	recorder := httptest.NewRecorder()
+	snsHandler(recorder, request)
+	return recorder
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// hookEvent is passed to hooks as JSON on stdin, and as AAZ_* environment variables.
+type hookEvent struct {
+	Hook                 string `json:"hook"`   // HookPre or HookPost
+	Action               string `json:"action"` // ScaleDownAction
+	InstanceId           string `json:"instanceId"`
+	AutoScalingGroupName string `json:"autoScalingGroupName,omitempty"` // if known
+	Host                 string `json:"host"`
+	HostId               string `json:"hostId"`
+	Result               string `json:"result,omitempty"` // post hooks only: HookResultSuccess or HookResultFailed
+	Error                string `json:"error,omitempty"`  // post hooks only
+}
+
+const (
+	HookPre           = "pre"
+	HookPost          = "post"
+	HookResultSuccess = "success"
+	HookResultFailed  = "failed"
+
+	DefaultHookTimeout = 30 // seconds
+)
+
+func runPreHooks(host ZabbixHost, action string) error {
+	// Runs Hooks.PreAction in order; the first one failing vetoes action on host.
+	event := newHookEvent(HookPre, host, action)
+	for _, command := range currentConfig().Hooks.PreAction {
+		if err := runHook(command, event); err != nil {
+			return fmt.Errorf("pre hook %s failed: %s", command, err)
+		}
+	}
+	return nil
+}
+
+func runPostHooks(host ZabbixHost, action string, actionErr error) {
+	// Runs Hooks.PostAction in order, whatever the outcome of action; failures are logged only.
+	event := newHookEvent(HookPost, host, action)
+	event.Result = HookResultSuccess
+	if actionErr != nil {
+		event.Result = HookResultFailed
+		event.Error = actionErr.Error()
+	}
+	for _, command := range currentConfig().Hooks.PostAction {
+		if err := runHook(command, event); err != nil {
+			log.Printf("ERROR: Post hook %s failed for host '%s': %s", command, host.Host, err)
+			countError()
+		}
+	}
+}
+
+func newHookEvent(hook string, host ZabbixHost, action string) hookEvent {
+	asgMembers.Lock()
+	group := asgMembers.groups[host.InstanceId]
+	asgMembers.Unlock()
+	return hookEvent{Hook: hook, Action: action, InstanceId: host.InstanceId, AutoScalingGroupName: group,
+		Host: host.Host, HostId: host.HostId}
+}
+
+func (e hookEvent) environment() []string {
+	return append(os.Environ(),
+		"AAZ_HOOK="+e.Hook,
+		"AAZ_ACTION="+e.Action,
+		"AAZ_INSTANCE_ID="+e.InstanceId,
+		"AAZ_ASG="+e.AutoScalingGroupName,
+		"AAZ_ZABBIX_HOST="+e.Host,
+		"AAZ_ZABBIX_HOSTID="+e.HostId,
+		"AAZ_RESULT="+e.Result,
+	)
+}
+
+func runHook(command string, event hookEvent) error {
+	// Runs command (an executable, no shell) with event on stdin; output is logged.
+	timeout := time.Duration(currentConfig().Hooks.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	input, _ := json.Marshal(event)
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = event.environment()
+	cmd.WaitDelay = time.Second // in case the hook leaves children holding its output open
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			log.Printf("Hook %s (%s, host '%s'): %s", command, event.Hook, event.Host, line)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
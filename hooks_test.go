@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeHook(t *testing.T, name string, script string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func setHooks(hooks Hooks) {
+	config := currentConfig()
+	config.Hooks = hooks
+	setConfig(config, currentACL())
+}
+
+func TestPreHookVetoesAction(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa", "i-0bbb")
+	refreshZabbixInventory()
+	veto := writeHook(t, "veto", `test "$AAZ_INSTANCE_ID" != i-0aaa || { echo "still registered in CMDB"; exit 1; }`)
+	setHooks(Hooks{PreAction: []string{veto}})
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0bbb", "web"))
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Error("vetoed host deleted")
+	}
+	if _, ok := zabbix.host("i-0bbb"); ok {
+		t.Error("host not deleted")
+	}
+	if statusSnapshot().Warnings != 1 || statusSnapshot().Errors != 0 || len(failedActions.instanceIds()) != 0 {
+		t.Errorf("unexpected status %+v, failed actions %v", statusSnapshot(), failedActions.instanceIds())
+	}
+}
+
+func TestPostHookGetsEventAndResult(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDISABLE)
+	zabbix.addHosts("i-0aaa")
+	output := filepath.Join(t.TempDir(), "output")
+	post := writeHook(t, "post", `cat > `+output+`; echo >> `+output+`; echo "$AAZ_HOOK $AAZ_ACTION $AAZ_ASG $AAZ_ZABBIX_HOSTID $AAZ_RESULT" >> `+output)
+	setHooks(Hooks{PostAction: []string{post}})
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	contents, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(contents), "\n", 2)
+	var event hookEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("decoding hook stdin failed: %s", err)
+	}
+	host, _ := zabbix.host("i-0aaa")
+	want := hookEvent{Hook: HookPost, Action: ScaleDownActionDISABLE, InstanceId: "i-0aaa", AutoScalingGroupName: "web",
+		Host: "i-0aaa", HostId: host.HostId, Result: HookResultSuccess}
+	if event != want {
+		t.Errorf("got event %+v, want %+v", event, want)
+	}
+	if env := strings.TrimSpace(lines[1]); env != "post DISABLE web "+host.HostId+" success" {
+		t.Errorf("got environment '%s'", env)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	slow := writeHook(t, "slow", "sleep 10\n")
+	setHooks(Hooks{PreAction: []string{slow}, Timeout: 1})
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Error("host deleted although pre hook timed out")
+	}
+}
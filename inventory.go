@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// hostInventory holds the Zabbix hosts managed by AAZ. Hosts are looked up
+// explicitly by EC2 InstanceId (SNS notifications, ASG members), by Zabbix
+// host name or by Zabbix hostid (API calls, sync plans).
+type hostInventory struct {
+	mutex        sync.RWMutex
+	hosts        map[string]ZabbixHost // hostid -> host
+	byName       map[string]string     // host name -> hostid
+	byInstanceId map[string]string     // EC2 InstanceId -> hostid
+}
+
+var zabbixInventory = newHostInventory()
+
+func newHostInventory() *hostInventory {
+	return &hostInventory{hosts: map[string]ZabbixHost{}, byName: map[string]string{}, byInstanceId: map[string]string{}}
+}
+
+func instanceIdForHost(host ZabbixHost) string {
+	// AAZ expects Zabbix hosts to be named after the EC2 InstanceId of the host.
+	return host.Host
+}
+
+func (inv *hostInventory) replace(hosts []ZabbixHost) {
+	// Replaces the inventory contents, e.g. after fetching all hosts from Zabbix.
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	inv.hosts = map[string]ZabbixHost{}
+	inv.byName = map[string]string{}
+	inv.byInstanceId = map[string]string{}
+	for _, host := range hosts {
+		inv.add(host)
+	}
+}
+
+func (inv *hostInventory) add(host ZabbixHost) {
+	// caller must hold mutex
+	host.InstanceId = instanceIdForHost(host)
+	inv.hosts[host.HostId] = host
+	inv.byName[host.Host] = host.HostId
+	if host.InstanceId != "" {
+		inv.byInstanceId[host.InstanceId] = host.HostId
+	}
+}
+
+func (inv *hostInventory) set(host ZabbixHost) {
+	// Adds or updates host (by hostid).
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	if old, ok := inv.hosts[host.HostId]; ok {
+		delete(inv.byName, old.Host)
+		delete(inv.byInstanceId, old.InstanceId)
+	}
+	inv.add(host)
+}
+
+func (inv *hostInventory) remove(hostId string) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	if host, ok := inv.hosts[hostId]; ok {
+		delete(inv.byName, host.Host)
+		delete(inv.byInstanceId, host.InstanceId)
+		delete(inv.hosts, hostId)
+	}
+}
+
+func (inv *hostInventory) byHostId(hostId string) (ZabbixHost, bool) {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+	host, ok := inv.hosts[hostId]
+	return host, ok
+}
+
+func (inv *hostInventory) byHostName(name string) (ZabbixHost, bool) {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+	host, ok := inv.hosts[inv.byName[name]]
+	return host, ok
+}
+
+func (inv *hostInventory) byInstance(instanceId string) (ZabbixHost, bool) {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+	host, ok := inv.hosts[inv.byInstanceId[instanceId]]
+	return host, ok
+}
+
+func (inv *hostInventory) all() []ZabbixHost {
+	// Returns all hosts, sorted by host name.
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+	hosts := []ZabbixHost{}
+	for _, host := range inv.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+func (inv *hostInventory) len() int {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+	return len(inv.hosts)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHostInventoryLookups(t *testing.T) {
+	inventory := newHostInventory()
+	inventory.replace([]ZabbixHost{{HostId: "10001", Host: "i-0aaa", Status: "0"}, {HostId: "10002", Host: "i-0bbb", Status: "0"}})
+
+	if host, ok := inventory.byInstance("i-0aaa"); !ok || host.HostId != "10001" {
+		t.Errorf("byInstance: got %+v, %v", host, ok)
+	}
+	if host, ok := inventory.byHostId("10002"); !ok || host.InstanceId != "i-0bbb" {
+		t.Errorf("byHostId: got %+v, %v", host, ok)
+	}
+	if _, ok := inventory.byHostName("10001"); ok {
+		t.Error("byHostName must not match hostids")
+	}
+	inventory.remove("10001")
+	if _, ok := inventory.byInstance("i-0aaa"); ok || inventory.len() != 1 {
+		t.Errorf("host not removed: %+v", inventory.all())
+	}
+}
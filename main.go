@@ -1,139 +1,409 @@
 package main
 
 import (
-	"flag"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sync"
 	"time"
 )
 
 type ZabbixHost struct {
-	HostId string `json:"hostid"`
-	Host   string `json:"host"`
-	Status string `json:"status"`
+	HostId     string            `json:"hostid"`
+	Host       string            `json:"host"`
+	Status     string            `json:"status"`
+	Tags       []JSONRPC_HostTag `json:"tags,omitempty"`
+	InstanceId string            `json:"-"` // see instanceIdForHost()
 }
 
 type AAZStatus struct {
-	Errors        int `json:"errors"`
-	Warnings      int `json:"warnings"`
-	Notifications int `json:"notifications"`
-	ZabbixHosts   int `json:"zabbixHosts"`
+	Errors        int            `json:"errors"`
+	Warnings      int            `json:"warnings"`
+	Notifications int            `json:"notifications"`
+	ZabbixHosts   int            `json:"zabbixHosts"`
+	LastSync      *AAZSyncStatus `json:"lastSync,omitempty"`
+	// per managed ASG, see updateGroupStatus()
+	AutoScalingGroups map[string]*AAZGroupStatus `json:"autoScalingGroups,omitempty"`
+	Queue             *AAZQueueStatus            `json:"queue,omitempty"`
+}
+
+// event queue, see eventQueue; OldestAge is how long the oldest queued event waits (seconds)
+type AAZQueueStatus struct {
+	Depth     int     `json:"depth"`
+	Capacity  int     `json:"capacity"`
+	Workers   int     `json:"workers"`
+	Busy      int     `json:"busy"`
+	OldestAge float64 `json:"oldestAge"`
+	Rejected  int     `json:"rejected"`
+}
+
+// outcome of last AWS<->Zabbix sync; a failed sync does not stop the SNS listener
+type AAZSyncStatus struct {
+	Time   time.Time `json:"time"`
+	Failed bool      `json:"failed"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// events received per ASG; LastTestNotification proves the SNS wiring works
+type AAZGroupStatus struct {
+	LastTestNotification *time.Time     `json:"lastTestNotification,omitempty"`
+	LaunchErrors         int            `json:"launchErrors"`
+	TerminateErrors      int            `json:"terminateErrors"`
+	LastErrorEvent       *AAZErrorEvent `json:"lastErrorEvent,omitempty"`
 }
 
 var aazVersion = "0.0.1"
-var Config AAZConfig
-var ConfigHasAWSKey = false
-var useTLS = false
 
-var ConfigFile = flag.String("config", "/etc/aws-autoscale-zabbix.hcl", "AAZ configuration file")
-var VersionQuery = flag.Bool("version", false, "get aws-autoscale-zabbix version")
-var SkipListener = flag.Bool("skip-listener", false, "one-shot -- do not listen for SNS notifications")
-var DryRun = flag.Bool("dry-run", false, "don't kiss, just talk -- only tell what would be changed")
+// settings shared by subcommands; see cli.go
+var ConfigFile = DefaultConfigFile
+var DryRun = false
 
-var zabbixHostMap = map[string]ZabbixHost{} // map host(name) -> host "details"
+// guarded by serverStatusMutex; use updateStatus() and statusSnapshot()
 var serverStatus AAZStatus
+var serverStatusMutex sync.Mutex
 
-func main() {
-	flag.Parse()
+func updateStatus(update func(status *AAZStatus)) {
+	serverStatusMutex.Lock()
+	defer serverStatusMutex.Unlock()
+	update(&serverStatus)
+}
 
-	if *VersionQuery {
-		fmt.Println(aazVersion)
-		return
+func countError() {
+	updateStatus(func(status *AAZStatus) { status.Errors++ })
+}
+
+func countWarning() {
+	updateStatus(func(status *AAZStatus) { status.Warnings++ })
+}
+
+func countNotification() {
+	updateStatus(func(status *AAZStatus) { status.Notifications++ })
+}
+
+func statusSnapshot() AAZStatus {
+	// Copy of serverStatus, safe to read (and marshal) while workers update it.
+	serverStatusMutex.Lock()
+	defer serverStatusMutex.Unlock()
+	snapshot := serverStatus
+	if serverStatus.LastSync != nil {
+		lastSync := *serverStatus.LastSync
+		snapshot.LastSync = &lastSync
+	}
+	if serverStatus.AutoScalingGroups != nil {
+		snapshot.AutoScalingGroups = map[string]*AAZGroupStatus{}
+		for group, status := range serverStatus.AutoScalingGroups {
+			groupStatus := *status
+			snapshot.AutoScalingGroups[group] = &groupStatus
+		}
 	}
+	return snapshot
+}
 
-	Config = readConfig(*ConfigFile)
+func main() {
+	log.SetOutput(&redactingWriter{out: os.Stderr})
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+func startup() (AAZConfig, error) {
+	// Common startup for serve and sync: fetches Zabbix hosts
+	// and completes actions interrupted by last shutdown.
+	// Returns the error of fetching Zabbix hosts; it is up to the caller whether that is fatal.
+	config := currentConfig()
 	log.Printf("AAZ version %s starting ...", aazVersion)
-	if *DryRun {
+	handleSignals()
+	if DryRun {
 		log.Print("Running in dry-run mode; will make NO MODIFICATIONS to Zabbix")
 	}
 
-	// initialize zabbixHostMap
+	// initialize zabbixInventory
 	log.Printf("Retrieving hosts from Zabbix (GroupId: %d / TemplateId: %d)...",
-		Config.ZabbixConfig.RestrictToGroupId, Config.ZabbixConfig.RestrictToTemplateId)
-	zabbixHostMap = zabbixGetHosts()
-	log.Printf("Found %d matching hosts in Zabbix", len(zabbixHostMap))
+		config.ZabbixConfig.RestrictToGroupId, config.ZabbixConfig.RestrictToTemplateId)
+	err := refreshZabbixInventory()
+	if err == nil {
+		log.Printf("Found %d matching hosts in Zabbix", zabbixInventory.len())
+	}
+
+	// complete actions interrupted by last shutdown
+	resumePendingActions()
+	return config, err
+}
+
+func runServe(skipListener bool) int {
+	// Syncs hosts, then listens for notifications. A failing sync is fatal only
+	// with skipListener (one-shot mode); otherwise it is reported in /status.
+	config, err := startup()
+	if err != nil && skipListener {
+		return ExitError
+	}
 
 	// get AWS group and compare with Zabbix DB
-	if ConfigHasAWSKey {
-		initalizeHosts()
+	if config.hasAWSKey() {
+		if err := initalizeHosts(); err != nil && skipListener {
+			gracefulShutdown(nil)
+			return ExitError
+		}
 	} else {
 		log.Print("NOTICE: Skipping host initialization as AutoScale group has no IAM user/key defined")
 	}
 
+	if skipListener || isShuttingDown() {
+		gracefulShutdown(nil)
+		return exitCodeFromStatus()
+	}
+
 	// enable heartbeat message logging
 	go heartBeat()
+	go retryFailedActions()
+
+	// now listen for SNS notifications until SIGTERM/SIGINT; workers act on them
+	startEventQueue(config.DaemonConfig)
+	server := startSNSListener()
+	sdNotify(SD_Ready)
+	go sdWatchdog()
+	<-shutdownRequested
+	gracefulShutdown(server)
+	return ExitOK
+}
 
-	// now listen for SNS notifications
-	if !*SkipListener {
-		startSNSListener()
+func runSync(planFile string, planFormat string) int {
+	// One-shot reconcile of ASG members and Zabbix hosts.
+	// In dry-run mode, the plan is printed (and saved to planFile) instead.
+	// Preconditions are checked before startup() logs in to Zabbix and resumes actions.
+	if !currentConfig().hasAWSKey() {
+		log.Print("ERROR: Cannot sync as AutoScale group has no IAM user/key defined")
+		return ExitUsage
+	}
+	_, err := startup()
+	if err != nil {
+		zabbixLogout()
+		return ExitError
+	}
+	if DryRun {
+		defer zabbixLogout()
+		plan, err := currentSyncPlan()
+		if err != nil {
+			log.Printf("ERROR: Cannot plan: %s", err)
+			return ExitError
+		}
+		auditSyncPlan(plan, cliTrigger(TriggerSync, plan.Created.Format(time.RFC3339Nano)))
+		return outputPlan(plan, planFile, planFormat)
 	}
+	if err := initalizeHosts(); err != nil {
+		gracefulShutdown(nil)
+		return ExitError
+	}
+	gracefulShutdown(nil)
+	return exitCodeFromStatus()
+}
+
+func exitCodeFromStatus() int {
+	if statusSnapshot().Errors > 0 {
+		return ExitError
+	}
+	return ExitOK
 }
 
-func initalizeHosts() {
+// reconcileMutex keeps syncs from acting on hosts concurrently with event handling and
+// retries: initalizeHosts() holds it exclusively, handleEvent() and others share it.
+var reconcileMutex sync.RWMutex
+
+func initalizeHosts() error {
 	// Compares AWS AutoScalingGroup EC2 instances against Zabbix hosts.
 	// Hosts not found in ASG will be "unMonitored" in Zabbix.
+	// The outcome is recorded in serverStatus.LastSync.
+	reconcileMutex.Lock()
+	defer reconcileMutex.Unlock()
 	log.Print("Initial sync AWS<->Zabbix: starting")
-	log.Printf("Retrieving ASG '%s' members ...", Config.AutoScale.GroupName)
-	awsGroupMembers := getAutoScalingGroupMembers(Config.AutoScale.GroupName,
-		Config.AutoScale.Region, Config.AutoScale.AccessKey, Config.AutoScale.SecretKey)
-	log.Printf("Current ASG members: %s", awsGroupMembers)
-	for hostname, host := range zabbixHostMap {
-		//log.Printf("%s -> %s\n", hostname, host)
-		if contains(awsGroupMembers, hostname) {
-			log.Printf("Zabbix host '%s' exists in ASG, too -- KEEPING", hostname)
-		} else {
-			log.Printf("Zabbix host '%s' does NOT exist in ASG -- REMOVING!", hostname)
-			unMonitorHost(host.HostId)
+	plan, err := currentSyncPlan()
+	lastSync := AAZSyncStatus{Time: time.Now().UTC(), Failed: err != nil}
+	trigger := auditTrigger{Source: TriggerSync, RunId: lastSync.Time.Format(time.RFC3339Nano)}
+	if err != nil {
+		lastSync.Error = err.Error()
+	}
+	updateStatus(func(status *AAZStatus) { status.LastSync = &lastSync })
+	if err != nil {
+		log.Printf("ERROR: Initial sync AWS<->Zabbix failed, no hosts changed: %s", err)
+		countError()
+		event := NotifySync
+		if errors.Is(err, ErrASGMissing) || errors.Is(err, ErrASGEmpty) {
+			event = NotifySafetyLimit
 		}
+		notify(aazNotification{Event: event, Error: err.Error(), Message: "AAZ sync failed, no hosts changed: " + err.Error()})
+		return err
 	}
+	log.Printf("Sync plan: %d of %d host(s) to change", plan.changes(), len(plan.Steps))
+	changed, failed := applySyncPlan(plan, trigger)
+	enrichPlannedHosts(plan, trigger)
 	log.Print("Initial sync AWS<->Zabbix: completed")
-	// todo: other way round: INFORM about hosts missing on Zabbix side
+	notifySyncSummary(plan, changed, failed)
+	return nil
+}
+
+func refreshZabbixInventory() error {
+	// Re-reads zabbixInventory; on error, the current inventory is kept.
+	hosts, err := zabbixGetHosts()
+	if err != nil {
+		log.Printf("ERROR: Retrieving hosts from Zabbix failed: %s", err)
+		countError()
+		return err
+	}
+	zabbixInventory.replace(hosts)
+	return nil
+}
+
+func unMonitorInstance(instanceId string, trigger auditTrigger) {
+	unMonitorInstances([]string{instanceId}, trigger)
 }
 
-func unMonitorHost(hostname string) {
-	// Removes a host from Zabbix monitoring by DELETING or DISABLING (based on cfg).
-	// Respects DryRun bool. Also removes entry from zabbixHostMap.
+// instances whose hosts were removed from monitoring lately; a termination is notified twice
+// for ASG instances with EC2Events (ASG event and EC2 state change), the second is ignored
+var unmonitoredInstances = pendingActionSet{actions: map[string]time.Time{}}
 
-	// Start by refreshing zabbixHostMap if host not found in map; it may be a "new" auto-(up)scaled host
-	if _, ok := zabbixHostMap[hostname]; !ok {
-		log.Printf("UnMonitor request for host '%s' triggered Zabbix host map refresh", hostname)
-		zabbixHostMap = zabbixGetHosts()
+const UnmonitoredInstancesMemory = 15 * time.Minute
+
+func unMonitorInstances(instanceIds []string, trigger auditTrigger) {
+	// Removes the Zabbix hosts of EC2 instances from monitoring, see unMonitorHosts().
+	// Pending and failed actions are tracked by InstanceId.
+	var remaining []string
+	for _, instanceId := range instanceIds {
+		if unmonitoredInstances.since(instanceId, UnmonitoredInstancesMemory) {
+			log.Printf("Zabbix host of instance '%s' was removed from monitoring already (ignored)", instanceId)
+			continue
+		}
+		remaining = append(remaining, instanceId)
+	}
+	instanceIds = remaining
+	for _, instanceId := range instanceIds {
+		pendingActions.begin(instanceId)
+		defer pendingActions.done(instanceId)
 	}
 
-	// (Try to) look up host using map again
-	if hostMapEntry, ok := zabbixHostMap[hostname]; ok {
-		if *DryRun {
-			log.Printf("DRY-RUN: Would now %s Zabbix host '%s'", Config.ZabbixConfig.ScaleDownAction, hostname)
-			return
+	// Start by refreshing zabbixInventory if a host is not found; it may be a "new" auto-(up)scaled host
+	for _, instanceId := range instanceIds {
+		if _, ok := zabbixInventory.byInstance(instanceId); !ok {
+			log.Printf("UnMonitor request for instance '%s' triggered Zabbix host inventory refresh", instanceId)
+			if err := refreshZabbixInventory(); err != nil {
+				for _, failed := range instanceIds {
+					requeueFailedAction(failed, err)
+				}
+				return
+			}
+			break
 		}
-		log.Printf("Trying to %s Zabbix host '%s'", Config.ZabbixConfig.ScaleDownAction, hostname)
-		if Config.ZabbixConfig.ScaleDownAction == ScaleDownActionDELETE {
-			// drop host from zabbix and zabbixHostMap
-			zabbixDeleteHost(hostMapEntry.HostId)
-			delete(zabbixHostMap, hostname)
-		} else {
-			// disable host in zabbix. keep it in zabbixHostMap with new state.
-			// to-do: maybe improve hostmapEntry.status -- distinguish in status output
-			zabbixDisableHost(hostMapEntry.HostId)
-			hostMapEntry.Status = "DISABLED"
-			zabbixHostMap[hostname] = hostMapEntry
+	}
+
+	// (Try to) look up hosts again
+	var hosts []ZabbixHost
+	for _, instanceId := range instanceIds {
+		host, ok := zabbixInventory.byInstance(instanceId)
+		if !ok {
+			log.Printf("WARNING: Attempt to unMonitor instance '%s' not found in Zabbix", instanceId)
+			countWarning()
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	unMonitorHosts(hosts, trigger)
+}
+
+func unMonitorHosts(hosts []ZabbixHost, trigger auditTrigger) (changed int, failed int) {
+	// Removes hosts from Zabbix monitoring by DELETING or DISABLING (based on cfg),
+	// in batches of ZabbixConfig.BatchSize. Respects DryRun bool. Also updates zabbixInventory.
+	// Hooks run before and after, per host; a failing pre hook vetoes the action.
+	// Returns the number of hosts changed and failing to change (or vetoed); each is notified and audited.
+	scaleDownAction := currentConfig().ZabbixConfig.ScaleDownAction
+	var hostIds []string
+	var acting []ZabbixHost
+	for _, host := range hosts {
+		audit := auditEntry{Action: scaleDownAction, InstanceId: host.InstanceId, Before: &host, Trigger: trigger}
+		if DryRun {
+			log.Printf("DRY-RUN: Would now %s Zabbix host '%s' (hostid %s)", scaleDownAction, host.Host, host.HostId)
+			audit.Result = AuditDryRun
+			auditRecord(audit)
+			continue
+		}
+		if err := runPreHooks(host, scaleDownAction); err != nil {
+			log.Printf("WARNING: Not going to %s host '%s' (hostid %s), vetoed: %s", scaleDownAction, host.Host, host.HostId, err)
+			countWarning()
+			notify(aazNotification{Event: NotifyFailure, Action: scaleDownAction, Host: host.Host, HostId: host.HostId,
+				InstanceId: host.InstanceId, Error: err.Error(),
+				Message: fmt.Sprintf("AAZ did not %s Zabbix host '%s', vetoed: %s", scaleDownAction, host.Host, err)})
+			audit.Result, audit.Error = AuditVetoed, err.Error()
+			auditRecord(audit)
+			failed++
+			continue
+		}
+		log.Printf("Trying to %s Zabbix host '%s' (hostid %s)", scaleDownAction, host.Host, host.HostId)
+		hostIds = append(hostIds, host.HostId)
+		acting = append(acting, host)
+	}
+	if len(hostIds) == 0 {
+		return 0, failed
+	}
+
+	var results map[string]error
+	if scaleDownAction == ScaleDownActionDELETE {
+		// hosts failing to be saved are not deleted; DELETE cannot be undone otherwise
+		results = snapshotHosts(acting)
+		var snapshotted []string
+		for _, hostId := range hostIds {
+			if results[hostId] == nil {
+				snapshotted = append(snapshotted, hostId)
+			}
+		}
+		for hostId, err := range zabbixDeleteHosts(snapshotted) {
+			results[hostId] = err
 		}
 	} else {
-		log.Printf("WARNING: Attempt to unMonitor non-existent Zabbix host '%s'", hostname)
-		serverStatus.Warnings = serverStatus.Warnings + 1
+		results = zabbixDisableHosts(hostIds)
+	}
+	for _, host := range acting {
+		runPostHooks(host, scaleDownAction, results[host.HostId])
+		audit := auditEntry{Action: scaleDownAction, InstanceId: host.InstanceId, Before: &host, Trigger: trigger, Result: AuditSuccess}
+		if err := results[host.HostId]; err != nil {
+			log.Printf("ERROR: Failed to %s host '%s' (hostid %s): %s", scaleDownAction, host.Host, host.HostId, err)
+			countError()
+			requeueFailedAction(host.InstanceId, err)
+			notify(aazNotification{Event: NotifyFailure, Action: scaleDownAction, Host: host.Host, HostId: host.HostId,
+				InstanceId: host.InstanceId, Error: err.Error(),
+				Message: fmt.Sprintf("AAZ failed to %s Zabbix host '%s': %s", scaleDownAction, host.Host, err)})
+			audit.Result, audit.Error = AuditFailed, err.Error()
+			auditRecord(audit)
+			failed++
+			continue
+		}
+		log.Printf("SUCCESS: %s host '%s' (hostid %s)", scaleDownAction, host.Host, host.HostId)
+		notify(aazNotification{Event: NotifyAction, Action: scaleDownAction, Host: host.Host, HostId: host.HostId,
+			InstanceId: host.InstanceId, Message: fmt.Sprintf("AAZ did %s Zabbix host '%s'", scaleDownAction, host.Host)})
+		auditRecord(audit)
+		changed++
+		unmonitoredInstances.begin(host.InstanceId)
+		if scaleDownAction == ScaleDownActionDELETE {
+			zabbixInventory.remove(host.HostId)
+		} else {
+			// keep host in inventory with new state.
+			// to-do: maybe improve host status -- distinguish in status output
+			host.Status = "DISABLED"
+			if currentConfig().ZabbixConfig.ReEnableHosts {
+				host = markDisabledByAAZ(host)
+			}
+			zabbixInventory.set(host)
+		}
 	}
+	return changed, failed
 }
 
 func heartBeat() {
 	// might add some more useful information?
 	for {
 		time.Sleep(1 * time.Hour)
-		log.Printf("Heartbeat -- %d hosts active in Zabbix", len(zabbixHostMap))
+		log.Printf("Heartbeat -- %d hosts active in Zabbix", zabbixInventory.len())
 	}
 }
 
 func contains(s []string, e string) bool {
-	// tiny helper for unMonitorHost(): checks whether []s contains e
+	// tiny helper: checks whether []s contains e
 	for _, a := range s {
 		if a == e {
 			return true
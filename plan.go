@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+)
+
+// syncPlan lists what a sync would do with every host. Plans can be saved as
+// JSON and applied later; the fingerprint covers all inputs of the plan, so
+// apply can detect whether ASG or Zabbix changed meanwhile.
+type syncPlan struct {
+	Created           time.Time  `json:"created"`
+	AutoScalingGroups []string   `json:"autoScalingGroups"`
+	ScaleDownAction   string     `json:"scaleDownAction"`
+	Fingerprint       string     `json:"fingerprint"`
+	Steps             []planStep `json:"steps"`
+}
+
+// planStep describes what a sync would do with a single host.
+type planStep struct {
+	Host             string `json:"host"`                       // Zabbix host name (InstanceId for hosts missing in Zabbix)
+	HostId           string `json:"hostId,omitempty"`           // empty for hosts missing in Zabbix
+	InstanceId       string `json:"instanceId"`                 // see instanceIdForHost()
+	AutoScalingGroup string `json:"autoScalingGroup,omitempty"` // empty for hosts not in any ASG
+	LifecycleState   string `json:"lifecycleState,omitempty"`
+	ZabbixStatus     string `json:"zabbixStatus,omitempty"` // enabled or disabled
+	Action           string `json:"action"`
+}
+
+const (
+	PlanActionKeep    = "KEEP"    // host in ASG and Zabbix
+	PlanActionNone    = "NONE"    // host not in ASG, but already disabled in Zabbix
+	PlanActionMissing = "MISSING" // host in ASG, but not in Zabbix -- informational only
+	PlanActionEnable  = "ENABLE"  // host disabled by AAZ, but its instance is InService again
+	// hosts to remove use ScaleDownAction (DELETE or DISABLE) as action
+
+	PlanFormatTable = "table"
+	PlanFormatJSON  = "json"
+)
+
+func buildSyncPlan(zabbixHosts []ZabbixHost, instances []AWS_AutoScalingInstance, config AAZConfig) syncPlan {
+	// Compares Zabbix hosts against ASG instances by InstanceId; steps are sorted by host name.
+	plan := syncPlan{
+		Created:           time.Now().UTC(),
+		AutoScalingGroups: config.AutoScale.managedGroups(),
+		ScaleDownAction:   config.ZabbixConfig.ScaleDownAction,
+		Steps:             []planStep{},
+	}
+	asgInstances := map[string]AWS_AutoScalingInstance{}
+	for _, instance := range instances {
+		asgInstances[instance.InstanceId] = instance
+	}
+	zabbixInstances := map[string]bool{}
+	for _, host := range zabbixHosts {
+		zabbixInstances[host.InstanceId] = true
+		step := planStep{Host: host.Host, HostId: host.HostId, InstanceId: host.InstanceId,
+			ZabbixStatus: "enabled", Action: plan.ScaleDownAction}
+		if zabbixHostDisabled(host) {
+			step.ZabbixStatus = "disabled"
+		}
+		if instance, ok := asgInstances[host.InstanceId]; ok {
+			step.AutoScalingGroup = instance.AutoScalingGroupName
+			step.LifecycleState = instance.LifecycleState
+			step.Action = PlanActionKeep
+			if zabbixHostDisabled(host) && disabledByAAZ(host) && instance.LifecycleState == AWS_LifecycleInService {
+				step.Action = PlanActionEnable
+			}
+		} else if plan.ScaleDownAction == ScaleDownActionDISABLE && zabbixHostDisabled(host) {
+			step.Action = PlanActionNone
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+	for _, instance := range instances {
+		if !zabbixInstances[instance.InstanceId] {
+			plan.Steps = append(plan.Steps, planStep{Host: instance.InstanceId, InstanceId: instance.InstanceId,
+				AutoScalingGroup: instance.AutoScalingGroupName, LifecycleState: instance.LifecycleState, Action: PlanActionMissing})
+		}
+	}
+	sort.Slice(plan.Steps, func(i, j int) bool { return plan.Steps[i].Host < plan.Steps[j].Host })
+	plan.Fingerprint = plan.fingerprint()
+	return plan
+}
+
+func currentSyncPlan() (syncPlan, error) {
+	// Builds a plan from zabbixInventory and the current ASG instances.
+	config := currentConfig()
+	log.Printf("Retrieving ASG %s members ...", config.AutoScale.managedGroups())
+	instances, err := getAutoScalingGroupInstances(config.AutoScale)
+	if err != nil {
+		return syncPlan{}, fmt.Errorf("Cannot get ASG members: %w", err)
+	}
+	rememberASGMembers(instances)
+	return buildSyncPlan(zabbixInventory.all(), instances, config), nil
+}
+
+func zabbixHostDisabled(host ZabbixHost) bool {
+	return host.Status == fmt.Sprint(JSONRPC_StatusDisableHost) || host.Status == "DISABLED"
+}
+
+func (plan syncPlan) fingerprint() string {
+	// Hash of everything but the creation time.
+	inputs, _ := json.Marshal([]interface{}{plan.AutoScalingGroups, plan.ScaleDownAction, plan.Steps})
+	return fmt.Sprintf("%x", sha256.Sum256(inputs))
+}
+
+func (plan syncPlan) changes() int {
+	// Returns number of steps that would modify Zabbix.
+	changes := 0
+	for _, step := range plan.Steps {
+		if step.Action == ScaleDownActionDELETE || step.Action == ScaleDownActionDISABLE || step.Action == PlanActionEnable {
+			changes++
+		}
+	}
+	return changes
+}
+
+func writePlan(out io.Writer, plan syncPlan, format string) error {
+	switch format {
+	case PlanFormatJSON:
+		planJSON, _ := json.MarshalIndent(plan, "", "  ")
+		_, err := fmt.Fprintln(out, string(planJSON))
+		return err
+	case PlanFormatTable:
+		fmt.Fprintf(out, "%-8s %-22s %-10s %-20s %-22s %s\n", "ACTION", "HOST", "HOSTID", "ASG", "LIFECYCLE", "ZABBIX")
+		for _, step := range plan.Steps {
+			fmt.Fprintf(out, "%-8s %-22s %-10s %-20s %-22s %s\n", step.Action, step.Host,
+				orDash(step.HostId), orDash(step.AutoScalingGroup), orDash(step.LifecycleState), orDash(step.ZabbixStatus))
+		}
+		_, err := fmt.Fprintf(out, "\n%d host(s) to change\n", plan.changes())
+		return err
+	}
+	return fmt.Errorf("unknown plan format '%s' (use %s or %s)", format, PlanFormatTable, PlanFormatJSON)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func savePlan(filename string, plan syncPlan) error {
+	planJSON, _ := json.MarshalIndent(plan, "", "  ")
+	return ioutil.WriteFile(filename, planJSON, 0644)
+}
+
+func loadPlan(filename string) (syncPlan, error) {
+	var plan syncPlan
+	planJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return plan, err
+	}
+	if err := json.Unmarshal(planJSON, &plan); err != nil {
+		return plan, fmt.Errorf("decoding plan %s failed: %s", filename, err)
+	}
+	if plan.Fingerprint != plan.fingerprint() {
+		return plan, fmt.Errorf("plan %s has been modified", filename)
+	}
+	return plan, nil
+}
+
+func planDiff(oldPlan syncPlan, newPlan syncPlan) []string {
+	// Describes differences between two plans, e.g. for a stale plan on apply.
+	var diffs []string
+	if oldPlan.ScaleDownAction != newPlan.ScaleDownAction {
+		diffs = append(diffs, fmt.Sprintf("ScaleDownAction: %s -> %s", oldPlan.ScaleDownAction, newPlan.ScaleDownAction))
+	}
+	oldSteps := map[string]planStep{}
+	for _, step := range oldPlan.Steps {
+		oldSteps[step.Host] = step
+	}
+	for _, step := range newPlan.Steps {
+		oldStep, ok := oldSteps[step.Host]
+		delete(oldSteps, step.Host)
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: new host (%s)", step.Host, step.Action))
+		} else if oldStep != step {
+			diffs = append(diffs, fmt.Sprintf("%s: %+v -> %+v", step.Host, oldStep, step))
+		}
+	}
+	for host := range oldSteps {
+		diffs = append(diffs, fmt.Sprintf("%s: host vanished", host))
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+func auditSyncPlan(plan syncPlan, trigger auditTrigger) {
+	// Records each change plan would make as dry-run, as unMonitorHosts() and enableHosts() do in DryRun mode.
+	for _, step := range plan.Steps {
+		if step.Action != ScaleDownActionDELETE && step.Action != ScaleDownActionDISABLE && step.Action != PlanActionEnable {
+			continue
+		}
+		before, ok := zabbixInventory.byHostId(step.HostId)
+		if !ok {
+			before = ZabbixHost{HostId: step.HostId, Host: step.Host, InstanceId: step.InstanceId}
+		}
+		auditRecord(auditEntry{Action: step.Action, InstanceId: step.InstanceId, Before: &before, Trigger: trigger, Result: AuditDryRun})
+	}
+}
+
+func applySyncPlan(plan syncPlan, trigger auditTrigger) (changed int, failed int) {
+	// Executes plan steps; hosts not in ASG get "unMonitored" in Zabbix, in batches, those AAZ
+	// disabled get enabled again. Hosts are identified by hostid, as planned.
+	// Returns the number of hosts changed and failing to change.
+	var hostsToRemove, hostsToEnable []ZabbixHost
+	for _, step := range plan.Steps {
+		switch {
+		case step.Action == PlanActionMissing:
+			log.Printf("NOTICE: ASG instance '%s' is not monitored by Zabbix", step.Host)
+		case step.Action == PlanActionKeep:
+			log.Printf("Zabbix host '%s' exists in ASG, too -- KEEPING", step.Host)
+		case step.Action == PlanActionNone:
+			log.Printf("Zabbix host '%s' does NOT exist in ASG, but is disabled already", step.Host)
+		case step.Action == PlanActionEnable:
+			// not persisted on shutdown like removals; the next sync catches up
+			if host, ok := zabbixInventory.byHostId(step.HostId); ok && !isShuttingDown() {
+				log.Printf("Zabbix host '%s' disabled by AAZ is InService again -- ENABLING", step.Host)
+				hostsToEnable = append(hostsToEnable, host)
+			}
+		case isShuttingDown():
+			// remember hosts not yet handled; gracefulShutdown() persists them
+			pendingActions.begin(step.InstanceId)
+		default:
+			host, ok := zabbixInventory.byHostId(step.HostId)
+			if !ok {
+				log.Printf("WARNING: Zabbix host '%s' (hostid %s) vanished since planning", step.Host, step.HostId)
+				countWarning()
+				continue
+			}
+			log.Printf("Zabbix host '%s' does NOT exist in ASG -- REMOVING!", step.Host)
+			hostsToRemove = append(hostsToRemove, host)
+		}
+	}
+	changed, failed = unMonitorHosts(hostsToRemove, trigger)
+	enabled, enableFailed := enableHosts(hostsToEnable, trigger)
+	return changed + enabled, failed + enableFailed
+}
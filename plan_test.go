@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPlan() syncPlan {
+	hosts := []ZabbixHost{
+		{HostId: "10001", Host: "i-0aaa", InstanceId: "i-0aaa", Status: "0"},
+		{HostId: "10002", Host: "i-0bbb", InstanceId: "i-0bbb", Status: "0"},
+	}
+	instances := []AWS_AutoScalingInstance{{InstanceId: "i-0aaa", AutoScalingGroupName: "web", LifecycleState: "InService"}}
+	config := AAZConfig{AutoScale: AutoScale{GroupName: "web"}, ZabbixConfig: ZabbixConfig{ScaleDownAction: ScaleDownActionDELETE}}
+	return buildSyncPlan(hosts, instances, config)
+}
+
+func TestPlanFingerprint(t *testing.T) {
+	plan := testPlan()
+	later := plan
+	later.Created = plan.Created.Add(time.Hour)
+	if later.fingerprint() != plan.Fingerprint {
+		t.Error("fingerprint depends on creation time")
+	}
+	changed := testPlan()
+	changed.Steps = append([]planStep{}, changed.Steps...)
+	changed.Steps[1].Action = ScaleDownActionDISABLE
+	if changed.fingerprint() == plan.Fingerprint {
+		t.Error("fingerprint does not cover steps")
+	}
+	changed = testPlan()
+	changed.ScaleDownAction = ScaleDownActionDISABLE
+	if changed.fingerprint() == plan.Fingerprint {
+		t.Error("fingerprint does not cover ScaleDownAction")
+	}
+}
+
+func TestLoadPlanDetectsModification(t *testing.T) {
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	plan := testPlan()
+	if err := savePlan(planFile, plan); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadPlan(planFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Steps, plan.Steps) || !loaded.Created.Equal(plan.Created) {
+		t.Errorf("got %+v, want %+v", loaded, plan)
+	}
+
+	// e.g. a host added to the plan by hand
+	planJSON, _ := os.ReadFile(planFile)
+	modified := strings.Replace(string(planJSON), `"action": "KEEP"`, `"action": "DELETE"`, 1)
+	os.WriteFile(planFile, []byte(modified), 0644)
+	if _, err := loadPlan(planFile); err == nil || !strings.Contains(err.Error(), "has been modified") {
+		t.Errorf("expected modified plan to be refused, got %v", err)
+	}
+	os.WriteFile(planFile, []byte("{"), 0644)
+	if _, err := loadPlan(planFile); err == nil {
+		t.Error("expected error for invalid plan")
+	}
+}
+
+func TestPlanDiff(t *testing.T) {
+	plan := testPlan()
+	same := testPlan()
+	if diffs := planDiff(plan, same); len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v", diffs)
+	}
+
+	changed := testPlan()
+	changed.ScaleDownAction = ScaleDownActionDISABLE
+	changed.Steps = []planStep{
+		changed.Steps[0],
+		{Host: "i-0ccc", HostId: "10003", InstanceId: "i-0ccc", ZabbixStatus: "enabled", Action: ScaleDownActionDISABLE},
+	}
+	changed.Steps[0].LifecycleState = "Standby"
+	expected := []string{
+		"ScaleDownAction: DELETE -> DISABLE",
+		"i-0aaa: {Host:i-0aaa HostId:10001 InstanceId:i-0aaa AutoScalingGroup:web LifecycleState:InService ZabbixStatus:enabled Action:KEEP} -> " +
+			"{Host:i-0aaa HostId:10001 InstanceId:i-0aaa AutoScalingGroup:web LifecycleState:Standby ZabbixStatus:enabled Action:KEEP}",
+		"i-0bbb: host vanished",
+		"i-0ccc: new host (DISABLE)",
+	}
+	if diffs := planDiff(plan, changed); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("got diff\n%s\nwant\n%s", strings.Join(diffs, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestApplyRefusesStalePlan(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa", "i-0old")
+	autoScaling.setGroup("web", "i-0aaa")
+	configFile := writeConfigFile(t, zabbix, autoScaling, ScaleDownActionDELETE)
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	if code := cmdPlan([]string{"-config", configFile, "-out", planFile}); code != ExitChanges {
+		t.Fatalf("plan: got exit code %d, want %d", code, ExitChanges)
+	}
+
+	// ASG changed since the plan was made
+	autoScaling.setGroup("web", "i-0aaa", "i-0old")
+	if code := cmdApply([]string{"-config", configFile, planFile}); code != ExitStale {
+		t.Errorf("apply: got exit code %d, want %d", code, ExitStale)
+	}
+	if _, ok := zabbix.host("i-0old"); !ok || zabbix.countCalls(JSONRPC_Method_DeleteHost) != 0 {
+		t.Error("stale plan applied")
+	}
+
+	autoScaling.setGroup("web", "i-0aaa")
+	if code := cmdApply([]string{"-config", configFile, planFile}); code != ExitOK {
+		t.Errorf("apply: got exit code %d, want %d", code, ExitOK)
+	}
+	if _, ok := zabbix.host("i-0old"); ok {
+		t.Error("plan not applied")
+	}
+	if code := cmdApply([]string{"-config", configFile, filepath.Join(t.TempDir(), "missing.json")}); code != ExitUsage {
+		t.Errorf("apply of missing plan: got exit code %d, want %d", code, ExitUsage)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// eventQueue decouples receiving events from acting on them: snsHandler only
+// decodes and enqueues, workers run handleEvent(). The queue is bounded; when
+// it is full, senders are asked to retry later (503).
+type eventQueue struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond // signalled on push, on work done and on close
+	items    []queuedEvent
+	capacity int
+	workers  int
+	busy     int  // workers currently handling an event
+	closed   bool // no more pushes; workers exit once items are taken
+	rejected int  // events refused as queue was full
+}
+
+type queuedEvent struct {
+	event    aazEvent
+	received time.Time
+}
+
+const (
+	DefaultQueueSize    = 1000
+	DefaultQueueWorkers = 4
+)
+
+// queue used by snsHandler; set up by startEventQueue()
+var workQueue *eventQueue
+
+func newEventQueue(capacity int, workers int) *eventQueue {
+	if capacity <= 0 {
+		capacity = DefaultQueueSize
+	}
+	if workers <= 0 {
+		workers = DefaultQueueWorkers
+	}
+	q := &eventQueue{capacity: capacity, workers: workers}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func startEventQueue(config DaemonConfig) *eventQueue {
+	// Creates workQueue and starts its workers.
+	workQueue = newEventQueue(config.QueueSize, config.QueueWorkers)
+	for i := 0; i < workQueue.workers; i++ {
+		go workQueue.work(handleEvent)
+	}
+	log.Printf("Started %d event queue workers (queue size: %d)", workQueue.workers, workQueue.capacity)
+	return workQueue
+}
+
+func (q *eventQueue) push(events ...aazEvent) bool {
+	// Enqueues all events, or none of them if they do not fit.
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed || len(q.items)+len(events) > q.capacity {
+		q.rejected += len(events)
+		return false
+	}
+	now := time.Now()
+	for _, event := range events {
+		q.items = append(q.items, queuedEvent{event: event, received: now})
+	}
+	q.cond.Broadcast()
+	return true
+}
+
+func (q *eventQueue) work(handle func(aazEvent)) {
+	// Worker loop; returns once the queue is closed and empty.
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.items) == 0 {
+			return
+		}
+		item := q.items[0]
+		q.items = q.items[1:]
+		q.busy++
+		q.mutex.Unlock()
+		handle(item.event)
+		q.mutex.Lock()
+		q.busy--
+		q.cond.Broadcast()
+	}
+}
+
+func (q *eventQueue) wait() {
+	// Blocks until all queued events have been handled.
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.items) > 0 || q.busy > 0 {
+		q.cond.Wait()
+	}
+}
+
+func (q *eventQueue) drain(timeout time.Duration) []aazEvent {
+	// Closes the queue and waits up to timeout for workers to handle queued events.
+	// Returns events not even started by then; these are dropped from the queue.
+	q.mutex.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var remaining []aazEvent
+	for _, item := range q.items {
+		remaining = append(remaining, item.event)
+	}
+	q.items = nil
+	q.cond.Broadcast()
+	return remaining
+}
+
+func (q *eventQueue) status() *AAZQueueStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	status := &AAZQueueStatus{Depth: len(q.items), Capacity: q.capacity, Workers: q.workers, Busy: q.busy, Rejected: q.rejected}
+	if len(q.items) > 0 {
+		status.OldestAge = time.Since(q.items[0].received).Seconds()
+	}
+	return status
+}
+
+func persistQueuedEvents(events []aazEvent) {
+	// Unhandled terminations are turned into pending actions, so that they get persisted
+	// by savePendingActions() and resumed on next startup. Other events are lost.
+	for _, event := range events {
+		if event.Event == SNS_EV_Terminate && contains(currentConfig().AutoScale.managedGroups(), event.AutoScalingGroupName) {
+			pendingActions.begin(event.InstanceId)
+			continue
+		}
+		log.Printf("WARNING: Dropping unhandled '%s' event of instance '%s' on shutdown", event.Event, event.InstanceId)
+		countWarning()
+	}
+}
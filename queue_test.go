@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventQueueBackpressure(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	// no workers, so nothing is taken off the queue
+	workQueue = newEventQueue(2, 1)
+
+	if code := deliverSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web")).Code; code != 200 {
+		t.Errorf("got %d, want 200", code)
+	}
+	if code := deliverSNS(sqsBatch(eventBridgeTerminate, eventBridgeTerminate)).Code; code != 503 {
+		t.Errorf("batch exceeding capacity: got %d, want 503", code)
+	}
+	if code := deliverSNS(snsNotification(SNS_EV_Terminate, "i-0bbb", "web")).Code; code != 200 {
+		t.Errorf("got %d, want 200", code)
+	}
+	time.Sleep(10 * time.Millisecond)
+	status := workQueue.status()
+	if status.Depth != 2 || status.Capacity != 2 || status.Rejected != 2 || status.OldestAge <= 0 {
+		t.Errorf("unexpected queue status %+v", status)
+	}
+}
+
+func TestEventQueueDrainPersistsTerminations(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	workQueue = newEventQueue(10, 1)
+	pendingActions = pendingActionSet{actions: map[string]time.Time{}}
+	workQueue.push(
+		aazEvent{Event: SNS_EV_Terminate, InstanceId: "i-0aaa", AutoScalingGroupName: "web"},
+		aazEvent{Event: SNS_EV_Terminate, InstanceId: "i-0bbb", AutoScalingGroupName: "other"},
+		aazEvent{Event: SNS_EV_Launch, InstanceId: "i-0ccc", AutoScalingGroupName: "web"},
+	)
+
+	remaining := workQueue.drain(10 * time.Millisecond)
+	if len(remaining) != 3 {
+		t.Fatalf("got %d remaining events, want 3", len(remaining))
+	}
+	persistQueuedEvents(remaining)
+	if ids := pendingActions.instanceIds(); len(ids) != 1 || ids[0] != "i-0aaa" {
+		t.Errorf("got pending actions %v, want [i-0aaa]", ids)
+	}
+	if workQueue.push(aazEvent{Event: SNS_EV_Terminate}) {
+		t.Error("drained queue accepted event")
+	}
+}
+
+func TestEventQueueWorkers(t *testing.T) {
+	queue := newEventQueue(10, 3)
+	handled := make(chan string, 10)
+	for i := 0; i < queue.workers; i++ {
+		go queue.work(func(event aazEvent) { handled <- event.InstanceId })
+	}
+	queue.push(aazEvent{InstanceId: "i-0aaa"}, aazEvent{InstanceId: "i-0bbb"})
+	queue.wait()
+	if len(handled) != 2 {
+		t.Errorf("got %d handled events, want 2", len(handled))
+	}
+	if remaining := queue.drain(time.Second); len(remaining) != 0 {
+		t.Errorf("got remaining events %v", remaining)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Hosts AAZ disabled carry this tag (with the time as value); only these are enabled again,
+// never hosts disabled by someone else. Tagging requires ZabbixConfig.ReEnableHosts.
+const AAZDisabledTag = "aaz:disabled"
+
+func disabledByAAZ(host ZabbixHost) bool {
+	for _, tag := range host.Tags {
+		if tag.Tag == AAZDisabledTag {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutAAZTag(tags []JSONRPC_HostTag) []JSONRPC_HostTag {
+	result := []JSONRPC_HostTag{}
+	for _, tag := range tags {
+		if tag.Tag != AAZDisabledTag {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+func updateAAZTag(hostId string, disabled bool, params map[string]interface{}) ([]JSONRPC_HostTag, error) {
+	// Sets or removes the AAZ tag using host.update, which replaces all tags: all other tags
+	// are fetched right before and kept. Returns the tags the host has now.
+	current, err := zabbixGetHostTags(hostId)
+	if err != nil {
+		return nil, err
+	}
+	tags := withoutAAZTag(current)
+	if disabled {
+		tags = append(tags, JSONRPC_HostTag{Tag: AAZDisabledTag, Value: time.Now().UTC().Format(time.RFC3339)})
+	}
+	params["tags"] = tags
+	return tags, zabbixUpdateHost(hostId, params)
+}
+
+func markDisabledByAAZ(host ZabbixHost) ZabbixHost {
+	// Tags a host just disabled, so enableHosts() may enable it again; returns the host as tagged.
+	tags, err := updateAAZTag(host.HostId, true, map[string]interface{}{})
+	if err != nil {
+		log.Printf("WARNING: Cannot tag host '%s' as disabled by AAZ, it will not be enabled again automatically: %s", host.Host, err)
+		countWarning()
+		return host
+	}
+	host.Tags = tags
+	return host
+}
+
+func enableHosts(hosts []ZabbixHost, trigger auditTrigger) (changed int, failed int) {
+	// Enables hosts disabled by AAZ whose instances are InService again, removing their tag.
+	// Respects DryRun bool. Returns the number of hosts enabled and failing to enable; each is notified and audited.
+	for _, host := range hosts {
+		audit := auditEntry{Action: AuditActionEnable, InstanceId: host.InstanceId, Before: &host, Trigger: trigger, Result: AuditSuccess}
+		if DryRun {
+			log.Printf("DRY-RUN: Would now ENABLE Zabbix host '%s' (hostid %s)", host.Host, host.HostId)
+			audit.Result = AuditDryRun
+			auditRecord(audit)
+			continue
+		}
+		tags, err := updateAAZTag(host.HostId, false, map[string]interface{}{"status": JSONRPC_StatusEnableHost})
+		if err != nil {
+			log.Printf("ERROR: Failed to ENABLE host '%s' (hostid %s): %s", host.Host, host.HostId, err)
+			countError()
+			notify(aazNotification{Event: NotifyFailure, Action: AuditActionEnable, Host: host.Host, HostId: host.HostId,
+				InstanceId: host.InstanceId, Error: err.Error(),
+				Message: fmt.Sprintf("AAZ failed to ENABLE Zabbix host '%s': %s", host.Host, err)})
+			audit.Result, audit.Error = AuditFailed, err.Error()
+			auditRecord(audit)
+			failed++
+			continue
+		}
+		log.Printf("SUCCESS: ENABLE host '%s' (hostid %s)", host.Host, host.HostId)
+		notify(aazNotification{Event: NotifyAction, Action: AuditActionEnable, Host: host.Host, HostId: host.HostId,
+			InstanceId: host.InstanceId, Message: fmt.Sprintf("AAZ did ENABLE Zabbix host '%s'", host.Host)})
+		auditRecord(audit)
+		changed++
+		host.Status = fmt.Sprint(JSONRPC_StatusEnableHost)
+		host.Tags = tags
+		zabbixInventory.set(host)
+		unmonitoredInstances.done(host.InstanceId) // may be removed again
+	}
+	return changed, failed
+}
+
+func enableInstance(instanceId string, trigger auditTrigger) {
+	// Enables the host of a (re-)launched instance, if AAZ disabled it and the instance is InService.
+	config := currentConfig()
+	if !config.ZabbixConfig.ReEnableHosts {
+		return
+	}
+	host, ok := zabbixInventory.byInstance(instanceId)
+	if !ok && refreshZabbixInventory() == nil {
+		host, ok = zabbixInventory.byInstance(instanceId)
+	}
+	if !ok || !zabbixHostDisabled(host) || !disabledByAAZ(host) {
+		return
+	}
+	if !config.hasAWSKey() {
+		log.Printf("NOTICE: Cannot check lifecycle state of instance '%s' (no AWS key), not enabling host '%s'", instanceId, host.Host)
+		return
+	}
+	instance, found, err := describeAutoScalingInstance(config.AutoScale, instanceId)
+	if err != nil {
+		log.Printf("ERROR: Cannot check lifecycle state of instance '%s': %s", instanceId, err)
+		countError()
+		return
+	}
+	if !found || instance.LifecycleState != AWS_LifecycleInService {
+		log.Printf("NOTICE: Instance '%s' is not InService (yet), not enabling host '%s'", instanceId, host.Host)
+		return
+	}
+	enableHosts([]ZabbixHost{host}, trigger)
+}
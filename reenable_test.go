@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func setReEnableHosts() {
+	config := currentConfig()
+	config.ZabbixConfig.ReEnableHosts = true
+	setConfig(config, currentACL())
+}
+
+func TestReEnableOnSync(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDISABLE)
+	setReEnableHosts()
+	autoScaling.setGroup("web", "i-0bbb")
+	zabbix.addHosts("i-0aaa", "i-0bbb", "i-0ccc")
+	manual, _ := zabbix.host("i-0ccc")
+	zabbix.mutex.Lock()
+	zabbix.setStatus([]string{manual.HostId}, JSONRPC_StatusDisableHost) // disabled by someone else
+	zabbix.mutex.Unlock()
+	setAudit(t, AuditConfig{})
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	if details := zabbix.detailsOf("i-0aaa"); tagValue(details.tags, AAZDisabledTag) == "" || tagValue(details.tags, "env") != "prod" {
+		t.Fatalf("disabled host not tagged: %+v", details.tags)
+	}
+
+	// i-0aaa returns from Standby, i-0ccc is attached
+	autoScaling.setGroup("web", "i-0aaa", "i-0bbb", "i-0ccc")
+	if err := initalizeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	host, _ := zabbix.host("i-0aaa")
+	details := zabbix.detailsOf("i-0aaa")
+	if host.Status != strconv.Itoa(JSONRPC_StatusEnableHost) || tagValue(details.tags, AAZDisabledTag) != "" || tagValue(details.tags, "env") != "prod" {
+		t.Errorf("host not enabled: %+v, tags %+v", host, details.tags)
+	}
+	if host, _ := zabbix.host("i-0ccc"); host.Status != strconv.Itoa(JSONRPC_StatusDisableHost) {
+		t.Error("host disabled by someone else enabled")
+	}
+	entries := auditEntries(t, func(entry auditEntry) bool { return entry.Action == AuditActionEnable })
+	if len(entries) != 1 || entries[0].InstanceId != "i-0aaa" || entries[0].Trigger.Source != TriggerSync {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+}
+
+func TestReEnablePlan(t *testing.T) {
+	disabled := ZabbixHost{HostId: "10001", Host: "i-0aaa", InstanceId: "i-0aaa", Status: "1",
+		Tags: []JSONRPC_HostTag{{Tag: AAZDisabledTag, Value: "2026-10-19T10:00:00Z"}}}
+	manual := ZabbixHost{HostId: "10002", Host: "i-0bbb", InstanceId: "i-0bbb", Status: "1"}
+	config := AAZConfig{AutoScale: AutoScale{GroupName: "web"}, ZabbixConfig: ZabbixConfig{ScaleDownAction: ScaleDownActionDISABLE}}
+	tests := []struct {
+		host  ZabbixHost
+		state string
+		want  string
+	}{
+		{disabled, AWS_LifecycleInService, PlanActionEnable},
+		{disabled, "Standby", PlanActionKeep},
+		{manual, AWS_LifecycleInService, PlanActionKeep},
+	}
+	for _, test := range tests {
+		plan := buildSyncPlan([]ZabbixHost{test.host},
+			[]AWS_AutoScalingInstance{{InstanceId: test.host.InstanceId, LifecycleState: test.state, AutoScalingGroupName: "web"}}, config)
+		if plan.Steps[0].Action != test.want {
+			t.Errorf("%s (%s): got %s, want %s", test.host.Host, test.state, plan.Steps[0].Action, test.want)
+		}
+	}
+}
+
+func TestReEnableOnLaunch(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDISABLE)
+	setReEnableHosts()
+	zabbix.addHosts("i-0aaa")
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+
+	autoScaling.setGroup("web", "i-0aaa")
+	autoScaling.setLifecycleState("i-0aaa", "Pending")
+	postSNS(snsNotification(SNS_EV_Launch, "i-0aaa", "web"))
+	if host, _ := zabbix.host("i-0aaa"); host.Status != strconv.Itoa(JSONRPC_StatusDisableHost) {
+		t.Error("host enabled before instance is InService")
+	}
+	autoScaling.setLifecycleState("i-0aaa", AWS_LifecycleInService)
+	postSNS(snsNotification(SNS_EV_Launch, "i-0aaa", "web"))
+	if host, _ := zabbix.host("i-0aaa"); host.Status != strconv.Itoa(JSONRPC_StatusEnableHost) {
+		t.Error("host not enabled")
+	}
+	if statusSnapshot().Errors != 0 || statusSnapshot().Notifications != 3 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
+
+func TestReEnableKeepsOtherTags(t *testing.T) {
+	// Tags set in Zabbix after the inventory was loaded (by enrichment or operators) survive DISABLE and ENABLE.
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDISABLE)
+	setReEnableHosts()
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+	addTag := func(name string, value string) {
+		host, _ := zabbix.host("i-0aaa")
+		zabbix.mutex.Lock()
+		defer zabbix.mutex.Unlock()
+		zabbix.details[host.HostId].tags = append(zabbix.details[host.HostId].tags, JSONRPC_HostTag{Tag: name, Value: value})
+	}
+
+	addTag("owner", "ops")
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	details := zabbix.detailsOf("i-0aaa")
+	if tagValue(details.tags, AAZDisabledTag) == "" || tagValue(details.tags, "owner") != "ops" || tagValue(details.tags, "env") != "prod" {
+		t.Fatalf("tags lost on DISABLE: %+v", details.tags)
+	}
+
+	addTag("ec2:type", "t3.small")
+	autoScaling.setGroup("web", "i-0aaa")
+	postSNS(snsNotification(SNS_EV_Launch, "i-0aaa", "web"))
+	host, _ := zabbix.host("i-0aaa")
+	details = zabbix.detailsOf("i-0aaa")
+	if host.Status != strconv.Itoa(JSONRPC_StatusEnableHost) {
+		t.Fatal("host not enabled")
+	}
+	if tagValue(details.tags, AAZDisabledTag) != "" || tagValue(details.tags, "owner") != "ops" ||
+		tagValue(details.tags, "ec2:type") != "t3.small" || len(details.tags) != 3 {
+		t.Errorf("tags lost on ENABLE: %+v", details.tags)
+	}
+}
+
+func TestReEnableDisabledByDefault(t *testing.T) {
+	// Zabbix before 4.2 knows no host tags: no tags selected, none set on DISABLE.
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDISABLE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	if calls := zabbix.countCalls(JSONRPC_Method_UpdateHost); calls != 0 {
+		t.Errorf("expected no host.update calls, got %d", calls)
+	}
+	if host, _ := zabbixInventory.byInstance("i-0aaa"); len(host.Tags) != 0 {
+		t.Errorf("unexpected tags %+v", host.Tags)
+	}
+	autoScaling.setGroup("web", "i-0aaa")
+	postSNS(snsNotification(SNS_EV_Launch, "i-0aaa", "web"))
+	if err := initalizeHosts(); err != nil {
+		t.Fatal(err)
+	}
+	if host, _ := zabbix.host("i-0aaa"); host.Status != strconv.Itoa(JSONRPC_StatusDisableHost) {
+		t.Error("host enabled without ReEnableHosts")
+	}
+}
+
+func TestZabbixHostTagsSupport(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDISABLE)
+	autoScaling.setGroup("web", "i-0aaa")
+	setReEnableHosts()
+	if problems := checkConnectivity(currentConfig()); len(problems) != 0 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+	zabbix.mutex.Lock()
+	zabbix.version = "3.2.11"
+	zabbix.mutex.Unlock()
+	if problems := checkConnectivity(currentConfig()); len(problems) != 1 {
+		t.Errorf("expected host tags to be reported as unsupported, got %v", problems)
+	}
+	for version, supported := range map[string]bool{"3.4.15": false, "4.0.1": false, "4.2.0": true, "5.0.3": true, "6.4.0rc1": true} {
+		if zabbixSupportsHostTags(version) != supported {
+			t.Errorf("zabbixSupportsHostTags(%s) = %t", version, !supported)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// refreshes and syncs started by reloadConfig(), waited for on shutdown
+var reloadSyncs sync.WaitGroup
+
+func reloadConfig(filename string) {
+	// Re-reads configuration on SIGHUP. The new configuration is activated only
+	// if it is completely valid; otherwise the running configuration stays in place.
+	log.Printf("Reloading configuration from %s", filename)
+	newConfig, acl, err := loadConfig(filename)
+	if err != nil {
+		log.Print("ERROR: Configuration reload failed, keeping current configuration:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			log.Printf("ERROR: %s", line)
+		}
+		countError()
+		return
+	}
+	oldConfig := currentConfig()
+	changes := configDiff(oldConfig, newConfig)
+	if len(changes) == 0 {
+		log.Print("Configuration reloaded -- no changes")
+		return
+	}
+	for _, change := range changes {
+		log.Printf("Configuration change: %s", change)
+	}
+
+	// the listener socket cannot be swapped, everything else can
+	if newConfig.ListenerConfig.Address != oldConfig.ListenerConfig.Address || newConfig.useTLS() != oldConfig.useTLS() {
+		log.Print("WARNING: Changing listener Address or enabling/disabling TLS requires a restart")
+		newConfig.ListenerConfig.Address = oldConfig.ListenerConfig.Address
+		newConfig.ListenerConfig.TLS_CertPath = oldConfig.ListenerConfig.TLS_CertPath
+		newConfig.ListenerConfig.TLS_CertKey = oldConfig.ListenerConfig.TLS_CertKey
+		countWarning()
+	}
+	if newConfig.DaemonConfig.QueueSize != oldConfig.DaemonConfig.QueueSize ||
+		newConfig.DaemonConfig.QueueWorkers != oldConfig.DaemonConfig.QueueWorkers {
+		log.Print("WARNING: Changing QueueSize or QueueWorkers requires a restart")
+		newConfig.DaemonConfig.QueueSize = oldConfig.DaemonConfig.QueueSize
+		newConfig.DaemonConfig.QueueWorkers = oldConfig.DaemonConfig.QueueWorkers
+		countWarning()
+	}
+	if newConfig.useTLS() && !reflect.DeepEqual(newConfig.ListenerConfig, oldConfig.ListenerConfig) {
+		tlsConfig, err := buildTLSConfig(newConfig.ListenerConfig)
+		if err != nil {
+			log.Printf("ERROR: Configuration reload failed, keeping current configuration: invalid TLS configuration: %s", err)
+			countError()
+			return
+		}
+		setTLSConfig(tlsConfig)
+	}
+
+	// end session using old credentials; next API call will log in using new ones
+	zabbixChanged := newConfig.ZabbixConfig.URL != oldConfig.ZabbixConfig.URL ||
+		newConfig.ZabbixConfig.User != oldConfig.ZabbixConfig.User ||
+		newConfig.ZabbixConfig.Password != oldConfig.ZabbixConfig.Password
+	if zabbixChanged {
+		zabbixLogout()
+	}
+
+	setConfig(newConfig, acl)
+	log.Print("Configuration reloaded")
+
+	refresh := zabbixChanged ||
+		newConfig.ZabbixConfig.RestrictToGroupId != oldConfig.ZabbixConfig.RestrictToGroupId ||
+		newConfig.ZabbixConfig.RestrictToTemplateId != oldConfig.ZabbixConfig.RestrictToTemplateId
+	resync := !reflect.DeepEqual(newConfig.AutoScale, oldConfig.AutoScale)
+	if resync && !newConfig.hasAWSKey() {
+		log.Print("NOTICE: Skipping host sync as AutoScale group has no IAM user/key defined")
+		resync = false
+	}
+	if !refresh && !resync {
+		return
+	}
+	// in background, so signals are still handled while API calls are retried; see gracefulShutdown()
+	reloadSyncs.Add(1)
+	go func() {
+		defer reloadSyncs.Done()
+		if refresh {
+			// not while workers act on hosts of the old inventory
+			log.Print("Refreshing Zabbix host inventory after configuration change")
+			reconcileMutex.Lock()
+			if refreshZabbixInventory() == nil {
+				log.Printf("Found %d matching hosts in Zabbix", zabbixInventory.len())
+			}
+			reconcileMutex.Unlock()
+		}
+		if resync && !isShuttingDown() {
+			initalizeHosts() // waits for events being handled
+		}
+	}()
+}
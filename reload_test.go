@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManagedGroups(t *testing.T) {
+	a := AutoScale{GroupName: "web", GroupNames: []string{"worker", "web", ""}}
+	if groups := a.managedGroups(); !reflect.DeepEqual(groups, []string{"web", "worker"}) {
+		t.Errorf("managedGroups() = %v, want [web worker]", groups)
+	}
+	if groups := (AutoScale{}).managedGroups(); len(groups) != 0 {
+		t.Errorf("managedGroups() of empty AutoScale = %v, want none", groups)
+	}
+}
+
+func TestConfigDiffHidesCredentials(t *testing.T) {
+	var oldConfig, newConfig AAZConfig
+	oldConfig.ZabbixConfig.Password = "old-secret"
+	oldConfig.ZabbixConfig.URL = "http://monitor-a.test"
+	newConfig.ZabbixConfig.Password = "new-secret"
+	newConfig.ZabbixConfig.URL = "http://monitor-b.test"
+
+	changes := configDiff(oldConfig, newConfig)
+	if len(changes) != 2 {
+		t.Fatalf("configDiff() = %v, want 2 changes", changes)
+	}
+	all := strings.Join(changes, "\n")
+	if strings.Contains(all, "secret") {
+		t.Errorf("configDiff() prints credentials: %v", changes)
+	}
+	if !strings.Contains(all, "ZabbixConfig.Password: (changed)") ||
+		!strings.Contains(all, "ZabbixConfig.URL: http://monitor-a.test -> http://monitor-b.test") {
+		t.Errorf("configDiff() = %v", changes)
+	}
+	if changes := configDiff(oldConfig, oldConfig); len(changes) != 0 {
+		t.Errorf("configDiff() of identical configs = %v, want none", changes)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	var running AAZConfig
+	running.ZabbixConfig.URL = "http://monitor-a.test"
+	setConfig(running, &hostACL{})
+
+	reloadConfig(filepath.Join(t.TempDir(), "missing.hcl"))
+	if url := currentConfig().ZabbixConfig.URL; url != running.ZabbixConfig.URL {
+		t.Errorf("configuration replaced by failed reload: ZabbixConfig.URL = %q", url)
+	}
+}
+
+func TestReloadSyncsInBackground(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa", "i-0old")
+	refreshZabbixInventory()
+	autoScaling.setGroup("web", "i-0aaa")
+	configFile := writeConfigFile(t, zabbix, autoScaling, ScaleDownActionDELETE)
+	config := currentConfig()
+	config.AutoScale.GroupName = "previous"
+	setConfig(config, currentACL())
+
+	// a sync holds reconcileMutex; the signal handler must not wait for it
+	reconcileMutex.Lock()
+	returned := make(chan struct{})
+	go func() {
+		reloadConfig(configFile)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Error("reloadConfig blocked by running sync")
+	}
+	reconcileMutex.Unlock()
+
+	if !waitTimeout(&reloadSyncs, 5*time.Second) {
+		t.Fatal("sync after reload did not complete")
+	}
+	if _, ok := zabbix.host("i-0old"); ok {
+		t.Error("no sync after AutoScale change")
+	}
+}
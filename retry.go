@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// retryPolicy is shared by all AWS and Zabbix API calls. Each attempt gets its
+// own deadline; only errors considered transient are retried, using
+// exponential backoff with jitter.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	callTimeout    time.Duration
+}
+
+// retryableError marks errors worth another attempt, e.g. throttling or HTTP 5xx.
+type retryableError struct {
+	err error
+}
+
+// decodeError is returned for API responses that cannot be decoded.
+type decodeError struct {
+	api string
+	err error
+}
+
+const (
+	DefaultRetryMaxAttempts     = 5
+	DefaultRetryInitialBackoff  = 1  // seconds
+	DefaultRetryMaxBackoff      = 30 // seconds
+	DefaultRetryCallTimeout     = 20 // seconds
+	DefaultRetryRequeueInterval = 60 // seconds
+)
+
+// actions that failed with retryable errors; retried by retryFailedActions()
+var failedActions = pendingActionSet{actions: map[string]time.Time{}}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+func (e decodeError) Error() string {
+	return fmt.Sprintf("Decoding %s response failed: %s", e.api, e.err)
+}
+
+func (e decodeError) Unwrap() error {
+	return e.err
+}
+
+func retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err}
+}
+
+func isRetryable(err error) bool {
+	// Transient errors: explicitly marked ones, timeouts, connection resets/refusals and truncated responses.
+	var marked retryableError
+	if errors.As(err, &marked) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, transient := range []error{context.DeadlineExceeded, syscall.ECONNRESET, syscall.ECONNREFUSED,
+		syscall.EPIPE, io.EOF, io.ErrUnexpectedEOF} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+func httpStatusError(resp *http.Response) error {
+	// Returns nil for HTTP 2xx; 429 and 5xx are retryable.
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := fmt.Errorf("HTTP %s", resp.Status)
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return retryable(err)
+	}
+	return err
+}
+
+func currentRetryPolicy() retryPolicy {
+	c := currentConfig().RetryConfig
+	policy := retryPolicy{
+		maxAttempts:    c.MaxAttempts,
+		initialBackoff: time.Duration(c.InitialBackoff) * time.Second,
+		maxBackoff:     time.Duration(c.MaxBackoff) * time.Second,
+		callTimeout:    time.Duration(c.CallTimeout) * time.Second,
+	}
+	if policy.maxAttempts <= 0 {
+		policy.maxAttempts = DefaultRetryMaxAttempts
+	}
+	if policy.initialBackoff <= 0 {
+		policy.initialBackoff = DefaultRetryInitialBackoff * time.Second
+	}
+	if policy.maxBackoff <= 0 {
+		policy.maxBackoff = DefaultRetryMaxBackoff * time.Second
+	}
+	if policy.callTimeout <= 0 {
+		policy.callTimeout = DefaultRetryCallTimeout * time.Second
+	}
+	return policy
+}
+
+func (p retryPolicy) do(what string, call func(ctx context.Context) error) error {
+	// Runs call until it succeeds, fails permanently or maxAttempts are used up.
+	// No further attempts are made once shutdown has started.
+	var err error
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), p.callTimeout)
+		err = call(ctx)
+		cancel()
+		if err == nil || !isRetryable(err) || attempt >= p.maxAttempts || isShuttingDown() {
+			return err
+		}
+		delay := p.backoff(attempt)
+		log.Printf("WARNING: %s failed (attempt %d/%d), retrying in %s: %s", what, attempt, p.maxAttempts, delay, err)
+		countWarning()
+		time.Sleep(delay)
+	}
+}
+
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	// Exponential backoff with "equal jitter": half fixed, half random.
+	delay := p.initialBackoff << uint(attempt-1)
+	if delay > p.maxBackoff || delay <= 0 {
+		delay = p.maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func requeueFailedAction(instanceId string, err error) {
+	// Keeps hosts whose action failed with a retryable error for retryFailedActions();
+	// permanent failures are only logged (and counted) by the failing call.
+	if !isRetryable(err) {
+		log.Printf("ERROR: Giving up on instance '%s': %s", instanceId, err)
+		return
+	}
+	log.Printf("Re-queued action for instance '%s'", instanceId)
+	failedActions.begin(instanceId)
+}
+
+func retryFailedActions() {
+	// Periodically retries actions that failed with retryable errors. Started as goroutine.
+	interval := time.Duration(currentConfig().RetryConfig.RequeueInterval) * time.Second
+	if interval <= 0 {
+		interval = DefaultRetryRequeueInterval * time.Second
+	}
+	for {
+		time.Sleep(interval)
+		instanceIds := failedActions.instanceIds()
+		if len(instanceIds) == 0 {
+			continue
+		}
+		if isShuttingDown() {
+			return
+		}
+		for _, instanceId := range instanceIds {
+			failedActions.done(instanceId)
+		}
+		log.Printf("Retrying failed actions for instances %s", instanceIds)
+		reconcileMutex.RLock()
+		unMonitorInstances(instanceIds, auditTrigger{Source: TriggerRequeue})
+		reconcileMutex.RUnlock()
+	}
+}
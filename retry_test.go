@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("Invalid params"), false},
+		{retryable(errors.New("HTTP 502 Bad Gateway")), true},
+		{fmt.Errorf("post: %w", syscall.ECONNRESET), true},
+		{fmt.Errorf("post: %w", context.DeadlineExceeded), true},
+		{io.ErrUnexpectedEOF, true},
+	}
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.retryable {
+			t.Errorf("isRetryable(%v) = %v, want %v", test.err, got, test.retryable)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 3, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond, callTimeout: time.Second}
+	attempts := 0
+	err := policy.do("test", func(ctx context.Context) error {
+		attempts++
+		return retryable(errors.New("throttled"))
+	})
+	if err == nil || attempts != 3 {
+		t.Errorf("expected 3 failed attempts, got %d (%v)", attempts, err)
+	}
+
+	attempts = 0
+	err = policy.do("test", func(ctx context.Context) error {
+		attempts++
+		return errors.New("permanent")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("permanent error retried: %d attempts", attempts)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{initialBackoff: time.Second, maxBackoff: 8 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		delay := policy.backoff(attempt + 1)
+		if delay < max/2 || delay > max {
+			t.Errorf("backoff(%d) = %s, want between %s and %s", attempt+1, delay, max/2, max)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration values may reference secrets instead of containing them:
+//   ${env:ZBX_PASS}            -- value of environment variable ZBX_PASS
+//   ${file:/run/secrets/zbx}   -- contents of file (trailing newline removed)
+//   ${exec:/usr/bin/pass zbx}  -- stdout of command (trailing newline removed)
+// References are resolved by loadConfig(), i.e. at startup and on reload.
+
+// redactingWriter replaces known secrets in log output.
+type redactingWriter struct {
+	out io.Writer
+}
+
+const (
+	SecretRedacted    = "[REDACTED]"
+	secretExecTimeout = 10 * time.Second
+	secretMinLength   = 4 // shorter values would garble log output when redacted
+)
+
+var secretReference = regexp.MustCompile(`^\$\{(env|file|exec):(.+)\}$`)
+
+// all secret values seen so far; kept after reload so old secrets stay redacted, too
+var knownSecrets = map[string]bool{}
+var knownSecretsMutex sync.RWMutex
+
+func resolveSecrets(c *AAZConfig) error {
+	// Replaces secret references in all string settings of c by their values.
+	// Resolved values and the credential settings are registered for redaction.
+	var errs []string
+	configValue := reflect.ValueOf(c).Elem()
+	for i := 0; i < configValue.NumField(); i++ {
+		block := configValue.Field(i)
+		blockName := configValue.Type().Field(i).Name
+		if block.Kind() == reflect.Slice {
+			// repeated blocks, e.g. Webhook "name" { ... }
+			for k := 0; k < block.Len(); k++ {
+				errs = append(errs, resolveBlockSecrets(block.Index(k), blockName+"."+block.Index(k).FieldByName("Name").String())...)
+			}
+			continue
+		}
+		errs = append(errs, resolveBlockSecrets(block, blockName)...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Cannot resolve secrets: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func resolveBlockSecrets(block reflect.Value, blockName string) []string {
+	var errs []string
+	for j := 0; j < block.NumField(); j++ {
+		field := block.Field(j)
+		name := blockName + "." + block.Type().Field(j).Name
+		switch field.Kind() {
+		case reflect.String:
+			value, isSecret, err := resolveSecret(field.String())
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+				continue
+			}
+			field.SetString(value)
+			if isSecret || isSecretSetting(name) {
+				registerSecret(value)
+			}
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				continue
+			}
+			for k := 0; k < field.Len(); k++ {
+				value, isSecret, err := resolveSecret(field.Index(k).String())
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+					continue
+				}
+				field.Index(k).SetString(value)
+				if isSecret {
+					registerSecret(value)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func resolveSecret(value string) (string, bool, error) {
+	// Returns the resolved value and whether value was a secret reference.
+	match := secretReference.FindStringSubmatch(value)
+	if match == nil {
+		return value, false, nil
+	}
+	source, reference := match[1], match[2]
+	switch source {
+	case "env":
+		secret, ok := os.LookupEnv(reference)
+		if !ok {
+			return "", true, fmt.Errorf("environment variable %s not set", reference)
+		}
+		return secret, true, nil
+	case "file":
+		secret, err := ioutil.ReadFile(reference)
+		if err != nil {
+			return "", true, err
+		}
+		return strings.TrimRight(string(secret), "\r\n"), true, nil
+	default:
+		secret, err := execSecretHelper(reference)
+		return secret, true, err
+	}
+}
+
+func execSecretHelper(commandLine string) (string, error) {
+	// Runs commandLine (no shell involved) and returns its stdout.
+	args := strings.Fields(commandLine)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty secret helper command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// don't include stdout; it may contain (parts of) the secret
+		return "", fmt.Errorf("secret helper %s failed: %s %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+func registerSecret(secret string) {
+	if len(secret) < secretMinLength {
+		return
+	}
+	knownSecretsMutex.Lock()
+	defer knownSecretsMutex.Unlock()
+	knownSecrets[secret] = true
+}
+
+func redactSecrets(text string) string {
+	knownSecretsMutex.RLock()
+	defer knownSecretsMutex.RUnlock()
+	for secret := range knownSecrets {
+		text = strings.Replace(text, secret, SecretRedacted, -1)
+	}
+	return text
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write([]byte(redactSecrets(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
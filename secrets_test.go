@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AAZ_TEST_SECRET", "from-env")
+	tests := []struct {
+		value    string
+		expected string
+		isSecret bool
+		fails    bool
+	}{
+		{"plain", "plain", false, false},
+		{"${unknown:x}", "${unknown:x}", false, false},
+		{"prefix ${env:AAZ_TEST_SECRET}", "prefix ${env:AAZ_TEST_SECRET}", false, false},
+		{"${env:AAZ_TEST_SECRET}", "from-env", true, false},
+		{"${env:AAZ_TEST_UNSET}", "", true, true},
+		{"${file:" + secretFile + "}", "from-file", true, false},
+		{"${file:/nonexistent/secret}", "", true, true},
+		{"${exec:echo from-exec}", "from-exec", true, false},
+		{"${exec:/nonexistent/helper}", "", true, true},
+		{"${exec:   }", "", true, true},
+		{"${exec:}", "${exec:}", false, false},
+	}
+	for _, test := range tests {
+		value, isSecret, err := resolveSecret(test.value)
+		if value != test.expected || isSecret != test.isSecret || (err != nil) != test.fails {
+			t.Errorf("resolveSecret(%q) = %q, %t, %v; want %q, %t, fails=%t",
+				test.value, value, isSecret, err, test.expected, test.isSecret, test.fails)
+		}
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	// only the secrets of this test; loading configurations registers others
+	knownSecretsMutex.Lock()
+	saved := knownSecrets
+	knownSecrets = map[string]bool{}
+	knownSecretsMutex.Unlock()
+	t.Cleanup(func() {
+		knownSecretsMutex.Lock()
+		knownSecrets = saved
+		knownSecretsMutex.Unlock()
+	})
+	registerSecret("s3cr3t-password")
+	registerSecret("abc") // too short to be redacted
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"no secret here", "no secret here"},
+		{"login with s3cr3t-password failed", "login with " + SecretRedacted + " failed"},
+		{"s3cr3t-password s3cr3t-password", SecretRedacted + " " + SecretRedacted},
+		{"abc stays", "abc stays"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		writer := &redactingWriter{out: &out}
+		n, err := writer.Write([]byte(test.line))
+		if err != nil || n != len(test.line) || out.String() != test.expected {
+			t.Errorf("Write(%q) wrote %q (%d, %v), want %q", test.line, out.String(), n, err, test.expected)
+		}
+	}
+}
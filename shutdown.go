@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// pendingActionSet tracks unMonitor actions that have been started but not completed yet.
+// Whatever is still pending on shutdown gets persisted to DaemonConfig.StateFile
+// and is resumed on next startup.
+type pendingActionSet struct {
+	mutex   sync.Mutex
+	actions map[string]time.Time // instanceId -> action start
+}
+
+const DefaultShutdownTimeout = 30 // seconds
+
+var pendingActions = pendingActionSet{actions: map[string]time.Time{}}
+var shuttingDown int32
+var shutdownRequested = make(chan os.Signal, 1)
+
+func (p *pendingActionSet) begin(instanceId string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.actions[instanceId] = time.Now()
+}
+
+func (p *pendingActionSet) done(instanceId string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.actions, instanceId)
+}
+
+func (p *pendingActionSet) since(instanceId string, age time.Duration) bool {
+	// true if instanceId was added within age; older entries are dropped.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for id, added := range p.actions {
+		if time.Since(added) >= age {
+			delete(p.actions, id)
+		}
+	}
+	_, ok := p.actions[instanceId]
+	return ok
+}
+
+func (p *pendingActionSet) instanceIds() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	result := []string{}
+	for instanceId := range p.actions {
+		result = append(result, instanceId)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func handleSignals() {
+	// Installs SIGHUP (reload) and SIGTERM/SIGINT handler; main() waits on shutdownRequested.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				reloadConfig(ConfigFile)
+				continue
+			}
+			log.Printf("Received %s -- shutting down", sig)
+			atomic.StoreInt32(&shuttingDown, 1)
+			shutdownRequested <- sig
+			return
+		}
+	}()
+}
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func gracefulShutdown(server *http.Server) {
+	// Stops accepting new notifications and waits (up to ShutdownTimeout) for
+	// in-flight requests and queued events to complete. Unfinished actions are
+	// persisted, then we log out of Zabbix.
+	sdNotify(SD_Stopping)
+	timeout := time.Duration(currentConfig().DaemonConfig.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	if server != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("WARNING: Draining SNS listener did not complete within %s: %s", timeout, err)
+		}
+	}
+	if workQueue != nil {
+		if remaining := workQueue.drain(time.Until(deadline)); len(remaining) > 0 {
+			log.Printf("WARNING: Draining event queue did not complete within %s: %d events left", timeout, len(remaining))
+			persistQueuedEvents(remaining)
+		}
+	}
+	if !waitTimeout(&reloadSyncs, time.Until(deadline)) {
+		log.Printf("WARNING: Sync after configuration reload did not complete within %s", timeout)
+	}
+	if !waitForWebhooks(time.Until(deadline)) {
+		log.Printf("WARNING: Webhook deliveries did not complete within %s", timeout)
+	}
+	savePendingActions()
+	zabbixLogout()
+	log.Print("Shutdown completed")
+}
+
+func savePendingActions() {
+	// Persists in-flight actions and those re-queued after failures.
+	instanceIds := pendingActions.instanceIds()
+	for _, instanceId := range failedActions.instanceIds() {
+		if !contains(instanceIds, instanceId) {
+			instanceIds = append(instanceIds, instanceId)
+		}
+	}
+	if len(instanceIds) == 0 {
+		return
+	}
+	stateFile := currentConfig().DaemonConfig.StateFile
+	if stateFile == "" {
+		log.Printf("WARNING: Unfinished actions for instances %s are lost (no DaemonConfig.StateFile defined)", instanceIds)
+		return
+	}
+	stateJSON, _ := json.Marshal(instanceIds)
+	if err := ioutil.WriteFile(stateFile, stateJSON, 0600); err != nil {
+		log.Printf("ERROR: Cannot persist unfinished actions for instances %s: %s", instanceIds, err)
+		return
+	}
+	log.Printf("Persisted unfinished actions for instances %s to %s", instanceIds, stateFile)
+}
+
+func resumePendingActions() {
+	// Re-runs unMonitorInstances for hosts persisted by savePendingActions() during last shutdown.
+	stateFile := currentConfig().DaemonConfig.StateFile
+	if stateFile == "" {
+		return
+	}
+	stateJSON, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Cannot read unfinished actions from %s: %s", stateFile, err)
+		countError()
+		return
+	}
+	var instanceIds []string
+	if err := json.Unmarshal(stateJSON, &instanceIds); err != nil {
+		log.Printf("ERROR: Decoding unfinished actions from %s failed: %s", stateFile, err)
+		countError()
+		return
+	}
+	if DryRun {
+		log.Printf("DRY-RUN: Would now resume unfinished actions for instances %s (kept in %s)", instanceIds, stateFile)
+		return
+	}
+	log.Printf("Resuming unfinished actions for instances %s", instanceIds)
+	reconcileMutex.RLock()
+	unMonitorInstances(instanceIds, auditTrigger{Source: TriggerResume})
+	reconcileMutex.RUnlock()
+
+	// state file is updated only now, so a crash while resuming loses nothing; actions failing
+	// again stay in it (and in failedActions, to be persisted on next shutdown)
+	var remaining []string
+	for _, instanceId := range failedActions.instanceIds() {
+		if contains(instanceIds, instanceId) {
+			remaining = append(remaining, instanceId)
+		}
+	}
+	if len(remaining) == 0 {
+		os.Remove(stateFile)
+		return
+	}
+	stateJSON, _ = json.Marshal(remaining)
+	if err := ioutil.WriteFile(stateFile, stateJSON, 0600); err != nil {
+		log.Printf("ERROR: Cannot persist unfinished actions for instances %s: %s", remaining, err)
+		countError()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeStateFile(t *testing.T, instanceIds ...string) string {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	stateJSON, _ := json.Marshal(instanceIds)
+	if err := os.WriteFile(stateFile, stateJSON, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := currentConfig()
+	config.DaemonConfig.StateFile = stateFile
+	setConfig(config, currentACL())
+	return stateFile
+}
+
+func readStateFile(t *testing.T, stateFile string) []string {
+	stateJSON, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	var instanceIds []string
+	if err := json.Unmarshal(stateJSON, &instanceIds); err != nil {
+		t.Fatal(err)
+	}
+	return instanceIds
+}
+
+func TestResumePendingActions(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa", "i-0bbb")
+	refreshZabbixInventory()
+	stateFile := writeStateFile(t, "i-0aaa", "i-0gone")
+	zabbix.failHTTP(JSONRPC_Method_DeleteHost, currentRetryPolicy().maxAttempts)
+
+	resumePendingActions()
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Fatal("host deleted despite failure")
+	}
+	if got := readStateFile(t, stateFile); !reflect.DeepEqual(got, []string{"i-0aaa"}) {
+		t.Errorf("got state file %v, want [i-0aaa]", got)
+	}
+
+	failedActions = pendingActionSet{actions: map[string]time.Time{}} // as on next startup
+	resumePendingActions()
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Error("host not deleted")
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("state file not removed: %v", err)
+	}
+}
+
+func TestResumePendingActionsDryRun(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+	stateFile := writeStateFile(t, "i-0aaa")
+	DryRun = true
+	t.Cleanup(func() { DryRun = false })
+
+	resumePendingActions()
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Error("host deleted in dry-run mode")
+	}
+	if got := readStateFile(t, stateFile); !reflect.DeepEqual(got, []string{"i-0aaa"}) {
+		t.Errorf("got state file %v, want [i-0aaa]", got)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, see
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+const (
+	SigV4_Algorithm  = "AWS4-HMAC-SHA256"
+	SigV4_DateFormat = "20060102T150405Z"
+	SigV4_Terminator = "aws4_request"
+)
+
+func signRequestV4(req *http.Request, body []byte, creds awsCredentials, region string, service string, now time.Time) {
+	// Adds X-Amz-Date (and X-Amz-Security-Token) and Authorization headers to req.
+	// All headers present in req are signed, plus Host.
+	amzDate := now.UTC().Format(SigV4_DateFormat)
+	dateStamp := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	canonicalHeaders, signedHeaders := sigV4CanonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		sigV4CanonicalURI(req.URL),
+		sigV4CanonicalQuery(req.URL.RawQuery),
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	credentialScope := strings.Join([]string{dateStamp, region, service, SigV4_Terminator}, "/")
+	stringToSign := strings.Join([]string{SigV4_Algorithm, amzDate, credentialScope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	signingKey := sigV4SigningKey(creds.SecretAccessKey, dateStamp, region, service)
+	signature := fmt.Sprintf("%x", hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		SigV4_Algorithm, creds.AccessKeyID, credentialScope, signedHeaders, signature))
+}
+
+func sigV4SigningKey(secret string, dateStamp string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), dateStamp)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, SigV4_Terminator)
+}
+
+func sigV4CanonicalURI(u *url.URL) string {
+	// URI-encodes each path segment; the path is not normalized (non-S3 services expect that, but we never send such paths).
+	path := u.Path
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsURIEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func sigV4CanonicalQuery(rawQuery string) string {
+	// Sorted by key (then value), keys and values URI-encoded.
+	if rawQuery == "" {
+		return ""
+	}
+	type param struct{ key, value string }
+	var params []param
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		keyValue := strings.SplitN(pair, "=", 2)
+		key, _ := url.QueryUnescape(keyValue[0])
+		value := ""
+		if len(keyValue) == 2 {
+			value, _ = url.QueryUnescape(keyValue[1])
+		}
+		params = append(params, param{awsURIEncode(key), awsURIEncode(value)})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].key != params[j].key {
+			return params[i].key < params[j].key
+		}
+		return params[i].value < params[j].value
+	})
+	var encoded []string
+	for _, p := range params {
+		encoded = append(encoded, p.key+"="+p.value)
+	}
+	return strings.Join(encoded, "&")
+}
+
+func sigV4CanonicalHeaders(req *http.Request) (string, string) {
+	// Returns canonical headers block (each line terminated by \n) and signed headers list.
+	headers := map[string]string{}
+	for name, values := range req.Header {
+		var trimmed []string
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers["host"] = host
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return canonical.String(), strings.Join(names, ";")
+}
+
+func awsURIEncode(s string) string {
+	// Percent-encodes everything but RFC 3986 unreserved characters.
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from the AWS Signature Version 4 test suite,
+// https://docs.aws.amazon.com/general/latest/gr/signature-v4-test-suite.html
+var sigV4TestCredentials = awsCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+var sigV4TestTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+func TestSignRequestV4TestSuite(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		headers       map[string]string
+		body          string
+		signedHeaders string
+		signature     string
+	}{
+		{"get-vanilla", "GET", "https://example.amazonaws.com/", nil, "",
+			"host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "GET", "https://example.amazonaws.com/?Param2=value2&Param1=value1", nil, "",
+			"host;x-amz-date", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"get-vanilla-empty-query-key", "GET", "https://example.amazonaws.com/?Param1=value1", nil, "",
+			"host;x-amz-date", "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb"},
+		{"get-vanilla-utf8-query", "GET", "https://example.amazonaws.com/?%E1%88%B4=bar", nil, "",
+			"host;x-amz-date", "2cdec8eed098649ff3a119c94853b13c643bcf08f8b0a1d91e12c9027818dd04"},
+		{"get-unreserved", "GET", "https://example.amazonaws.com/-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz", nil, "",
+			"host;x-amz-date", "07ef7494c76fa4850883e2b006601f940f8a34d404d0cfa977f52a65bbf5f24f"},
+		{"post-vanilla", "POST", "https://example.amazonaws.com/", nil, "",
+			"host;x-amz-date", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"post-vanilla-query", "POST", "https://example.amazonaws.com/?Param1=value1", nil, "",
+			"host;x-amz-date", "28038455d6de14eafc1f9222cf5aa6f1a96197d7deb8263271d420d138af7f11"},
+		{"post-header-key-sort", "POST", "https://example.amazonaws.com/", map[string]string{"My-Header1": "value1"}, "",
+			"host;my-header1;x-amz-date", "c5410059b04c1ee005303aed430f6e6645f61f4dc9e1461ec8f8916fdf18852c"},
+		{"post-x-www-form-urlencoded", "POST", "https://example.amazonaws.com/",
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "Param1=value1",
+			"content-type;host;x-amz-date", "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		signRequestV4(req, []byte(test.body), sigV4TestCredentials, "us-east-1", "service", sigV4TestTime)
+		expected := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=%s, Signature=%s", test.signedHeaders, test.signature)
+		if got := req.Header.Get("Authorization"); got != expected {
+			t.Errorf("%s:\n got: %s\nwant: %s", test.name, got, expected)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: X-Amz-Date is %s", test.name, got)
+		}
+	}
+}
+
+func TestSignRequestV4IAMExample(t *testing.T) {
+	// Example from "Examples of the complete Signature Version 4 signing process"
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signRequestV4(req, nil, sigV4TestCredentials, "us-east-1", "iam", sigV4TestTime)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("\n got: %s\nwant: %s", got, expected)
+	}
+}
+
+func TestSigV4SigningKey(t *testing.T) {
+	key := sigV4SigningKey(sigV4TestCredentials.SecretAccessKey, "20150830", "us-east-1", "iam")
+	expected := "c4afb1cc5771d871763a393e44b703571b55cc28424d1a5e86da6ed3c154a4b9"
+	if got := fmt.Sprintf("%x", key); got != expected {
+		t.Errorf("got %s, want %s", got, expected)
+	}
+}
+
+func TestSignRequestV4SessionToken(t *testing.T) {
+	creds := sigV4TestCredentials
+	creds.SessionToken = "token"
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signRequestV4(req, nil, creds, "us-east-1", "service", sigV4TestTime)
+	if req.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Error("X-Amz-Security-Token header missing")
+	}
+	if !strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("session token not signed: %s", req.Header.Get("Authorization"))
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// hostSnapshot is the definition of a Zabbix host saved before DELETING it; see restoreHost().
+type hostSnapshot struct {
+	Created    time.Time              `json:"created"`
+	InstanceId string                 `json:"instanceId"`
+	Host       map[string]interface{} `json:"host"` // host.get result, incl. interfaces, groups, templates, macros, tags and inventory
+}
+
+// https://www.zabbix.com/documentation/3.2/manual/api/reference/host/get
+type JSONRPC_GetHostSnapshotParams struct {
+	Output                string   `json:"output"`
+	HostIds               []string `json:"hostids"`
+	SelectInterfaces      string   `json:"selectInterfaces"`
+	SelectGroups          string   `json:"selectGroups"`
+	SelectParentTemplates []string `json:"selectParentTemplates"`
+	SelectMacros          string   `json:"selectMacros"`
+	SelectTags            string   `json:"selectTags"`
+	SelectInventory       string   `json:"selectInventory"`
+}
+
+// host properties copied by restoreHost(); others are read-only or set by Zabbix.
+// PSK settings cannot be read using the API, so hosts using PSK encryption need them set again.
+var snapshotHostFields = []string{"host", "name", "status", "description", "proxy_hostid", "inventory_mode",
+	"ipmi_authtype", "ipmi_privilege", "ipmi_username", "ipmi_password", "tls_connect", "tls_accept", "tls_issuer", "tls_subject"}
+var snapshotInterfaceFields = []string{"type", "main", "useip", "ip", "dns", "port", "bulk", "details"}
+var snapshotMacroFields = []string{"macro", "value", "description", "type"}
+var snapshotTagFields = []string{"tag", "value"}
+
+func snapshotPath(dir string, instanceId string) string {
+	return filepath.Join(dir, instanceId+".json")
+}
+
+func snapshotHosts(hosts []ZabbixHost) map[string]error {
+	// Saves the definition of hosts to ZabbixConfig.SnapshotDir, one file per instance.
+	// Returns an error per hostid not saved; empty if SnapshotDir is not set.
+	results := map[string]error{}
+	dir := currentConfig().ZabbixConfig.SnapshotDir
+	if dir == "" || len(hosts) == 0 {
+		return results
+	}
+	params := JSONRPC_GetHostSnapshotParams{Output: "extend", SelectInterfaces: "extend", SelectGroups: "extend",
+		SelectParentTemplates: []string{"templateid", "host"}, SelectMacros: "extend", SelectTags: "extend", SelectInventory: "extend"}
+	for _, host := range hosts {
+		params.HostIds = append(params.HostIds, host.HostId)
+	}
+	var definitions []map[string]interface{}
+	err := zabbixAPI(JSONRPC_Method_GetHost, params, &definitions)
+	byHostId := map[string]map[string]interface{}{}
+	for _, definition := range definitions {
+		if hostId, ok := definition["hostid"].(string); ok {
+			byHostId[hostId] = definition
+		}
+	}
+	for _, host := range hosts {
+		definition, ok := byHostId[host.HostId]
+		switch {
+		case err != nil:
+			results[host.HostId] = fmt.Errorf("cannot snapshot host: %w", err)
+		case !ok:
+			results[host.HostId] = fmt.Errorf("cannot snapshot host: %s returned no hostid %s", JSONRPC_Method_GetHost, host.HostId)
+		default:
+			results[host.HostId] = saveSnapshot(dir, hostSnapshot{Created: time.Now().UTC(), InstanceId: host.InstanceId, Host: definition})
+		}
+	}
+	return results
+}
+
+func saveSnapshot(dir string, snapshot hostSnapshot) error {
+	// Written to a temporary file first, so an existing snapshot is never left half-written.
+	path := snapshotPath(dir, snapshot.InstanceId)
+	snapshotJSON, _ := json.MarshalIndent(snapshot, "", "  ")
+	if err := ioutil.WriteFile(path+".tmp", snapshotJSON, 0600); err != nil {
+		return fmt.Errorf("cannot snapshot host: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("cannot snapshot host: %w", err)
+	}
+	log.Printf("Saved snapshot of Zabbix host '%s' to %s", snapshot.Host["host"], path)
+	return nil
+}
+
+func loadSnapshot(dir string, instanceId string) (hostSnapshot, error) {
+	var snapshot hostSnapshot
+	snapshotJSON, err := ioutil.ReadFile(snapshotPath(dir, instanceId))
+	if err != nil {
+		return snapshot, fmt.Errorf("cannot read snapshot of instance '%s': %s", instanceId, err)
+	}
+	if err := json.Unmarshal(snapshotJSON, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("cannot decode snapshot of instance '%s': %s", instanceId, err)
+	}
+	return snapshot, nil
+}
+
+func (s hostSnapshot) createParams() map[string]interface{} {
+	// host.create parameters recreating the host; ids of interfaces, macros etc. are assigned anew.
+	params := pickFields(s.Host, snapshotHostFields)
+	params["interfaces"] = pickEach(s.Host["interfaces"], snapshotInterfaceFields)
+	params["groups"] = pickEach(s.Host["groups"], []string{"groupid"})
+	params["templates"] = pickEach(s.Host["parentTemplates"], []string{"templateid"})
+	params["macros"] = pickEach(s.Host["macros"], snapshotMacroFields)
+	params["tags"] = pickEach(s.Host["tags"], snapshotTagFields)
+	// Zabbix returns an empty array if inventory is disabled
+	if inventory, ok := s.Host["inventory"].(map[string]interface{}); ok {
+		fields := map[string]interface{}{}
+		for name, value := range inventory {
+			if name != "hostid" && name != "inventory_mode" && value != "" {
+				fields[name] = value
+			}
+		}
+		params["inventory"] = fields
+	}
+	return params
+}
+
+func pickFields(object map[string]interface{}, fields []string) map[string]interface{} {
+	picked := map[string]interface{}{}
+	for _, field := range fields {
+		if value, ok := object[field]; ok {
+			picked[field] = value
+		}
+	}
+	return picked
+}
+
+func pickEach(list interface{}, fields []string) []map[string]interface{} {
+	picked := []map[string]interface{}{}
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		if object, ok := item.(map[string]interface{}); ok {
+			picked = append(picked, pickFields(object, fields))
+		}
+	}
+	return picked
+}
+
+func restoreHost(instanceId string) error {
+	// Recreates the Zabbix host of instanceId from its snapshot -- without history, which is lost by DELETE.
+	dir := currentConfig().ZabbixConfig.SnapshotDir
+	if dir == "" {
+		return fmt.Errorf("no ZabbixConfig.SnapshotDir defined")
+	}
+	snapshot, err := loadSnapshot(dir, instanceId)
+	if err != nil {
+		return err
+	}
+	audit := auditEntry{Action: AuditActionCreate, InstanceId: instanceId, Trigger: cliTrigger(TriggerRestore, ""), Result: AuditSuccess}
+	params := snapshot.createParams()
+	if DryRun {
+		paramsJSON, _ := json.Marshal(params)
+		log.Printf("DRY-RUN: Would now create Zabbix host '%s' from snapshot of %s: %s", params["host"], snapshot.Created, paramsJSON)
+		audit.Result = AuditDryRun
+		auditRecord(audit)
+		return nil
+	}
+	var result JSONRPC_HostIdsResult
+	if err := zabbixAPI(JSONRPC_Method_CreateHost, params, &result); err != nil {
+		audit.Result, audit.Error = AuditFailed, err.Error()
+		auditRecord(audit)
+		return fmt.Errorf("cannot restore Zabbix host '%s': %s", params["host"], err)
+	}
+	auditRecord(audit)
+	log.Printf("SUCCESS: Restored Zabbix host '%s' (hostid %v) from snapshot of %s", params["host"], result.HostIds, snapshot.Created)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func setSnapshotDir(t *testing.T) string {
+	dir := t.TempDir()
+	config := currentConfig()
+	config.ZabbixConfig.SnapshotDir = dir
+	setConfig(config, currentACL())
+	return dir
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	dir := setSnapshotDir(t)
+	setAudit(t, AuditConfig{})
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	if _, ok := zabbix.host("i-0aaa"); ok {
+		t.Fatal("host not deleted")
+	}
+	snapshot, err := loadSnapshot(dir, "i-0aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.InstanceId != "i-0aaa" || snapshot.Host["host"] != "i-0aaa" {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	if err := restoreHost("i-0aaa"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Fatal("host not restored")
+	}
+	want := map[string]interface{}{
+		"host":           "i-0aaa",
+		"status":         "0",
+		"inventory_mode": "0",
+		"interfaces": []interface{}{map[string]interface{}{"type": "1", "main": "1", "useip": "1", "ip": "10.0.0.1",
+			"dns": "", "port": "10050"}},
+		"groups":    []interface{}{map[string]interface{}{"groupid": "2"}},
+		"templates": []interface{}{map[string]interface{}{"templateid": "10001"}},
+		"macros":    []interface{}{map[string]interface{}{"macro": "{$ROLE}", "value": "web"}},
+		"tags":      []interface{}{map[string]interface{}{"tag": "env", "value": "prod"}},
+		"inventory": map[string]interface{}{"os": "Linux"},
+	}
+	if len(zabbix.created) != 1 || !reflect.DeepEqual(zabbix.created[0], want) {
+		t.Errorf("got host.create params %v, want %v", zabbix.created, want)
+	}
+	entries := auditEntries(t, func(entry auditEntry) bool { return entry.Action == AuditActionCreate })
+	if len(entries) != 1 || entries[0].Trigger.Source != TriggerRestore || entries[0].Result != AuditSuccess {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+
+	if err := restoreHost("i-0aaa"); err == nil {
+		t.Error("host restored twice")
+	}
+	if err := restoreHost("i-0unknown"); err == nil {
+		t.Error("host restored without snapshot")
+	}
+}
+
+func TestSnapshotFailurePreventsDelete(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDELETE)
+	zabbix.addHosts("i-0aaa")
+	refreshZabbixInventory()
+	dir := setSnapshotDir(t)
+	zabbix.failHTTP(JSONRPC_Method_GetHost, currentRetryPolicy().maxAttempts)
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	if _, ok := zabbix.host("i-0aaa"); !ok {
+		t.Error("host deleted without snapshot")
+	}
+	if _, err := os.Stat(snapshotPath(dir, "i-0aaa")); !os.IsNotExist(err) {
+		t.Errorf("unexpected snapshot: %v", err)
+	}
+	if ids := failedActions.instanceIds(); len(ids) != 1 || ids[0] != "i-0aaa" {
+		t.Errorf("got failed actions %v, want [i-0aaa]", ids)
+	}
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"regexp"
 )
 
 type SNS_Notification struct {
 	Type         string `json:"Type"`
+	MessageId    string `json:"MessageId"`
 	Message      string `json:"Message"`
 	SubscribeURL string `json:"SubscribeURL"`
 }
@@ -19,105 +20,170 @@ type SNS_Message struct {
 	Event                string `json:"Event"`
 	EC2InstanceId        string `json:"EC2InstanceId"`
 	AutoScalingGroupName string `json:"AutoScalingGroupName"`
+	StatusMessage        string `json:"StatusMessage"` // error events: reason of failure
+	Cause                string `json:"Cause"`
 }
 
 const (
 	SNS_EV_Terminate      = "autoscaling:EC2_INSTANCE_TERMINATE"
+	SNS_EV_TerminateError = "autoscaling:EC2_INSTANCE_TERMINATE_ERROR"
+	SNS_EV_Launch         = "autoscaling:EC2_INSTANCE_LAUNCH"
+	SNS_EV_LaunchError    = "autoscaling:EC2_INSTANCE_LAUNCH_ERROR"
+	SNS_EV_Test           = "autoscaling:TEST_NOTIFICATION"
 	SNS_Type_Notification = "Notification"
 	SNS_Type_Subscription = "SubscriptionConfirmation"
 )
 
-func startSNSListener() {
+func startSNSListener() *http.Server {
+	// Binds the listener and serves SNS notifications in background.
+	// Use server.Shutdown() to stop it.
 	var err error
-	log.Printf("Now listening for SNS notifications on %s (TLS:%t)", Config.ListenerConfig.Address, useTLS)
+	config := currentConfig()
 	http.HandleFunc("/", snsHandler)
 	http.HandleFunc("/status", statusHandler)
-	if useTLS {
-		err = http.ListenAndServeTLS(Config.ListenerConfig.Address,
-			Config.ListenerConfig.TLS_CertPath, Config.ListenerConfig.TLS_CertKey, nil)
-	} else {
-		err = http.ListenAndServe(Config.ListenerConfig.Address, nil)
+	http.HandleFunc("/audit", auditHandler)
+	server := &http.Server{Addr: config.ListenerConfig.Address}
+	if config.useTLS() {
+		tlsConfig, err := buildTLSConfig(config.ListenerConfig)
+		if err != nil {
+			log.Fatalf("FATAL: Invalid TLS configuration: %s", err)
+		}
+		// TLS settings are looked up per connection, so they can be changed by reloadConfig()
+		setTLSConfig(tlsConfig)
+		server.TLSConfig = &tls.Config{GetConfigForClient: getTLSConfigForClient}
 	}
+	listener, err := net.Listen("tcp", config.ListenerConfig.Address)
 	if err != nil {
 		log.Fatalf("FATAL: Cannot start SNS listener: %s", err)
 	}
+	log.Printf("Now listening for SNS notifications on %s (TLS:%t)", config.ListenerConfig.Address, config.useTLS())
+	go func() {
+		if config.useTLS() {
+			// certificates are provided by TLSConfig.GetConfigForClient
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("FATAL: SNS listener failed: %s", err)
+		}
+	}()
+	return server
 }
 
 func snsHandler(w http.ResponseWriter, request *http.Request) {
-	// Parses and handles received SNS messages.
-	if !hostIsAllowed(request.RemoteAddr) {
+	// Parses and handles received SNS notifications, SQS messages and EventBridge events.
+	if !hostIsAllowed(request) {
 		http.Error(w, "Not authorized", 401)
-		log.Printf("WARNING: Denied SNS request (401) from %s", request.RemoteAddr)
-		serverStatus.Warnings = serverStatus.Warnings + 1
+		log.Printf("WARNING: Denied SNS request (401) from %s", currentACL().clientIP(request))
+		countWarning()
+		return
+	}
+	if isShuttingDown() {
+		// SNS will retry delivery later
+		http.Error(w, "Shutting down", 503)
 		return
 	}
 	// todo: sanity-check request content-length
 	log.Printf("%s %s %s", request.Host, request.Method, request.URL.EscapedPath()) // todo: -verbose flag?
 	bodyBytes, err := ioutil.ReadAll(request.Body)
 	if err != nil {
-		log.Print("ERROR: Failed to read request Body: %s", err)
-		serverStatus.Errors = serverStatus.Errors + 1
+		log.Printf("ERROR: Failed to read request Body: %s", err)
+		countError()
 		return
 	}
 	//body := string(bodyBytes); log.Print(body);// todo: -debug flag?
 
-	// unmarshal whole notification
-	var notification SNS_Notification
-	err = json.Unmarshal(bodyBytes, &notification)
+	// SNS notifications, SQS message batches and EventBridge events all end up as aazEvents
+	events, err := decodeEvents(bodyBytes)
 	if err != nil {
-		log.Printf("ERROR: Decoding JSON notification failed: %s", err)
-		serverStatus.Errors = serverStatus.Errors + 1
+		log.Printf("ERROR: %s", err)
+		countError()
+		if len(events) == 0 {
+			http.Error(w, "Cannot decode event", 400)
+			return
+		}
+	}
+	client := auditClient(request)
+	for i := range events {
+		events[i].Client = client
+	}
+	// handled by workers; if the queue is full, SNS/SQS will deliver again later
+	if !workQueue.push(events...) {
+		log.Printf("WARNING: Event queue full, refusing %d events", len(events))
+		countWarning()
+		http.Error(w, "Queue full", 503)
+	}
+}
+
+func handleEvent(event aazEvent) {
+	// Acts on a single event, whatever its source.
+	reconcileMutex.RLock()
+	defer reconcileMutex.RUnlock()
+	if event.Event == SNS_Type_Subscription {
+		log.Printf("NOTICE: Subscription confirmation message received. Visit: %s", event.SubscribeURL)
 		return
 	}
-	if notification.Type == SNS_Type_Subscription {
-		log.Printf("NOTICE: Subscription confirmation message received. Visit: %s", notification.SubscribeURL)
+	if event.Event == SNS_EV_Test || event.Event == SNS_EV_LaunchError || event.Event == SNS_EV_TerminateError {
+		handleGroupEvent(event)
 		return
 	}
-	if notification.Type != SNS_Type_Notification {
-		log.Printf("ERROR: Invalid notification type received: '%s'", notification.Type)
-		serverStatus.Errors = serverStatus.Errors + 1
+	if event.Event == EventBridge_EC2StateChange || event.Event == EventBridge_SpotInterruption {
+		handleEC2Event(event)
 		return
 	}
-
-	// unescape/unmarshal/sanity check json message contained in notification
-	var message SNS_Message
-	err = json.Unmarshal([]byte(notification.Message), &message)
-	if err != nil {
-		log.Printf("ERROR: Decoding JSON message failed: %s", err)
-		serverStatus.Errors = serverStatus.Errors + 1
+	if event.Event == SNS_EV_Launch && contains(currentConfig().AutoScale.managedGroups(), event.AutoScalingGroupName) {
+		// instances may be launched anew, or return from Standby or be re-attached;
+		// remembered so EC2 events resolve their ASG once AWS no longer lists them
+		rememberASGMembers([]AWS_AutoScalingInstance{{InstanceId: event.InstanceId, AutoScalingGroupName: event.AutoScalingGroupName}})
+		log.Printf("Received %s launch event for instance '%s' via %s", event.Source, event.InstanceId, event.Via)
+		enableInstance(event.InstanceId, eventTrigger(event))
+		enrichInstance(event.InstanceId, event.AutoScalingGroupName, eventTrigger(event))
+		countNotification()
 		return
 	}
-	if message.Event != SNS_EV_Terminate {
-		log.Printf("NOTICE: Received non-termination event '%s' (ignored)", message.Event)
+	if event.Event != SNS_EV_Terminate {
+		log.Printf("NOTICE: Received non-termination event '%s' via %s (ignored)", event.Event, event.Via)
 		return
 	}
-	if message.AutoScalingGroupName != Config.AutoScale.GroupName {
-		log.Printf("NOTICE: Received message for other ASG '%s' (ignored)", message.AutoScalingGroupName)
+	if !contains(currentConfig().AutoScale.managedGroups(), event.AutoScalingGroupName) {
+		log.Printf("NOTICE: Received message for other ASG '%s' (ignored)", event.AutoScalingGroupName)
 		return
 	}
 
-	// finally unMonitor host reported in this notification ...
-	unMonitorHost(message.EC2InstanceId)
-	// ... and update serverStatus accordingly
-	serverStatus.Notifications = serverStatus.Notifications + 1
+	// finally unMonitor host reported in this event (hooks get to know its ASG) ...
+	rememberASGMembers([]AWS_AutoScalingInstance{{InstanceId: event.InstanceId, AutoScalingGroupName: event.AutoScalingGroupName}})
+	log.Printf("Received %s event for instance '%s' via %s", event.Source, event.InstanceId, event.Via)
+	unMonitorInstance(event.InstanceId, eventTrigger(event))
+	// ... and count it in serverStatus
+	countNotification()
 }
 
 func statusHandler(w http.ResponseWriter, request *http.Request) {
 	// provide simple server status (errors, warnings, notifications processed,...)
-	if !hostIsAllowed(request.RemoteAddr) {
+	if !hostIsAllowed(request) {
 		http.Error(w, "Not authorized", 401)
-		log.Printf("WARNING: Denied status request (401) from %s", request.RemoteAddr)
-		serverStatus.Warnings = serverStatus.Warnings + 1
+		log.Printf("WARNING: Denied status request (401) from %s", currentACL().clientIP(request))
+		countWarning()
+		return
+	}
+	if !clientCertVerified(request) {
+		http.Error(w, "Client certificate required", 403)
+		log.Printf("WARNING: Denied status request (403, no client certificate) from %s", currentACL().clientIP(request))
+		countWarning()
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	serverStatus.ZabbixHosts = len(zabbixHostMap)
-	myJSON, _ := json.Marshal(serverStatus)
+	status := statusSnapshot()
+	status.ZabbixHosts = zabbixInventory.len()
+	if workQueue != nil {
+		status.Queue = workQueue.status()
+	}
+	myJSON, _ := json.Marshal(status)
 	w.Write(myJSON)
 }
 
-func hostIsAllowed(remote string) bool {
-	clientIP, _, _ := net.SplitHostPort(remote)
-	matched, _ := regexp.MatchString(Config.ListenerConfig.HostsAllow, clientIP)
-	return matched
+func hostIsAllowed(request *http.Request) bool {
+	acl := currentACL()
+	return acl.allows(acl.clientIP(request))
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Minimal sd_notify(3) implementation, see
+// https://www.freedesktop.org/software/systemd/man/sd_notify.html
+const (
+	SD_Ready    = "READY=1"
+	SD_Stopping = "STOPPING=1"
+	SD_Watchdog = "WATCHDOG=1"
+)
+
+func sdNotify(state string) bool {
+	// Sends state to systemd if running as Type=notify service. Returns false if not supported.
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false
+	}
+	if socketPath[0] == '@' {
+		// abstract namespace socket
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		log.Printf("WARNING: sd_notify failed: %s", err)
+		return false
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("WARNING: sd_notify failed: %s", err)
+		return false
+	}
+	return true
+}
+
+func sdWatchdogInterval() time.Duration {
+	// Returns the interval we should ping the systemd watchdog at, or 0 if disabled.
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+func sdWatchdog() {
+	// Keeps systemd's watchdog happy while we're running. Started as goroutine.
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Printf("systemd watchdog enabled, pinging every %s", interval)
+	for {
+		sdNotify(SD_Watchdog)
+		time.Sleep(interval)
+	}
+}
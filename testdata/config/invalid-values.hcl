@@ -0,0 +1,23 @@
+ListenerConfig {
+  Address = "8080"
+  AllowedNetworks = ["192.168.0.0/33"]
+}
+AutoScale {
+  GroupName = "web"
+  Region = "Frankfurt"
+}
+ZabbixConfig {
+  URL = "zabbix.example.com"
+  User = "Admin"
+  ScaleDownAction = "REMOVE"
+  RestrictToGroupId = 2
+  BatchSize = -1
+}
+RetryConfig {
+  InitialBackoff = 10
+  MaxBackoff = 5
+}
+Webhook "ops" {
+  URL = "https://hooks.example.com/aaz"
+  Events = ["everything"]
+}
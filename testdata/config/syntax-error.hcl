@@ -0,0 +1,3 @@
+ZabbixConfig {
+  URL = "http://zabbix/api_jsonrpc.php"
+  User = "Admin"
@@ -0,0 +1,19 @@
+ListenerConfig {
+  Address = ":8080"
+  AllowedNetworks = ["192.168.0.0/16"]
+}
+AutoScale {
+  GroupName = "web"
+  Region = "eu-west-1"
+}
+ZabbixConfig {
+  URL = "http://zabbix.example.com/api_jsonrpc.php"
+  User = "Admin"
+  Password = "zabbix"
+  ScaleDownAction = "DELETE"
+  RestrictToGroupId = 2
+}
+Webhook "ops" {
+  URL = "https://hooks.example.com/aaz"
+  Events = ["action", "failure"]
+}
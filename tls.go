@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloader serves the listener's certificate and re-reads cert/key from
+// disk whenever their modification time changes, so certificates can be
+// rotated without restarting AAZ.
+type certReloader struct {
+	certPath  string
+	keyPath   string
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	certMtime time.Time
+	keyMtime  time.Time
+	lastCheck time.Time
+}
+
+var certReloadCheckInterval = 10 * time.Second
+
+// TLS configuration used for new connections; replaced on configuration reload
+var listenerTLSConfig *tls.Config
+var listenerTLSMutex sync.RWMutex
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	reloader := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (cr *certReloader) reload() error {
+	certInfo, err := os.Stat(cr.certPath)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.certMtime = certInfo.ModTime()
+	cr.keyMtime = keyInfo.ModTime()
+	return nil
+}
+
+func (cr *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// Checks (at most every certReloadCheckInterval) whether cert or key changed on disk.
+	// A broken new cert/key pair is logged, the previous certificate stays in use.
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if time.Since(cr.lastCheck) < certReloadCheckInterval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = time.Now()
+	certInfo, certErr := os.Stat(cr.certPath)
+	keyInfo, keyErr := os.Stat(cr.keyPath)
+	if certErr != nil || keyErr != nil {
+		return cr.cert, nil
+	}
+	if certInfo.ModTime().Equal(cr.certMtime) && keyInfo.ModTime().Equal(cr.keyMtime) {
+		return cr.cert, nil
+	}
+	if err := cr.reload(); err != nil {
+		log.Printf("ERROR: Reloading TLS certificate %s failed, keeping previous one: %s", cr.certPath, err)
+		countError()
+		return cr.cert, nil
+	}
+	log.Printf("NOTICE: Reloaded TLS certificate %s", cr.certPath)
+	return cr.cert, nil
+}
+
+func buildTLSConfig(c ListenerConfig) (*tls.Config, error) {
+	// Builds the listener's TLS configuration: minimum version, cipher suites,
+	// hot-reloading server certificate and optional client certificate verification.
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLS_MinVersion != "" {
+		version, ok := tlsVersions[c.TLS_MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS_MinVersion '%s' (use 1.0, 1.1, 1.2 or 1.3)", c.TLS_MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(c.TLS_CipherSuites) > 0 {
+		suites, err := parseCipherSuites(c.TLS_CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
+	reloader, err := newCertReloader(c.TLS_CertPath, c.TLS_CertKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %s", err)
+	}
+	tlsConfig.GetCertificate = reloader.getCertificate
+	if c.TLS_ClientCA != "" {
+		caBundle, err := ioutil.ReadFile(c.TLS_ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read TLS_ClientCA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in TLS_ClientCA %s", c.TLS_ClientCA)
+		}
+		// SNS cannot present client certificates, so only verify them if given;
+		// endpoints requiring them check via clientCertVerified().
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+func setTLSConfig(tlsConfig *tls.Config) {
+	listenerTLSMutex.Lock()
+	defer listenerTLSMutex.Unlock()
+	listenerTLSConfig = tlsConfig
+}
+
+func getTLSConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	listenerTLSMutex.RLock()
+	defer listenerTLSMutex.RUnlock()
+	return listenerTLSConfig, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	// Maps cipher suite names as used by Go's crypto/tls (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) to IDs.
+	// Note that Go does not allow configuring TLS 1.3 cipher suites.
+	available := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+	var result []uint16
+	for _, name := range names {
+		id, ok := available[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite '%s'", name)
+		}
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+func clientCertVerified(request *http.Request) bool {
+	// True if no client CA is configured or the client presented a certificate signed by it.
+	if currentConfig().ListenerConfig.TLS_ClientCA == "" {
+		return true
+	}
+	return request.TLS != nil && len(request.TLS.VerifiedChains) > 0
+}
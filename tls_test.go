@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a key pair signed by parent (self-signed if parent is nil).
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, name string, serial int64, isCA bool, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: name}, DNSNames: []string{name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return testCert{cert: cert, key: key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})}
+}
+
+func (c testCert) write(t *testing.T, dir string, mtime time.Time) (string, string) {
+	certPath, keyPath := filepath.Join(dir, "aaz.cert"), filepath.Join(dir, "aaz.key")
+	for path, contents := range map[string][]byte{certPath: c.certPEM, keyPath: c.keyPEM} {
+		if err := os.WriteFile(path, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	return certPath, keyPath
+}
+
+func startTLSListener(t *testing.T, c ListenerConfig) *httptest.Server {
+	// Serves /status like startSNSListener() does, using TLS configuration c.
+	tlsConfig, err := buildTLSConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTLSConfig(tlsConfig)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{GetConfigForClient: getTLSConfigForClient}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func servedSerial(t *testing.T, server *httptest.Server) int64 {
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertReloadServesNewCertificate(t *testing.T) {
+	saved := certReloadCheckInterval
+	certReloadCheckInterval = 100 * time.Millisecond
+	t.Cleanup(func() { certReloadCheckInterval = saved })
+	setupFakes(t, ScaleDownActionDELETE)
+	dir := t.TempDir()
+	certPath, keyPath := newTestCert(t, "localhost", 1, false, nil).write(t, dir, time.Now().Add(-time.Minute))
+	server := startTLSListener(t, ListenerConfig{TLS_CertPath: certPath, TLS_CertKey: keyPath})
+	if serial := servedSerial(t, server); serial != 1 {
+		t.Fatalf("got certificate %d, want 1", serial)
+	}
+
+	newTestCert(t, "localhost", 2, false, nil).write(t, dir, time.Now())
+	time.Sleep(certReloadCheckInterval)
+	if serial := servedSerial(t, server); serial != 2 {
+		t.Errorf("got certificate %d after reload interval, want 2", serial)
+	}
+
+	// a broken pair keeps the previous certificate
+	os.WriteFile(keyPath, []byte("garbage"), 0600)
+	os.Chtimes(keyPath, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	time.Sleep(certReloadCheckInterval)
+	if serial := servedSerial(t, server); serial != 2 {
+		t.Errorf("got certificate %d after broken reload, want 2", serial)
+	}
+	if statusSnapshot().Errors != 1 {
+		t.Errorf("broken certificate not counted as error: %+v", statusSnapshot())
+	}
+}
+
+func TestStatusRequiresClientCertificate(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	dir := t.TempDir()
+	ca := newTestCert(t, "AAZ admin CA", 10, true, nil)
+	caPath := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caPath, ca.certPEM, 0600)
+	certPath, keyPath := newTestCert(t, "localhost", 1, false, nil).write(t, dir, time.Now())
+	listenerConfig := ListenerConfig{TLS_CertPath: certPath, TLS_CertKey: keyPath, TLS_ClientCA: caPath}
+	config := currentConfig()
+	config.ListenerConfig = listenerConfig
+	setConfig(config, currentACL())
+	server := startTLSListener(t, listenerConfig)
+
+	admin := newTestCert(t, "admin", 11, false, &ca)
+	adminPair, _ := tls.X509KeyPair(admin.certPEM, admin.keyPEM)
+	stranger := newTestCert(t, "stranger", 12, false, nil)
+	strangerPair, _ := tls.X509KeyPair(stranger.certPEM, stranger.keyPEM)
+	tests := []struct {
+		name     string
+		certs    []tls.Certificate
+		expected int
+	}{
+		{"no client certificate", nil, http.StatusForbidden},
+		{"certificate signed by client CA", []tls.Certificate{adminPair}, http.StatusOK},
+		{"certificate of another CA", []tls.Certificate{strangerPair}, http.StatusForbidden}, // not even sent
+	}
+	for _, test := range tests {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: test.certs}}}
+		resp, err := client.Get(server.URL + "/status")
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Errorf("%s: got HTTP %d, want %d", test.name, resp.StatusCode, test.expected)
+		}
+	}
+}
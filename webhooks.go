@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// aazNotification is sent to the Webhooks configured, rendered as per WebhookConfig.Format.
+type aazNotification struct {
+	Time                 time.Time `json:"time"`
+	Event                string    `json:"event"`            // Notify* constant
+	Action               string    `json:"action,omitempty"` // DELETE, DISABLE, ENABLE or MAINTENANCE
+	Host                 string    `json:"host,omitempty"`
+	HostId               string    `json:"hostId,omitempty"`
+	InstanceId           string    `json:"instanceId,omitempty"`
+	AutoScalingGroupName string    `json:"autoScalingGroupName,omitempty"`
+	Changed              int       `json:"changed,omitempty"` // sync only: hosts changed
+	Failed               int       `json:"failed,omitempty"`  // sync only: hosts failing to change
+	Error                string    `json:"error,omitempty"`
+	Message              string    `json:"message"` // human readable summary
+}
+
+const (
+	NotifyAction      = "action"       // host deleted, disabled, enabled again or put into maintenance
+	NotifyFailure     = "failure"      // such an action failed
+	NotifySafetyLimit = "safety-limit" // sync refused to act on implausible ASG data (ErrASGMissing/ErrASGEmpty)
+	NotifySync        = "sync"         // summary of a sync
+	NotifyASGError    = "asg-error"    // ASG launch/terminate error event, see handleGroupEvent()
+
+	WebhookFormatJSON  = "json"
+	WebhookFormatSlack = "slack"
+	WebhookFormatTeams = "teams"
+
+	WebhookSignatureHeader = "X-AAZ-Signature" // "sha256=" + hex HMAC-SHA256 of the body, keyed by Secret
+)
+
+var NotifyEvents = []string{NotifyAction, NotifyFailure, NotifySafetyLimit, NotifySync, NotifyASGError}
+var WebhookFormats = []string{WebhookFormatJSON, WebhookFormatSlack, WebhookFormatTeams}
+
+var webhookHTTPClient = &http.Client{}
+
+// deliveries in progress; see waitForWebhooks()
+var webhookDeliveries sync.WaitGroup
+
+func notify(notification aazNotification) {
+	// Sends notification to all webhooks subscribed to its event, in background.
+	notification.Time = time.Now().UTC()
+	for _, webhook := range currentConfig().Webhooks {
+		if len(webhook.Events) > 0 && !contains(webhook.Events, notification.Event) {
+			continue
+		}
+		webhookDeliveries.Add(1)
+		go func(webhook WebhookConfig) {
+			defer webhookDeliveries.Done()
+			if err := webhook.send(notification); err != nil {
+				log.Printf("ERROR: Webhook '%s' failed for %s notification: %s", webhook.Name, notification.Event, err)
+				countError()
+			}
+		}(webhook)
+	}
+}
+
+func notifySyncSummary(plan syncPlan, changed int, failed int) {
+	notify(aazNotification{Event: NotifySync, Changed: changed, Failed: failed,
+		Message: fmt.Sprintf("AAZ sync completed: %d of %d host(s) changed, %d failed", changed, len(plan.Steps), failed)})
+}
+
+func waitForWebhooks(timeout time.Duration) bool {
+	// Waits for deliveries in progress; false if they did not complete within timeout.
+	return waitTimeout(&webhookDeliveries, timeout)
+}
+
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (w WebhookConfig) send(notification aazNotification) error {
+	body, err := w.render(notification)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{}
+	if w.Secret != "" {
+		headers[WebhookSignatureHeader] = "sha256=" + webhookSignature(w.Secret, body)
+	}
+	return postWebhook(w.Name, w.URL, body, headers)
+}
+
+func (w WebhookConfig) render(notification aazNotification) ([]byte, error) {
+	// Builds the request body: Slack and Teams get a message, others the notification as JSON or Template.
+	switch w.Format {
+	case WebhookFormatSlack:
+		return json.Marshal(map[string]string{"text": notification.Message})
+	case WebhookFormatTeams:
+		// https://learn.microsoft.com/en-us/outlook/actionable-messages/message-card-reference
+		color := "2EB886"
+		if notification.Event != NotifyAction && notification.Event != NotifySync {
+			color = "D40E0D"
+		}
+		return json.Marshal(map[string]string{"@type": "MessageCard", "@context": "http://schema.org/extensions",
+			"themeColor": color, "summary": notification.Message, "title": "AAZ " + notification.Event, "text": notification.Message})
+	}
+	if w.Template == "" {
+		return json.Marshal(notification)
+	}
+	tmpl, err := parseWebhookTemplate(w.Template)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, notification); err != nil {
+		return nil, fmt.Errorf("rendering Template failed: %s", err)
+	}
+	return body.Bytes(), nil
+}
+
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	// Templates see aazNotification fields, e.g. {{.Host}}; json quotes a value as JSON string.
+	return template.New("webhook").Funcs(template.FuncMap{"json": func(v interface{}) (string, error) {
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	}}).Parse(text)
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(name string, target string, payload []byte, headers map[string]string) error {
+	// POSTs payload as JSON, with retries. Errors never contain the URL: Slack and Teams URLs are secrets.
+	return currentRetryPolicy().do(fmt.Sprintf("Webhook '%s'", name), func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(payload))
+		if err != nil {
+			return withoutURL(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := webhookHTTPClient.Do(req)
+		if err != nil {
+			return withoutURL(err)
+		}
+		defer resp.Body.Close()
+		return httpStatusError(resp)
+	})
+}
+
+func withoutURL(err error) error {
+	// Strips the URL net/http puts into errors (Post "https://...": EOF), keeping the cause.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
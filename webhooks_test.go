@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebhook records the requests received.
+type fakeWebhook struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	status   int // answer, 200 if 0
+}
+
+func newFakeWebhook(t *testing.T) *fakeWebhook {
+	fake := &fakeWebhook{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		fake.requests = append(fake.requests, r)
+		fake.bodies = append(fake.bodies, string(body))
+		if fake.status != 0 {
+			w.WriteHeader(fake.status)
+		}
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (fake *fakeWebhook) received() []string {
+	waitForWebhooks(5 * time.Second)
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]string{}, fake.bodies...)
+}
+
+func setWebhooks(webhooks ...WebhookConfig) {
+	config := currentConfig()
+	config.Webhooks = webhooks
+	setConfig(config, currentACL())
+}
+
+func TestWebhookRender(t *testing.T) {
+	notification := aazNotification{Event: NotifyAction, Action: ScaleDownActionDELETE, Host: "i-0aaa",
+		Message: "AAZ did DELETE Zabbix host 'i-0aaa'"}
+	tests := []struct {
+		webhook WebhookConfig
+		want    string
+	}{
+		{WebhookConfig{Format: WebhookFormatSlack}, `{"text":"AAZ did DELETE Zabbix host 'i-0aaa'"}`},
+		{WebhookConfig{Template: `{"host":{{json .Host}},"what":"{{.Action}}"}`}, `{"host":"i-0aaa","what":"DELETE"}`},
+		{WebhookConfig{}, `"event":"action","action":"DELETE","host":"i-0aaa","message":"AAZ did DELETE Zabbix host 'i-0aaa'"}`},
+		{WebhookConfig{Format: WebhookFormatTeams}, `"@type":"MessageCard"`},
+	}
+	for _, test := range tests {
+		body, err := test.webhook.render(notification)
+		if err != nil || !strings.Contains(string(body), test.want) {
+			t.Errorf("format '%s': got %s, %v; want %s", test.webhook.Format, body, err, test.want)
+		}
+	}
+}
+
+func TestWebhookNotifiesActionsWithSignature(t *testing.T) {
+	zabbix, autoScaling := setupFakes(t, ScaleDownActionDELETE)
+	autoScaling.setGroup("web", "i-0bbb")
+	zabbix.addHosts("i-0aaa", "i-0bbb", "i-0ccc")
+	actions := newFakeWebhook(t)
+	summaries := newFakeWebhook(t)
+	setWebhooks(WebhookConfig{Name: "actions", URL: actions.URL, Events: []string{NotifyAction}, Secret: "s3cret"},
+		WebhookConfig{Name: "summaries", URL: summaries.URL, Format: WebhookFormatSlack, Events: []string{NotifySync}})
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	actions.received() // deliveries run in background; keep their order
+	if err := initalizeHosts(); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := actions.received()
+	if len(bodies) != 2 {
+		t.Fatalf("got %d action notifications, want 2: %v", len(bodies), bodies)
+	}
+	var notification aazNotification
+	json.Unmarshal([]byte(bodies[0]), &notification)
+	if notification.Event != NotifyAction || notification.InstanceId != "i-0aaa" || notification.Action != ScaleDownActionDELETE {
+		t.Errorf("unexpected notification %+v", notification)
+	}
+	if signature := actions.requests[0].Header.Get(WebhookSignatureHeader); signature != "sha256="+webhookSignature("s3cret", []byte(bodies[0])) {
+		t.Errorf("invalid signature '%s'", signature)
+	}
+	if bodies := summaries.received(); len(bodies) != 1 || !strings.Contains(bodies[0], "1 of 2 host(s) changed, 0 failed") {
+		t.Errorf("unexpected sync summaries %v", bodies)
+	}
+}
+
+func TestWebhookNotifiesFailuresAndSafetyLimit(t *testing.T) {
+	zabbix, _ := setupFakes(t, ScaleDownActionDISABLE)
+	zabbix.addHosts("i-0aaa")
+	zabbix.failHost("i-0aaa")
+	webhook := newFakeWebhook(t)
+	setWebhooks(WebhookConfig{Name: "all", URL: webhook.URL})
+
+	postSNS(snsNotification(SNS_EV_Terminate, "i-0aaa", "web"))
+	webhook.received() // deliveries run in background; keep their order
+	initalizeHosts()   // ASG "web" unknown
+
+	var events []string
+	for _, body := range webhook.received() {
+		var notification aazNotification
+		json.Unmarshal([]byte(body), &notification)
+		events = append(events, notification.Event)
+	}
+	if len(events) != 2 || events[0] != NotifyFailure || events[1] != NotifySafetyLimit {
+		t.Errorf("got notifications %v, want [%s %s]", events, NotifyFailure, NotifySafetyLimit)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	webhook := newFakeWebhook(t)
+	webhook.status = http.StatusServiceUnavailable
+	setWebhooks(WebhookConfig{Name: "down", URL: webhook.URL})
+
+	notify(aazNotification{Event: NotifySync, Message: "test"})
+	if bodies := webhook.received(); len(bodies) != currentRetryPolicy().maxAttempts {
+		t.Errorf("got %d attempts, want %d", len(bodies), currentRetryPolicy().maxAttempts)
+	}
+	if statusSnapshot().Errors != 1 {
+		t.Errorf("unexpected status %+v", statusSnapshot())
+	}
+}
+
+func TestWebhookErrorsHideURL(t *testing.T) {
+	setupFakes(t, ScaleDownActionDELETE)
+	webhook := newFakeWebhook(t)
+	target := webhook.URL + "/services/T0000/B0000/secret-token"
+	webhook.Close() // connection refused
+
+	err := postWebhook("ops", target, []byte("{}"), nil)
+	if err == nil || strings.Contains(err.Error(), "secret-token") || !isRetryable(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -1,244 +1,419 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	JSONRPC_Method_UserLogin  = "user.login"
-	JSONRPC_Method_DeleteHost = "host.delete"
-	JSONRPC_Method_UpdateHost = "host.update" // status:1 -> disable
-	JSONRPC_Method_GetHost    = "host.get"
-	JSONRPC_DefaultVersion    = "2.0"
-	JSONRPC_StatusDisableHost = 1
-	JSONRPC_StatusEnableHost  = 0
+	JSONRPC_Method_UserLogin      = "user.login"
+	JSONRPC_Method_UserLogout     = "user.logout"
+	JSONRPC_Method_DeleteHost     = "host.delete"
+	JSONRPC_Method_UpdateHost     = "host.update" // status:1 -> disable
+	JSONRPC_Method_MassUpdateHost = "host.massupdate"
+	JSONRPC_Method_GetHost        = "host.get"
+	JSONRPC_Method_CreateHost     = "host.create"
+	JSONRPC_Method_CreateMaint    = "maintenance.create"
+	JSONRPC_Method_APIVersion     = "apiinfo.version"
+	JSONRPC_DefaultVersion        = "2.0"
+	JSONRPC_StatusDisableHost     = 1
+	JSONRPC_StatusEnableHost      = 0
+
+	DefaultZabbixBatchSize = 100 // hosts per host.delete/host.massupdate call
 )
 
-type JSONRPC_LoginRequest struct {
-	Version string       `json:"jsonrpc"`
-	Method  string       `json:"method"` // user.login
-	Params  JSONRPC_Auth `json:"params"`
-	Id      int          `json:"id"`
+// JSONRPC_Request is the envelope of all Zabbix API requests; Params depend on Method.
+type JSONRPC_Request struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+	Auth    string      `json:"auth,omitempty"` // not sent with user.login
+	Id      int64       `json:"id"`
+}
+
+// JSONRPC_Response is the envelope of all Zabbix API responses; Result is decoded per method.
+type JSONRPC_Response struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *JSONRPC_Error  `json:"error"`
+	Id      int64           `json:"id"`
+}
+type JSONRPC_Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data"`
 }
+
+// https://www.zabbix.com/documentation/3.2/manual/api/reference/user/login
 type JSONRPC_Auth struct {
 	User     string `json:"user"`
 	Password string `json:"password"`
 }
 
 // https://www.zabbix.com/documentation/3.2/manual/api/reference/host/get
-type JSONRPC_GetHostsRequest struct {
-	Version string                 `json:"jsonrpc"`
-	Method  string                 `json:"method"`
-	Params  JSONRPC_GetHostsParams `json:"params"`
-	Auth    string                 `json:"auth"`
-	Id      int                    `json:"id"`
-}
 type JSONRPC_GetHostsParams struct {
 	Output      string  `json:"output"`
 	GroupIds    *string `json:"groupids"`
 	TemplateIds *string `json:"templateids"`
+	SelectTags  string  `json:"selectTags,omitempty"`
 }
-type JSONRPC_GetHostsResponse struct {
-	Version string        `json:"jsonrpc"`
-	Result  []ZabbixHost  `json:"result"`
-	Error   JSONRPC_Error `json:"error"`
-	Id      int           `json:"id"`
+
+type JSONRPC_GetHostsByIdParams struct {
+	Output     []string `json:"output"`
+	HostIds    []string `json:"hostids"`
+	SelectTags string   `json:"selectTags,omitempty"`
 }
 
-// https://www.zabbix.com/documentation/3.2/manual/api/reference/host/delete
-type JSONRPC_DeleteRequest struct {
-	Version string   `json:"jsonrpc"`
-	Method  string   `json:"method"`
-	Params  []string `json:"params"`
-	Auth    string   `json:"auth"`
-	Id      int      `json:"id"`
+// https://www.zabbix.com/documentation/4.2/manual/api/reference/host/object#host_tag
+type JSONRPC_HostTag struct {
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
 }
 
 // https://www.zabbix.com/documentation/3.2/manual/api/reference/host/update
-type JSONRPC_UpdateRequest struct {
-	Version string               `json:"jsonrpc"`
-	Method  string               `json:"method"`
-	Params  JSONRPC_UpdateParams `json:"params"`
-	Auth    string               `json:"auth"`
-	Id      int                  `json:"id"`
-}
 type JSONRPC_UpdateParams struct {
 	Status int    `json:"status"`
 	HostId string `json:"hostid"`
 }
 
-type JSONRPC_Response struct {
-	Version string        `json:"jsonrpc"`
-	Result  string        `json:"result"` // note/fixme: may be array, e.g. hostIds
-	Error   JSONRPC_Error `json:"error"`
-	Id      int           `json:"id"`
+// https://www.zabbix.com/documentation/3.2/manual/api/reference/host/massupdate
+type JSONRPC_MassUpdateParams struct {
+	Hosts  []JSONRPC_HostRef `json:"hosts"`
+	Status int               `json:"status"`
 }
-type JSONRPC_Error struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-	Data    string `json:"data"`
+type JSONRPC_HostRef struct {
+	HostId string `json:"hostid"`
 }
 
-func zabbixGetSession() (string, error) {
-	var LoginRequest JSONRPC_LoginRequest
-	LoginRequest.Method = JSONRPC_Method_UserLogin
-	LoginRequest.Version = JSONRPC_DefaultVersion
-	LoginRequest.Params.User = Config.ZabbixConfig.User
-	LoginRequest.Params.Password = Config.ZabbixConfig.Password
-	jsonRequest, _ := json.Marshal(LoginRequest)
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", Config.ZabbixConfig.URL, strings.NewReader(string(jsonRequest)))
-	req.Header.Set("Content-Type", "application/json-rpc")
-	resp, err := client.Do(req)
+// https://www.zabbix.com/documentation/3.2/manual/api/reference/maintenance/create
+type JSONRPC_MaintenanceParams struct {
+	Name        string                      `json:"name"`
+	ActiveSince int64                       `json:"active_since"`
+	ActiveTill  int64                       `json:"active_till"`
+	HostIds     []string                    `json:"hostids"`
+	TimePeriods []JSONRPC_MaintenancePeriod `json:"timeperiods"`
+}
+type JSONRPC_MaintenancePeriod struct {
+	TimePeriodType int   `json:"timeperiod_type"` // 0: one time only
+	StartDate      int64 `json:"start_date"`
+	Period         int64 `json:"period"` // seconds
+}
+type JSONRPC_MaintenanceIdsResult struct {
+	MaintenanceIds []string `json:"maintenanceids"`
+}
+
+// result of host.delete, host.update and host.massupdate (and other host modifying methods)
+type JSONRPC_HostIdsResult struct {
+	HostIds []string `json:"hostids"`
+}
+
+// Zabbix session (auth token) shared by all API calls; see zabbixGetSession()
+var zabbixSession string
+var zabbixSessionMutex sync.Mutex
 
+var zabbixHTTPClient = &http.Client{}
+var zabbixRequestId int64 // last JSON-RPC request id used
+
+func zabbixGetSession() (string, error) {
+	// Returns the cached Zabbix session, logging in if there is none yet.
+	zabbixSessionMutex.Lock()
+	defer zabbixSessionMutex.Unlock()
+	if zabbixSession != "" {
+		return zabbixSession, nil
+	}
+	session, err := zabbixLogin()
 	if err != nil {
-		return "", errors.New("Failed to post authentication request")
-	} else {
-		defer resp.Body.Close()
-		var result JSONRPC_Response
-		json.NewDecoder(resp.Body).Decode(&result)
-		if result.Error.Code != 0 {
-			return "", errors.New(result.Error.Data)
-		}
-		return result.Result, nil
+		return "", err
+	}
+	zabbixSession = session
+	return session, nil
+}
+
+func zabbixCheckSession(zabbixError JSONRPC_Error) bool {
+	// Drops the cached session if Zabbix reports it as expired, so next call logs in again.
+	if strings.Contains(zabbixError.Data, "re-login") || strings.Contains(zabbixError.Data, "Not authorised") {
+		zabbixSessionMutex.Lock()
+		zabbixSession = ""
+		zabbixSessionMutex.Unlock()
+		return true
 	}
+	return false
 }
 
-func zabbixGetHosts() map[string]ZabbixHost {
-	session, err := zabbixGetSession()
+func zabbixResultError(zabbixError JSONRPC_Error) error {
+	// Converts a JSON-RPC error into an error; an expired session is retryable (after logging in again).
+	if zabbixCheckSession(zabbixError) {
+		return retryable(zabbixError)
+	}
+	return zabbixError
+}
+
+func (e JSONRPC_Error) Error() string {
+	return fmt.Sprintf("Zabbix API error %d: %s %s", e.Code, e.Message, e.Data)
+}
+
+func zabbixCall(ctx context.Context, method string, params interface{}, auth string, result interface{}) error {
+	// Single JSON-RPC call: checks HTTP status and response id, decodes Result into result (unless nil).
+	request := JSONRPC_Request{
+		Version: JSONRPC_DefaultVersion,
+		Method:  method,
+		Params:  params,
+		Auth:    auth,
+		Id:      atomic.AddInt64(&zabbixRequestId, 1),
+	}
+	jsonRequest, err := json.Marshal(request)
 	if err != nil {
-		log.Printf("ERROR: Zabbix authentication failed: %s", err)
-		serverStatus.Errors = serverStatus.Errors + 1
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", currentConfig().ZabbixConfig.URL, bytes.NewReader(jsonRequest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json-rpc")
+	resp, err := zabbixHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := httpStatusError(resp); err != nil {
+		return err
+	}
+	var response JSONRPC_Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return decodeError{"Zabbix " + method, err}
+	}
+	if response.Id != request.Id {
+		return decodeError{"Zabbix " + method, fmt.Errorf("response id %d does not match request id %d", response.Id, request.Id)}
+	}
+	if response.Error != nil {
+		return zabbixResultError(*response.Error)
+	}
+	if result == nil {
 		return nil
 	}
-	var resultHostMap = map[string]ZabbixHost{}
-	var GetHostsRequest JSONRPC_GetHostsRequest
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return decodeError{"Zabbix " + method, err}
+	}
+	return nil
+}
+
+func zabbixAPI(method string, params interface{}, result interface{}) error {
+	// Calls method using the shared session, with retries (logging in again if the session expired).
+	attempt := 0
+	return currentRetryPolicy().do("Zabbix "+method, func(ctx context.Context) error {
+		attempt++
+		session, err := zabbixGetSession()
+		if err != nil {
+			return err
+		}
+		err = zabbixCall(ctx, method, params, session, result)
+		if err != nil && attempt > 1 && method == JSONRPC_Method_DeleteHost {
+			return zabbixCheckDeleted(ctx, params, session, result, err)
+		}
+		return err
+	})
+}
+
+func zabbixCheckDeleted(ctx context.Context, params interface{}, session string, result interface{}, err error) error {
+	// A host.delete retried after a timeout fails if the previous attempt was applied nonetheless
+	// ("No permissions to referred object or it does not exist"). If none of the hosts exist
+	// anymore, that counts as success; otherwise err is returned.
+	hostIds, ok := params.([]string)
+	if !ok {
+		return err
+	}
+	var existing []ZabbixHost
+	if zabbixCall(ctx, JSONRPC_Method_GetHost, JSONRPC_GetHostsByIdParams{Output: []string{"hostid"}, HostIds: hostIds}, session, &existing) != nil ||
+		len(existing) > 0 {
+		return err
+	}
+	log.Printf("NOTICE: Retried %s failed, but hosts %s are gone -- deleted by previous attempt: %s", JSONRPC_Method_DeleteHost, hostIds, err)
+	if deleted, ok := result.(*JSONRPC_HostIdsResult); ok {
+		deleted.HostIds = hostIds
+	}
+	return nil
+}
+
+func zabbixLogout() {
+	zabbixSessionMutex.Lock()
+	defer zabbixSessionMutex.Unlock()
+	if zabbixSession == "" {
+		return
+	}
+	session := zabbixSession
+	zabbixSession = ""
+
+	// single attempt only -- the session expires on its own anyway
+	ctx, cancel := context.WithTimeout(context.Background(), currentRetryPolicy().callTimeout)
+	defer cancel()
+	if err := zabbixCall(ctx, JSONRPC_Method_UserLogout, []string{}, session, nil); err != nil {
+		log.Printf("WARNING: Zabbix logout failed: %s", err)
+		return
+	}
+	log.Print("Logged out of Zabbix")
+}
+
+func zabbixLogin() (string, error) {
+	config := currentConfig()
+	params := JSONRPC_Auth{User: config.ZabbixConfig.User, Password: config.ZabbixConfig.Password}
+
+	// single attempt; callers retry as a whole, including the login
+	ctx, cancel := context.WithTimeout(context.Background(), currentRetryPolicy().callTimeout)
+	defer cancel()
+	var session string
+	if err := zabbixCall(ctx, JSONRPC_Method_UserLogin, params, "", &session); err != nil {
+		return "", err
+	}
+	return session, nil
+}
+
+func zabbixAPIVersion() (string, error) {
+	// Zabbix refuses apiinfo.version with a session, so this is called without one.
+	var version string
+	err := currentRetryPolicy().do("Zabbix "+JSONRPC_Method_APIVersion, func(ctx context.Context) error {
+		return zabbixCall(ctx, JSONRPC_Method_APIVersion, []string{}, "", &version)
+	})
+	return version, err
+}
+
+func zabbixSupportsHostTags(version string) bool {
+	// Host tags were added in Zabbix 4.2.
+	var major, minor int
+	fmt.Sscanf(version, "%d.%d", &major, &minor)
+	return major > 4 || (major == 4 && minor >= 2)
+}
+
+func zabbixGetHosts() ([]ZabbixHost, error) {
+	// Returns matching hosts. Errors are JSONRPC_Error, decodeError or network errors.
+	config := currentConfig()
 
 	// use nil pointer to make empty fields in marshalled json "null"
 	var groupId *string = nil
 	var templateId *string = nil
-	groupIdValue := strconv.Itoa(Config.ZabbixConfig.RestrictToGroupId)
+	groupIdValue := strconv.Itoa(config.ZabbixConfig.RestrictToGroupId)
 	if groupIdValue != "0" {
 		groupId = &groupIdValue
 	}
-	templateIdValue := strconv.Itoa(Config.ZabbixConfig.RestrictToTemplateId)
+	templateIdValue := strconv.Itoa(config.ZabbixConfig.RestrictToTemplateId)
 	if templateIdValue != "0" {
 		templateId = &templateIdValue
 	}
+	params := JSONRPC_GetHostsParams{Output: "extend", GroupIds: groupId, TemplateIds: templateId}
+	if config.ZabbixConfig.ReEnableHosts {
+		// host tags exist since Zabbix 4.2 only
+		params.SelectTags = "extend"
+	}
 
-	GetHostsRequest.Auth = session
-	GetHostsRequest.Version = JSONRPC_DefaultVersion
-	GetHostsRequest.Method = JSONRPC_Method_GetHost
-	GetHostsRequest.Params.Output = "extend"
-	GetHostsRequest.Params.GroupIds = groupId
-	GetHostsRequest.Params.TemplateIds = templateId
+	var hosts []ZabbixHost
+	if err := zabbixAPI(JSONRPC_Method_GetHost, params, &hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
 
-	jsonRequest, _ := json.Marshal(GetHostsRequest)
-	//log.Print(string(jsonRequest))
+func zabbixDeleteHosts(hostIds []string) map[string]error {
+	// Deletes hosts in chunks of ZabbixConfig.BatchSize; returns the result per hostid.
+	return zabbixBatch(JSONRPC_Method_DeleteHost, hostIds, func(chunk []string) interface{} {
+		return chunk
+	})
+}
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", Config.ZabbixConfig.URL, strings.NewReader(string(jsonRequest)))
-	req.Header.Set("Content-Type", "application/json-rpc")
-	resp, err := client.Do(req)
+func zabbixDisableHosts(hostIds []string) map[string]error {
+	// Disables hosts using host.massupdate in chunks of ZabbixConfig.BatchSize; returns the result per hostid.
+	return zabbixBatch(JSONRPC_Method_MassUpdateHost, hostIds, func(chunk []string) interface{} {
+		params := JSONRPC_MassUpdateParams{Status: JSONRPC_StatusDisableHost}
+		for _, hostId := range chunk {
+			params.Hosts = append(params.Hosts, JSONRPC_HostRef{HostId: hostId})
+		}
+		return params
+	})
+}
 
-	if err != nil {
-		log.Print("ERROR: Failed to post getHosts request")
-		serverStatus.Errors = serverStatus.Errors + 1
-		return nil
-	} else {
-		defer resp.Body.Close()
-		var result JSONRPC_GetHostsResponse
-		json.NewDecoder(resp.Body).Decode(&result)
-		if result.Error.Code != 0 {
-			log.Printf("ERROR: zabbixGetHosts failed: %s", result.Error.Data)
-			serverStatus.Errors = serverStatus.Errors + 1
-			return nil
+func zabbixBatch(method string, hostIds []string, params func(chunk []string) interface{}) map[string]error {
+	// Zabbix rejects a whole host.delete/host.massupdate if any single host fails (e.g. was
+	// deleted meanwhile), so chunks failing permanently are retried host by host.
+	results := map[string]error{}
+	batchSize := currentConfig().ZabbixConfig.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultZabbixBatchSize
+	}
+	for start := 0; start < len(hostIds); start += batchSize {
+		chunk := hostIds[start:min(start+batchSize, len(hostIds))]
+		var result JSONRPC_HostIdsResult
+		err := zabbixAPI(method, params(chunk), &result)
+		if err != nil && len(chunk) > 1 && !isRetryable(err) {
+			log.Printf("WARNING: %s failed for %d hosts, retrying one by one: %s", method, len(chunk), err)
+			countWarning()
+			for _, hostId := range chunk {
+				results[hostId] = zabbixBatch(method, []string{hostId}, params)[hostId]
+			}
+			continue
 		}
-		for _, host := range result.Result {
-			resultHostMap[host.Host] = host
+		for _, hostId := range chunk {
+			if err != nil {
+				results[hostId] = err
+			} else {
+				results[hostId] = result.verify(method, hostId)
+			}
 		}
-		return resultHostMap
 	}
+	return results
 }
 
-func zabbixDeleteHost(hostId string) {
-	session, err := zabbixGetSession()
-	if err != nil {
-		log.Printf("ERROR: Zabbix authentication failed: %s", err)
-		serverStatus.Errors = serverStatus.Errors + 1
-		return
+func zabbixCreateMaintenance(name string, hostIds []string, duration time.Duration) error {
+	// Creates a one-time maintenance period (with data collection) for hosts, starting now.
+	now := time.Now().Unix()
+	period := int64(duration / time.Second)
+	params := JSONRPC_MaintenanceParams{Name: name, ActiveSince: now, ActiveTill: now + period, HostIds: hostIds,
+		TimePeriods: []JSONRPC_MaintenancePeriod{{TimePeriodType: 0, StartDate: now, Period: period}}}
+	var result JSONRPC_MaintenanceIdsResult
+	if err := zabbixAPI(JSONRPC_Method_CreateMaint, params, &result); err != nil {
+		return err
 	}
-
-	hostToDelete := []string{hostId}
-	var DeleteRequest JSONRPC_DeleteRequest
-	DeleteRequest.Auth = session
-	DeleteRequest.Method = JSONRPC_Method_DeleteHost
-	DeleteRequest.Params = hostToDelete
-	DeleteRequest.Version = JSONRPC_DefaultVersion
-	jsonRequest, _ := json.Marshal(DeleteRequest)
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", Config.ZabbixConfig.URL, strings.NewReader(string(jsonRequest)))
-	req.Header.Set("Content-Type", "application/json-rpc")
-	resp, err := client.Do(req)
-
-	if err != nil {
-		log.Printf("ERROR: Failed to post delete request for hostId %s", hostId)
-		serverStatus.Errors = serverStatus.Errors + 1
-	} else {
-		defer resp.Body.Close()
-		var result JSONRPC_Response
-		json.NewDecoder(resp.Body).Decode(&result)
-		if result.Error.Code != 0 {
-			log.Printf("ERROR: Failed to DELETE host %s: %s", hostId, result.Error.Data)
-			serverStatus.Errors = serverStatus.Errors + 1
-			return
-		}
-		log.Printf("SUCCESS: Deleted host %s", hostId)
+	if len(result.MaintenanceIds) == 0 {
+		return fmt.Errorf("%s returned no maintenanceid", JSONRPC_Method_CreateMaint)
 	}
+	return nil
 }
 
-func zabbixDisableHost(hostId string) {
-	session, err := zabbixGetSession()
-	if err != nil {
-		log.Printf("Zabbix authentication failed: %s", err)
-		serverStatus.Errors = serverStatus.Errors + 1
-		return
+func zabbixGetHostTags(hostId string) ([]JSONRPC_HostTag, error) {
+	// Returns the tags a host has right now; the inventory may lag behind (tags set by enrichment or operators).
+	params := JSONRPC_GetHostsByIdParams{Output: []string{"hostid"}, HostIds: []string{hostId}, SelectTags: "extend"}
+	var hosts []ZabbixHost
+	if err := zabbixAPI(JSONRPC_Method_GetHost, params, &hosts); err != nil {
+		return nil, err
 	}
+	if len(hosts) != 1 {
+		return nil, fmt.Errorf("%s did not return hostid %s", JSONRPC_Method_GetHost, hostId)
+	}
+	return hosts[0].Tags, nil
+}
 
-	var UpdateRequest JSONRPC_UpdateRequest
-	UpdateRequest.Auth = session
-	UpdateRequest.Method = JSONRPC_Method_UpdateHost
-	UpdateRequest.Params.HostId = hostId
-	UpdateRequest.Params.Status = JSONRPC_StatusDisableHost
-	UpdateRequest.Version = JSONRPC_DefaultVersion
-	jsonRequest, _ := json.Marshal(UpdateRequest)
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", Config.ZabbixConfig.URL, strings.NewReader(string(jsonRequest)))
-	req.Header.Set("Content-Type", "application/json-rpc")
-	resp, err := client.Do(req)
+func zabbixUpdateHost(hostId string, params map[string]interface{}) error {
+	// Updates a single host; params are host properties, e.g. "status" or "tags" (replacing all tags).
+	params["hostid"] = hostId
+	var result JSONRPC_HostIdsResult
+	if err := zabbixAPI(JSONRPC_Method_UpdateHost, params, &result); err != nil {
+		return err
+	}
+	return result.verify(JSONRPC_Method_UpdateHost, hostId)
+}
 
-	if err != nil {
-		log.Printf("ERROR: Failed to post disable request for hostId %s", hostId)
-		serverStatus.Errors = serverStatus.Errors + 1
-	} else {
-		defer resp.Body.Close()
-		var result JSONRPC_Response
-		json.NewDecoder(resp.Body).Decode(&result)
-		if result.Error.Code != 0 {
-			log.Printf("ERROR: Failed to DISABLE host %s: %s", hostId, result.Error.Data)
-			serverStatus.Errors = serverStatus.Errors + 1
-			return
-		}
-		log.Printf("SUCCESS: Disabled host %s", hostId)
+func (r JSONRPC_HostIdsResult) verify(method string, hostId string) error {
+	// Zabbix returns ids of hosts actually modified; hostId missing means nothing happened.
+	if !contains(r.HostIds, hostId) {
+		return fmt.Errorf("%s did not act on hostid %s (result hostids: %v)", method, hostId, r.HostIds)
 	}
+	return nil
 }
 
 // see also:
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func zabbixTestServer(t *testing.T, respond func(request JSONRPC_Request) string) *httptest.Server {
+	// Fake Zabbix API answering each request with respond(); the test config points to it.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request JSONRPC_Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid request: %s", err)
+		}
+		fmt.Fprint(w, respond(request))
+	}))
+	setConfig(AAZConfig{ZabbixConfig: ZabbixConfig{URL: server.URL}}, nil)
+	return server
+}
+
+func TestZabbixCallDecodesResult(t *testing.T) {
+	server := zabbixTestServer(t, func(request JSONRPC_Request) string {
+		return fmt.Sprintf(`{"jsonrpc":"2.0","result":{"hostids":["10084"]},"id":%d}`, request.Id)
+	})
+	defer server.Close()
+
+	var result JSONRPC_HostIdsResult
+	if err := zabbixCall(context.Background(), JSONRPC_Method_DeleteHost, []string{"10084"}, "token", &result); err != nil {
+		t.Fatal(err)
+	}
+	if err := result.verify(JSONRPC_Method_DeleteHost, "10084"); err != nil {
+		t.Error(err)
+	}
+	if err := result.verify(JSONRPC_Method_DeleteHost, "10085"); err == nil {
+		t.Error("expected error for hostid missing in result")
+	}
+}
+
+func TestZabbixCallErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  string
+		retryable bool
+	}{
+		{"id mismatch", `{"jsonrpc":"2.0","result":true,"id":0}`, false},
+		{"api error", `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params.","data":"No permissions."},"id":%d}`, false},
+		{"session expired", `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params.","data":"Session terminated, re-login, please."},"id":%d}`, true},
+		{"not json", `<html>Bad Gateway</html>`, false},
+	}
+	for _, test := range tests {
+		server := zabbixTestServer(t, func(request JSONRPC_Request) string {
+			if strings.Contains(test.response, "%d") {
+				return fmt.Sprintf(test.response, request.Id)
+			}
+			return test.response
+		})
+		err := zabbixCall(context.Background(), JSONRPC_Method_UserLogout, []string{}, "token", nil)
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if isRetryable(err) != test.retryable {
+			t.Errorf("%s: isRetryable(%s) = %v", test.name, err, !test.retryable)
+		}
+		server.Close()
+	}
+}
+
+func TestZabbixCallHTTPStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream down", http.StatusBadGateway)
+	}))
+	defer server.Close()
+	setConfig(AAZConfig{ZabbixConfig: ZabbixConfig{URL: server.URL}}, nil)
+
+	err := zabbixCall(context.Background(), JSONRPC_Method_GetHost, nil, "token", nil)
+	if err == nil || !isRetryable(err) {
+		t.Errorf("expected retryable error for HTTP 502, got %v", err)
+	}
+}
+
+func TestZabbixBatchFallsBackToSingleHosts(t *testing.T) {
+	// Zabbix fails host.delete as a whole if one host does not exist.
+	var calls [][]string
+	server := zabbixTestServer(t, func(request JSONRPC_Request) string {
+		if request.Method == JSONRPC_Method_UserLogin {
+			return fmt.Sprintf(`{"jsonrpc":"2.0","result":"token","id":%d}`, request.Id)
+		}
+		var hostIds []string
+		for _, hostId := range request.Params.([]interface{}) {
+			hostIds = append(hostIds, hostId.(string))
+		}
+		calls = append(calls, hostIds)
+		if contains(hostIds, "3") {
+			return fmt.Sprintf(`{"jsonrpc":"2.0","error":{"code":-32500,"message":"Application error.",`+
+				`"data":"No permissions to referred object or it does not exist!"},"id":%d}`, request.Id)
+		}
+		hostIdsJSON, _ := json.Marshal(hostIds)
+		return fmt.Sprintf(`{"jsonrpc":"2.0","result":{"hostids":%s},"id":%d}`, hostIdsJSON, request.Id)
+	})
+	defer server.Close()
+	setConfig(AAZConfig{ZabbixConfig: ZabbixConfig{URL: server.URL, BatchSize: 2}}, nil)
+	defer zabbixLogout()
+
+	results := zabbixDeleteHosts([]string{"1", "2", "3", "4", "5"})
+	for _, hostId := range []string{"1", "2", "4", "5"} {
+		if results[hostId] != nil {
+			t.Errorf("host %s: %s", hostId, results[hostId])
+		}
+	}
+	if results["3"] == nil {
+		t.Error("host 3: expected error")
+	}
+	if expected := "[[1 2] [3 4] [3] [4] [5]]"; fmt.Sprint(calls) != expected {
+		t.Errorf("calls: got %v, want %s", calls, expected)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Zabbix sender protocol, as used by zabbix_sender to feed trapper items:
+// https://www.zabbix.com/documentation/3.2/manual/appendix/items/trapper
+const ZabbixSender_Header = "ZBXD\x01"
+
+type ZabbixSender_Request struct {
+	Request string                `json:"request"` // "sender data"
+	Data    []ZabbixSender_Values `json:"data"`
+}
+type ZabbixSender_Values struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+type ZabbixSender_Response struct {
+	Response string `json:"response"` // "success"
+	Info     string `json:"info"`     // e.g. "processed: 1; failed: 0; total: 1; seconds spent: 0.000055"
+}
+
+func zabbixSend(server string, host string, key string, value string) error {
+	// Sends a single value to a trapper item, with retries.
+	request := ZabbixSender_Request{Request: "sender data", Data: []ZabbixSender_Values{{Host: host, Key: key, Value: value}}}
+	return currentRetryPolicy().do("Zabbix sender "+server, func(ctx context.Context) error {
+		response, err := zabbixSenderCall(ctx, server, request)
+		if err != nil {
+			return err
+		}
+		// Zabbix accepts values for unknown hosts/items, but does not process them
+		if response.Response != "success" || !strings.Contains(response.Info, "failed: 0") {
+			return fmt.Errorf("trapper item %s of host %s not updated: %s %s", key, host, response.Response, response.Info)
+		}
+		return nil
+	})
+}
+
+func zabbixSenderCall(ctx context.Context, server string, request ZabbixSender_Request) (ZabbixSender_Response, error) {
+	var response ZabbixSender_Response
+	data, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return response, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	packet := bytes.NewBufferString(ZabbixSender_Header)
+	binary.Write(packet, binary.LittleEndian, uint64(len(data)))
+	packet.Write(data)
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		return response, err
+	}
+	header := make([]byte, len(ZabbixSender_Header)+8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return response, err
+	}
+	if string(header[:len(ZabbixSender_Header)]) != ZabbixSender_Header {
+		return response, decodeError{"Zabbix sender", errors.New("invalid response header")}
+	}
+	length := binary.LittleEndian.Uint64(header[len(ZabbixSender_Header):])
+	if length > 1<<20 {
+		return response, decodeError{"Zabbix sender", fmt.Errorf("response too large (%d bytes)", length)}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return response, err
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return response, decodeError{"Zabbix sender", err}
+	}
+	return response, nil
+}